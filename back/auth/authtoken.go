@@ -1,13 +1,12 @@
 package auth
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -30,39 +29,116 @@ func AuthToken(token string) http.HandlerFunc {
 	}
 }
 
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	TokenTypeMFA     = "mfa" // 密码已通过、等待第二步验证的临时令牌，不能访问任何业务接口
+
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 7 * 24 * time.Hour
+	MFATokenTTL     = 5 * time.Minute
+)
+
+// Claims 标准 JWT 声明加上业务字段，sub 为账号 ID
 type Claims struct {
-	UserID string `json:"uid"`
-	Role   string `json:"role"`
-	Exp    int64  `json:"exp"`
+	ID       string `json:"jti"`
+	UserID   string `json:"sub"`
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+	Exp      int64  `json:"exp"`
+	Role     string `json:"role"`
+	Type     string `json:"typ"`
+	Version  int    `json:"ver"`
+	// 同一次登录签发、刷新轮换出来的令牌共用一个会话ID，退出登录时整个会话一起吊销
+	SessionID string `json:"sid,omitempty"`
+
+	MustChangePassword bool `json:"mcp,omitempty"` // 改密码前只能访问账号相关接口，改密码后令牌版本变化会重新签发
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+// TokenValidator 由上层注入，检查令牌是否已被吊销、账号令牌版本是否一致
+type TokenValidator interface {
+	ValidateToken(ctx context.Context, claims *Claims) error
+}
+
+var validator TokenValidator
+
+func SetTokenValidator(v TokenValidator) {
+	validator = v
+}
+
+// IssueTokenPair 签发短期访问令牌和配套的刷新令牌，version 为账号当前的令牌版本。
+// sessionID 为空时开始一个新会话，刷新时传入旧令牌的会话ID
+func IssueTokenPair(userID string, role string, version int, mustChangePassword bool, sessionID string) (*TokenPair, error) {
+	if sessionID == "" {
+		var err error
+		if sessionID, err = newTokenID(); err != nil {
+			return nil, err
+		}
+	}
+	access, err := issueToken(userID, role, version, mustChangePassword, TokenTypeAccess, AccessTokenTTL, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := issueToken(userID, role, version, mustChangePassword, TokenTypeRefresh, RefreshTokenTTL, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(AccessTokenTTL / time.Second),
+	}, nil
 }
 
-func IssueToken(userID string, role string, ttl time.Duration) (string, error) {
+func IssueToken(userID string, role string, version int, mustChangePassword bool, tokenType string, ttl time.Duration) (string, error) {
+	return issueToken(userID, role, version, mustChangePassword, tokenType, ttl, "")
+}
+
+func issueToken(userID string, role string, version int, mustChangePassword bool, tokenType string, ttl time.Duration, sessionID string) (string, error) {
 	userID = strings.TrimSpace(userID)
 	role = strings.TrimSpace(role)
 	if userID == "" {
 		return "", errors.New("user id cannot be empty")
 	}
-	if !isValidRole(role) {
+	if !IsValidRole(role) {
 		return "", errors.New("invalid role")
 	}
+	if tokenType != TokenTypeAccess && tokenType != TokenTypeRefresh && tokenType != TokenTypeMFA {
+		return "", errors.New("invalid token type")
+	}
 	if ttl <= 0 {
 		ttl = 24 * time.Hour
 	}
 
-	claims := Claims{
-		UserID: userID,
-		Role:   role,
-		Exp:    time.Now().Add(ttl).Unix(),
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
 	}
-
-	payloadBytes, err := json.Marshal(claims)
+	ks, err := activeKeys()
 	if err != nil {
 		return "", err
 	}
+	now := time.Now()
+	claims := Claims{
+		ID:       jti,
+		UserID:   userID,
+		Issuer:   ks.issuer,
+		IssuedAt: now.Unix(),
+		Exp:      now.Add(ttl).Unix(),
+		Role:     role,
+		Type:     tokenType,
+		Version:  version,
 
-	payload := base64.RawURLEncoding.EncodeToString(payloadBytes)
-	sig := sign(payload)
-	return payload + "." + sig, nil
+		SessionID:          sessionID,
+		MustChangePassword: mustChangePassword,
+	}
+	return signJWT(claims)
 }
 
 func ParseToken(token string) (*Claims, error) {
@@ -70,28 +146,19 @@ func ParseToken(token string) (*Claims, error) {
 	if token == "" {
 		return nil, errors.New("token cannot be empty")
 	}
-	parts := strings.Split(token, ".")
-	if len(parts) != 2 {
-		return nil, errors.New("invalid token")
-	}
-	payload, sig := parts[0], parts[1]
-	if payload == "" || sig == "" {
-		return nil, errors.New("invalid token")
-	}
-	if !hmac.Equal([]byte(sig), []byte(sign(payload))) {
-		return nil, errors.New("invalid token")
-	}
-
-	payloadBytes, err := base64.RawURLEncoding.DecodeString(payload)
+	payloadBytes, ks, err := verifyJWT(token)
 	if err != nil {
-		return nil, errors.New("invalid token")
+		return nil, err
 	}
 
 	var claims Claims
 	if err := json.Unmarshal(payloadBytes, &claims); err != nil {
 		return nil, errors.New("invalid token")
 	}
-	if strings.TrimSpace(claims.UserID) == "" || !isValidRole(claims.Role) {
+	if strings.TrimSpace(claims.UserID) == "" || claims.ID == "" || claims.Issuer != ks.issuer || !IsValidRole(claims.Role) {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Type != TokenTypeAccess && claims.Type != TokenTypeRefresh && claims.Type != TokenTypeMFA {
 		return nil, errors.New("invalid token")
 	}
 	if claims.Exp <= 0 || time.Now().Unix() > claims.Exp {
@@ -110,15 +177,8 @@ func GinAuthMiddleware(allowedRoles ...string) gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
-		token := bearerTokenFromRequest(c.Request)
-		if token == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
-			return
-		}
-
-		claims, err := ParseToken(token)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		claims, ok := authenticate(c)
+		if !ok {
 			return
 		}
 
@@ -134,6 +194,63 @@ func GinAuthMiddleware(allowedRoles ...string) gin.HandlerFunc {
 	}
 }
 
+// GinPermissionMiddleware 要求当前角色拥有任一权限（全局或 :own 均可），
+// :own 权限的归属检查留给 handler 用 Authorize 完成。
+// 还没改掉初始密码的账号一律拒绝，只能访问 GinAuthMiddleware 保护的账号接口
+func GinPermissionMiddleware(perms ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, ok := authenticate(c)
+		if !ok {
+			return
+		}
+		if claims.MustChangePassword {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password change required"})
+			return
+		}
+
+		allowed := false
+		for _, perm := range perms {
+			if ScopeOf(claims.Role, perm) > ScopeNone {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+
+		c.Set("authClaims", claims)
+		c.Next()
+	}
+}
+
+// authenticate 校验访问令牌，失败时已经写入 401
+func authenticate(c *gin.Context) (*Claims, bool) {
+	token := bearerTokenFromRequest(c.Request)
+	if token == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return nil, false
+	}
+
+	claims, err := ParseToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if claims.Type != TokenTypeAccess {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return nil, false
+	}
+	if validator != nil {
+		if err := validator.ValidateToken(c, claims); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return nil, false
+		}
+	}
+	return claims, true
+}
+
 func GetClaims(c *gin.Context) (*Claims, bool) {
 	v, ok := c.Get("authClaims")
 	if !ok {
@@ -154,25 +271,10 @@ func bearerTokenFromRequest(r *http.Request) string {
 	return strings.TrimSpace(authorization)
 }
 
-func sign(payload string) string {
-	mac := hmac.New(sha256.New, []byte(secret()))
-	mac.Write([]byte(payload))
-	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
-}
-
-func secret() string {
-	s := strings.TrimSpace(os.Getenv("AUTH_SECRET"))
-	if s != "" {
-		return s
-	}
-	return "hospital-system-dev-secret"
-}
-
-func isValidRole(role string) bool {
-	switch role {
-	case "patient", "doctor", "admin":
-		return true
-	default:
-		return false
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,406 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+	AlgHS256 = "HS256"
+
+	// 没有配置密钥目录时的开发用共享密钥，生产环境禁止使用
+	defaultSecret = "hospital-system-dev-secret"
+	defaultIssuer = "hospital-system"
+	secretKeyID   = "default"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type signingKey struct {
+	kid     string
+	alg     string
+	private crypto.Signer // 只有公钥的密钥只用于校验旧令牌
+	public  crypto.PublicKey
+	secret  []byte // 仅 HS256
+}
+
+// KeySet 当前可用的密钥：一把用于签发，其余只用于校验，轮换期间新旧令牌都能通过
+type KeySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+	issuer  string
+}
+
+type KeyConfig struct {
+	Dir        string // AUTH_KEYS_DIR，存放 <kid>.pem 私钥或公钥
+	SigningKID string // AUTH_SIGNING_KID，为空时取目录里按文件名排序最后一把私钥
+	Secret     string // AUTH_SECRET，未配置密钥目录时退回 HS256
+	Issuer     string // AUTH_ISSUER
+	Production bool   // APP_ENV=production 或 GIN_MODE=release
+}
+
+func KeyConfigFromEnv() KeyConfig {
+	cfg := KeyConfig{
+		Dir:        strings.TrimSpace(os.Getenv("AUTH_KEYS_DIR")),
+		SigningKID: strings.TrimSpace(os.Getenv("AUTH_SIGNING_KID")),
+		Secret:     strings.TrimSpace(os.Getenv("AUTH_SECRET")),
+		Issuer:     strings.TrimSpace(os.Getenv("AUTH_ISSUER")),
+		Production: strings.EqualFold(strings.TrimSpace(os.Getenv("APP_ENV")), "production") ||
+			strings.EqualFold(strings.TrimSpace(os.Getenv("GIN_MODE")), "release"),
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = defaultIssuer
+	}
+	return cfg
+}
+
+var (
+	keySetMu sync.RWMutex
+	keySet   *KeySet
+)
+
+// LoadKeys 启动时加载签名密钥，生产环境下仍在用默认密钥会直接报错
+func LoadKeys(cfg KeyConfig) error {
+	ks, err := loadKeySet(cfg)
+	if err != nil {
+		return err
+	}
+	keySetMu.Lock()
+	keySet = ks
+	keySetMu.Unlock()
+	return nil
+}
+
+// SigningKeyInfo 返回当前签发用的 kid 和算法，便于启动日志核对
+func SigningKeyInfo() (kid string, alg string, err error) {
+	ks, err := activeKeys()
+	if err != nil {
+		return "", "", err
+	}
+	return ks.signing.kid, ks.signing.alg, nil
+}
+
+// Issuer 令牌的 iss，也用作验证器 App 里显示的发行方
+func Issuer() string {
+	ks, err := activeKeys()
+	if err != nil {
+		return defaultIssuer
+	}
+	return ks.issuer
+}
+
+func activeKeys() (*KeySet, error) {
+	keySetMu.RLock()
+	ks := keySet
+	keySetMu.RUnlock()
+	if ks != nil {
+		return ks, nil
+	}
+	// 没有显式调用 LoadKeys（比如工具脚本）时按环境变量加载一次
+	if err := LoadKeys(KeyConfigFromEnv()); err != nil {
+		return nil, err
+	}
+	keySetMu.RLock()
+	defer keySetMu.RUnlock()
+	return keySet, nil
+}
+
+func loadKeySet(cfg KeyConfig) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]*signingKey{}, issuer: cfg.Issuer}
+	if ks.issuer == "" {
+		ks.issuer = defaultIssuer
+	}
+
+	if cfg.Dir == "" {
+		secret := cfg.Secret
+		if cfg.Production && (secret == "" || secret == defaultSecret) {
+			return nil, errors.New("refusing to start in production with the default token secret: set AUTH_KEYS_DIR or AUTH_SECRET")
+		}
+		if secret == "" {
+			secret = defaultSecret
+		}
+		key := &signingKey{kid: secretKeyID, alg: AlgHS256, secret: []byte(secret)}
+		ks.keys[key.kid] = key
+		ks.signing = key
+		return ks, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var lastPrivate *signingKey
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+		key, err := readPEMKey(file, kid)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys[kid] = key
+		if key.private != nil {
+			lastPrivate = key
+		}
+	}
+
+	if cfg.SigningKID != "" {
+		key, ok := ks.keys[cfg.SigningKID]
+		if !ok || key.private == nil {
+			return nil, fmt.Errorf("signing key %q not found in %s", cfg.SigningKID, cfg.Dir)
+		}
+		ks.signing = key
+	} else {
+		ks.signing = lastPrivate
+	}
+	if ks.signing == nil {
+		return nil, fmt.Errorf("no private key found in %s", cfg.Dir)
+	}
+	return ks, nil
+}
+
+func readPEMKey(file string, kid string) (*signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", file)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", file, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	key := &signingKey{kid: kid}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.private, key.public = k, &k.PublicKey
+	case *ecdsa.PrivateKey:
+		key.private, key.public = k, &k.PublicKey
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		key.public = k
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T", file, parsed)
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%s: RSA key must be at least 2048 bits", file)
+		}
+		key.alg = AlgRS256
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("%s: EC key must use P-256", file)
+		}
+		key.alg = AlgES256
+	}
+	return key, nil
+}
+
+// signJWT 用当前签发密钥把 claims 编码成 header.payload.signature
+func signJWT(claims interface{}) (string, error) {
+	ks, err := activeKeys()
+	if err != nil {
+		return "", err
+	}
+	key := ks.signing
+
+	header, err := json.Marshal(jwtHeader{Alg: key.alg, Typ: "JWT", Kid: key.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	sig, err := key.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyJWT 按 kid 找到密钥校验签名，返回 payload 原文
+func verifyJWT(token string) ([]byte, *KeySet, error) {
+	ks, err := activeKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	key, ok := ks.keys[header.Kid]
+	// 算法以服务端密钥为准，防止把公钥当 HMAC 密钥之类的算法混淆攻击
+	if !ok || header.Alg != key.alg {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	return payload, ks, nil
+}
+
+func (k *signingKey) sign(input []byte) ([]byte, error) {
+	digest := sha256.Sum256(input)
+	switch k.alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case AlgRS256:
+		return rsa.SignPKCS1v15(rand.Reader, k.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case AlgES256:
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS 要求 ES256 签名是定长的 r||s，而不是 ASN.1
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	default:
+		return nil, errors.New("unsupported algorithm " + k.alg)
+	}
+}
+
+func (k *signingKey) verify(input []byte, sig []byte) bool {
+	digest := sha256.Sum256(input)
+	switch k.alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case AlgRS256:
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case AlgES256:
+		if len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k.public.(*ecdsa.PublicKey), digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS 导出所有非对称密钥的公钥，HS256 共享密钥不对外公开
+func JWKS() (*JWKSet, error) {
+	ks, err := activeKeys()
+	if err != nil {
+		return nil, err
+	}
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := &JWKSet{Keys: []JWK{}}
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		switch pub := key.public.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Use: "sig",
+				Alg: key.alg,
+				Kid: kid,
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case *ecdsa.PublicKey:
+			x := make([]byte, 32)
+			y := make([]byte, 32)
+			pub.X.FillBytes(x)
+			pub.Y.FillBytes(y)
+			set.Keys = append(set.Keys, JWK{
+				Kty: "EC",
+				Use: "sig",
+				Alg: key.alg,
+				Kid: kid,
+				Crv: "P-256",
+				X:   base64.RawURLEncoding.EncodeToString(x),
+				Y:   base64.RawURLEncoding.EncodeToString(y),
+			})
+		}
+	}
+	return set, nil
+}
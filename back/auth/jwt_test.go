@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePEM(t *testing.T, dir string, kid string, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeRSAKey(t *testing.T, dir string, kid string, bits int) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	return key
+}
+
+func writeECKey(t *testing.T, dir string, kid string, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "EC PRIVATE KEY", der)
+	return key
+}
+
+func writePublicKey(t *testing.T, dir string, kid string, pub interface{}) {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, dir, kid, "PUBLIC KEY", der)
+}
+
+// useKeys 加载测试用密钥，测试结束后恢复原来的全局密钥
+func useKeys(t *testing.T, cfg KeyConfig) {
+	t.Helper()
+	keySetMu.RLock()
+	previous := keySet
+	keySetMu.RUnlock()
+	t.Cleanup(func() {
+		keySetMu.Lock()
+		keySet = previous
+		keySetMu.Unlock()
+	})
+	if err := LoadKeys(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadKeySet(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, dir string)
+		cfg      KeyConfig
+		useDir   bool
+		wantErr  string
+		wantKID  string
+		wantAlg  string
+		wantKeys int
+	}{
+		{name: "dev secret fallback", cfg: KeyConfig{}, wantKID: secretKeyID, wantAlg: AlgHS256, wantKeys: 1},
+		{name: "configured secret", cfg: KeyConfig{Secret: "s3cret"}, wantKID: secretKeyID, wantAlg: AlgHS256, wantKeys: 1},
+		{name: "production rejects default secret", cfg: KeyConfig{Production: true}, wantErr: "production"},
+		{name: "production rejects explicit default secret", cfg: KeyConfig{Production: true, Secret: defaultSecret}, wantErr: "production"},
+		{name: "production with own secret", cfg: KeyConfig{Production: true, Secret: "s3cret"}, wantKID: secretKeyID, wantAlg: AlgHS256, wantKeys: 1},
+		{
+			name:   "last private key signs by default",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				writeRSAKey(t, dir, "2025-01", 2048)
+				writeECKey(t, dir, "2026-01", elliptic.P256())
+			},
+			wantKID: "2026-01", wantAlg: AlgES256, wantKeys: 2,
+		},
+		{
+			name:   "signing kid selects key",
+			useDir: true,
+			cfg:    KeyConfig{SigningKID: "2025-01"},
+			setup: func(t *testing.T, dir string) {
+				writeRSAKey(t, dir, "2025-01", 2048)
+				writeECKey(t, dir, "2026-01", elliptic.P256())
+			},
+			wantKID: "2025-01", wantAlg: AlgRS256, wantKeys: 2,
+		},
+		{
+			name:   "public key kept for verification only",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				old := writeECKey(t, dir, "tmp", elliptic.P256())
+				os.Remove(filepath.Join(dir, "tmp.pem"))
+				writePublicKey(t, dir, "2024-01", &old.PublicKey)
+				writeECKey(t, dir, "2026-01", elliptic.P256())
+			},
+			wantKID: "2026-01", wantAlg: AlgES256, wantKeys: 2,
+		},
+		{
+			name:   "unknown signing kid",
+			useDir: true,
+			cfg:    KeyConfig{SigningKID: "missing"},
+			setup: func(t *testing.T, dir string) {
+				writeECKey(t, dir, "2026-01", elliptic.P256())
+			},
+			wantErr: "not found",
+		},
+		{
+			name:   "signing kid must be a private key",
+			useDir: true,
+			cfg:    KeyConfig{SigningKID: "pub"},
+			setup: func(t *testing.T, dir string) {
+				key := writeECKey(t, dir, "2026-01", elliptic.P256())
+				writePublicKey(t, dir, "pub", &key.PublicKey)
+			},
+			wantErr: "not found",
+		},
+		{
+			name:   "only public keys",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				writePublicKey(t, dir, "pub", &key.PublicKey)
+			},
+			wantErr: "no private key",
+		},
+		{name: "empty key directory", useDir: true, setup: func(t *testing.T, dir string) {}, wantErr: "no private key"},
+		{
+			name:   "short RSA key",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				writeRSAKey(t, dir, "weak", 1024)
+			},
+			wantErr: "2048",
+		},
+		{
+			name:   "EC key on wrong curve",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				writeECKey(t, dir, "p384", elliptic.P384())
+			},
+			wantErr: "P-256",
+		},
+		{
+			name:   "unsupported PEM type",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				writePEM(t, dir, "cert", "CERTIFICATE", []byte("x"))
+			},
+			wantErr: "unsupported PEM type",
+		},
+		{
+			name:   "file without PEM block",
+			useDir: true,
+			setup: func(t *testing.T, dir string) {
+				os.WriteFile(filepath.Join(dir, "junk.pem"), []byte("junk"), 0600)
+			},
+			wantErr: "no PEM block",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if tt.useDir {
+				cfg.Dir = t.TempDir()
+				tt.setup(t, cfg.Dir)
+			}
+			ks, err := loadKeySet(cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ks.signing.kid != tt.wantKID || ks.signing.alg != tt.wantAlg {
+				t.Fatalf("signing key = %s/%s, want %s/%s", ks.signing.kid, ks.signing.alg, tt.wantKID, tt.wantAlg)
+			}
+			if len(ks.keys) != tt.wantKeys {
+				t.Fatalf("loaded %d keys, want %d", len(ks.keys), tt.wantKeys)
+			}
+			if ks.issuer != defaultIssuer {
+				t.Fatalf("issuer = %q, want default", ks.issuer)
+			}
+		})
+	}
+}
+
+func TestSignAndVerifyJWT(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "rsa", 2048)
+	writeECKey(t, dir, "ec", elliptic.P256())
+
+	tests := []struct {
+		name string
+		cfg  KeyConfig
+	}{
+		{name: AlgHS256, cfg: KeyConfig{Secret: "s3cret"}},
+		{name: AlgRS256, cfg: KeyConfig{Dir: dir, SigningKID: "rsa"}},
+		{name: AlgES256, cfg: KeyConfig{Dir: dir, SigningKID: "ec"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKeys(t, tt.cfg)
+			token, err := signJWT(map[string]string{"sub": "u1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload, _, err := verifyJWT(token)
+			if err != nil {
+				t.Fatalf("verify own token: %v", err)
+			}
+			if string(payload) != `{"sub":"u1"}` {
+				t.Fatalf("payload = %s", payload)
+			}
+
+			parts := strings.Split(token, ".")
+			var header jwtHeader
+			headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+			json.Unmarshal(headerJSON, &header)
+			if header.Alg != tt.name {
+				t.Fatalf("alg = %s, want %s", header.Alg, tt.name)
+			}
+			reheader := func(h jwtHeader) string {
+				b, _ := json.Marshal(h)
+				return base64.RawURLEncoding.EncodeToString(b)
+			}
+
+			invalid := map[string]string{
+				"tampered payload":   parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2],
+				"tampered signature": parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString([]byte("not a signature")),
+				"alg none":           reheader(jwtHeader{Alg: "none", Typ: "JWT", Kid: header.Kid}) + "." + parts[1] + ".",
+				"alg swapped":        reheader(jwtHeader{Alg: AlgHS256, Typ: "JWT", Kid: header.Kid}) + "." + parts[1] + "." + parts[2],
+				"unknown kid":        reheader(jwtHeader{Alg: header.Alg, Typ: "JWT", Kid: "nope"}) + "." + parts[1] + "." + parts[2],
+				"two segments":       parts[0] + "." + parts[1],
+				"empty":              "",
+				"bad base64 header":  "!!!." + parts[1] + "." + parts[2],
+			}
+			if tt.name == AlgHS256 {
+				delete(invalid, "alg swapped")
+			}
+			for name, bad := range invalid {
+				if _, _, err := verifyJWT(bad); err == nil {
+					t.Errorf("%s: token accepted", name)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyJWTAfterKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	old := writeECKey(t, dir, "2025-01", elliptic.P256())
+	useKeys(t, KeyConfig{Dir: dir})
+	token, err := signJWT(map[string]string{"sub": "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 轮换：旧私钥换成只留公钥，新密钥开始签发
+	os.Remove(filepath.Join(dir, "2025-01.pem"))
+	writePublicKey(t, dir, "2025-01", &old.PublicKey)
+	writeECKey(t, dir, "2026-01", elliptic.P256())
+	useKeys(t, KeyConfig{Dir: dir})
+	if _, _, err := verifyJWT(token); err != nil {
+		t.Fatalf("token signed by the retired key rejected: %v", err)
+	}
+
+	// 旧公钥也移除之后，旧令牌不再有效
+	os.Remove(filepath.Join(dir, "2025-01.pem"))
+	useKeys(t, KeyConfig{Dir: dir})
+	if _, _, err := verifyJWT(token); err == nil {
+		t.Fatal("token accepted after its key was removed")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "rsa", 2048)
+	writeECKey(t, dir, "ec", elliptic.P256())
+
+	tests := []struct {
+		name string
+		cfg  KeyConfig
+		want []string // kid/kty
+	}{
+		{name: "shared secret is never published", cfg: KeyConfig{Secret: "s3cret"}, want: []string{}},
+		{name: "asymmetric keys sorted by kid", cfg: KeyConfig{Dir: dir}, want: []string{"ec/EC", "rsa/RSA"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKeys(t, tt.cfg)
+			set, err := JWKS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(set.Keys))
+			for _, k := range set.Keys {
+				got = append(got, k.Kid+"/"+k.Kty)
+				if k.Use != "sig" {
+					t.Errorf("%s: use = %q", k.Kid, k.Use)
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
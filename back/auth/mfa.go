@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	mfaPolicyMu      sync.RWMutex
+	mfaRequiredRoles = map[string]struct{}{}
+)
+
+// MFARequiredRolesFromEnv 读取 AUTH_MFA_REQUIRED_ROLES（逗号分隔，如 "admin,doctor"），为空表示 MFA 全部可选
+func MFARequiredRolesFromEnv() []string {
+	var roleNames []string
+	for _, name := range strings.Split(os.Getenv("AUTH_MFA_REQUIRED_ROLES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			roleNames = append(roleNames, name)
+		}
+	}
+	return roleNames
+}
+
+// SetMFARequiredRoles 设置必须启用 MFA 的角色，角色需要先通过 LoadRoles 加载
+func SetMFARequiredRoles(roleNames []string) error {
+	required := make(map[string]struct{}, len(roleNames))
+	for _, name := range roleNames {
+		if !IsValidRole(name) {
+			return fmt.Errorf("unknown role %q", name)
+		}
+		required[strings.TrimSpace(name)] = struct{}{}
+	}
+	mfaPolicyMu.Lock()
+	mfaRequiredRoles = required
+	mfaPolicyMu.Unlock()
+	return nil
+}
+
+// MFARequired 该角色的账号是否必须启用 MFA 才能登录
+func MFARequired(role string) bool {
+	mfaPolicyMu.RLock()
+	defer mfaPolicyMu.RUnlock()
+	_, ok := mfaRequiredRoles[role]
+	return ok
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 权限名统一为 <资源>:<操作>，授予角色时可以加 :own 后缀表示只对自己的数据生效
+const (
+	PermPatientRead    = "patient:read"
+	PermPatientReadPII = "patient:read-pii" // 身份证号、电话、住址、紧急联系人
+	PermPatientCreate  = "patient:create"
+	PermPatientUpdate  = "patient:update"
+	PermPatientDelete  = "patient:delete"
+	PermPatientRestore = "patient:restore"
+
+	PermDiseaseRead    = "disease:read"
+	PermDiseaseCreate  = "disease:create"
+	PermDiseaseUpdate  = "disease:update"
+	PermDiseaseDelete  = "disease:delete"
+	PermDiseaseRestore = "disease:restore"
+
+	PermDoctorRead    = "doctor:read"
+	PermDoctorCreate  = "doctor:create"
+	PermDoctorUpdate  = "doctor:update"
+	PermDoctorDelete  = "doctor:delete"
+	PermDoctorRestore = "doctor:restore"
+
+	PermDepartmentRead    = "department:read"
+	PermDepartmentCreate  = "department:create"
+	PermDepartmentUpdate  = "department:update"
+	PermDepartmentDelete  = "department:delete"
+	PermDepartmentRestore = "department:restore"
+
+	PermRegistrationRead         = "registration:read"
+	PermRegistrationCreate       = "registration:create"
+	PermRegistrationUpdate       = "registration:update"
+	PermRegistrationUpdateStatus = "registration:update-status" // 只能改状态，不能改就诊信息
+	PermRegistrationCheckIn      = "registration:check-in"      // 前台签到
+	PermRegistrationMarkNoShow   = "registration:no-show"       // 前台标记爽约
+	PermRegistrationCancel       = "registration:cancel"        // 取消挂号，必须填写原因
+	PermRegistrationDelete       = "registration:delete"
+	PermRegistrationRestore      = "registration:restore"
+
+	PermAccountManage = "account:manage" // 创建员工账号、分配医生账号、重置密码、停用和解锁账号
+	PermAuditRead     = "audit:read"
+	PermDashboardRead = "dashboard:read" // 首页统计和最近动态
+)
+
+var knownPermissions = map[string]struct{}{}
+
+func init() {
+	for _, p := range []string{
+		PermPatientRead, PermPatientReadPII, PermPatientCreate, PermPatientUpdate, PermPatientDelete, PermPatientRestore,
+		PermDiseaseRead, PermDiseaseCreate, PermDiseaseUpdate, PermDiseaseDelete, PermDiseaseRestore,
+		PermDoctorRead, PermDoctorCreate, PermDoctorUpdate, PermDoctorDelete, PermDoctorRestore,
+		PermDepartmentRead, PermDepartmentCreate, PermDepartmentUpdate, PermDepartmentDelete, PermDepartmentRestore,
+		PermRegistrationRead, PermRegistrationCreate, PermRegistrationUpdate, PermRegistrationUpdateStatus,
+		PermRegistrationCheckIn, PermRegistrationMarkNoShow, PermRegistrationCancel,
+		PermRegistrationDelete, PermRegistrationRestore,
+		PermAccountManage, PermAuditRead, PermDashboardRead,
+	} {
+		knownPermissions[p] = struct{}{}
+	}
+	if err := setRoles(defaultRolesJSON); err != nil {
+		panic("auth: invalid built-in roles.json: " + err.Error())
+	}
+}
+
+// Scope 权限的生效范围
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopeOwn        // 只能操作自己的数据，是否属于自己由 OwnershipPolicy 判断
+	ScopeAll
+)
+
+// RoleConfig 单个角色的配置。linkedEntity 说明账号的 linkedId 指向哪类档案，
+// 归属判断（医生的挂号、病人的档案）依赖它
+type RoleConfig struct {
+	Label        string   `json:"label"`
+	LinkedEntity string   `json:"linkedEntity,omitempty"`
+	Permissions  []string `json:"permissions"`
+	Pages        []string `json:"pages,omitempty"` // 前端可见的菜单
+}
+
+type RolesConfig struct {
+	Roles map[string]RoleConfig `json:"roles"`
+}
+
+type role struct {
+	config RoleConfig
+	grants map[string]Scope
+}
+
+//go:embed roles.json
+var defaultRolesJSON []byte
+
+var (
+	rolesMu sync.RWMutex
+	roles   map[string]*role
+)
+
+// RolesFileFromEnv 角色配置文件：优先 AUTH_ROLES_FILE，其次数据目录下的 roles.json，都没有时用内置配置
+func RolesFileFromEnv(dataDir string) string {
+	if file := strings.TrimSpace(os.Getenv("AUTH_ROLES_FILE")); file != "" {
+		return file
+	}
+	file := filepath.Join(dataDir, "roles.json")
+	if _, err := os.Stat(file); err == nil {
+		return file
+	}
+	return ""
+}
+
+// LoadRoles 加载角色配置，file 为空时使用内置的 roles.json
+func LoadRoles(file string) error {
+	data := defaultRolesJSON
+	if file != "" {
+		var err error
+		if data, err = os.ReadFile(file); err != nil {
+			return err
+		}
+	}
+	return setRoles(data)
+}
+
+func setRoles(data []byte) error {
+	var cfg RolesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	if len(cfg.Roles) == 0 {
+		return errors.New("no roles defined")
+	}
+
+	parsed := make(map[string]*role, len(cfg.Roles))
+	for name, rc := range cfg.Roles {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return errors.New("role name cannot be empty")
+		}
+		switch rc.LinkedEntity {
+		case "", "patient", "doctor":
+		default:
+			return fmt.Errorf("role %s: unsupported linkedEntity %q", name, rc.LinkedEntity)
+		}
+		r := &role{config: rc, grants: map[string]Scope{}}
+		for _, grant := range rc.Permissions {
+			perm, scope, err := parseGrant(grant)
+			if err != nil {
+				return fmt.Errorf("role %s: %w", name, err)
+			}
+			if scope > r.grants[perm] {
+				r.grants[perm] = scope
+			}
+		}
+		parsed[name] = r
+	}
+
+	rolesMu.Lock()
+	roles = parsed
+	rolesMu.Unlock()
+	return nil
+}
+
+// parseGrant 解析 "registration:read"、"registration:read:own"、"registration:*"、"*" 这几种写法
+func parseGrant(grant string) (string, Scope, error) {
+	grant = strings.TrimSpace(grant)
+	scope := ScopeAll
+	if strings.HasSuffix(grant, ":own") {
+		grant = strings.TrimSuffix(grant, ":own")
+		scope = ScopeOwn
+	}
+	if grant == "*" {
+		return grant, scope, nil
+	}
+	parts := strings.Split(grant, ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", ScopeNone, fmt.Errorf("invalid permission %q", grant)
+	}
+	if parts[1] == "*" {
+		for known := range knownPermissions {
+			if strings.HasPrefix(known, parts[0]+":") {
+				return grant, scope, nil
+			}
+		}
+		return "", ScopeNone, fmt.Errorf("unknown resource in permission %q", grant)
+	}
+	if _, ok := knownPermissions[grant]; !ok {
+		return "", ScopeNone, fmt.Errorf("unknown permission %q", grant)
+	}
+	return grant, scope, nil
+}
+
+func lookupRole(name string) (*role, bool) {
+	rolesMu.RLock()
+	defer rolesMu.RUnlock()
+	r, ok := roles[name]
+	return r, ok
+}
+
+func IsValidRole(name string) bool {
+	_, ok := lookupRole(strings.TrimSpace(name))
+	return ok
+}
+
+func RoleInfo(name string) (RoleConfig, bool) {
+	r, ok := lookupRole(name)
+	if !ok {
+		return RoleConfig{}, false
+	}
+	return r.config, true
+}
+
+// RoleNames 当前配置的全部角色，按名称排序
+func RoleNames() []string {
+	rolesMu.RLock()
+	defer rolesMu.RUnlock()
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ScopeOf 角色对某个权限的生效范围，依次匹配精确权限、资源通配和全局通配
+func ScopeOf(roleName string, perm string) Scope {
+	r, ok := lookupRole(roleName)
+	if !ok {
+		return ScopeNone
+	}
+	scope := r.grants[perm]
+	if resource, _, found := strings.Cut(perm, ":"); found {
+		if s := r.grants[resource+":*"]; s > scope {
+			scope = s
+		}
+	}
+	if s := r.grants["*"]; s > scope {
+		scope = s
+	}
+	return scope
+}
+
+// Subject 当前操作人，LinkedID 指向的档案类型由角色的 linkedEntity 决定
+type Subject struct {
+	AccountID string
+	Role      string
+	LinkedID  string
+}
+
+func (s *Subject) LinkedEntity() string {
+	cfg, _ := RoleInfo(s.Role)
+	return cfg.LinkedEntity
+}
+
+func (s *Subject) Scope(perm string) Scope {
+	return ScopeOf(s.Role, perm)
+}
+
+func (s *Subject) Has(perm string) bool {
+	return s.Scope(perm) > ScopeNone
+}
+
+// OwnershipPolicy 判断资源是否属于当前操作人
+type OwnershipPolicy func(s *Subject) bool
+
+// Authorize 有全局权限直接放行；只有 own 权限时由 owns 判断资源归属
+func Authorize(s *Subject, perm string, owns OwnershipPolicy) bool {
+	switch s.Scope(perm) {
+	case ScopeAll:
+		return true
+	case ScopeOwn:
+		return owns != nil && s.LinkedID != "" && owns(s)
+	default:
+		return false
+	}
+}
+
+// Grants 角色拥有的全部权限，供前端按权限控制按钮
+func Grants(roleName string) []string {
+	r, ok := lookupRole(roleName)
+	if !ok {
+		return []string{}
+	}
+	grants := make([]string, 0, len(r.grants))
+	for perm, scope := range r.grants {
+		if scope == ScopeOwn {
+			perm += ":own"
+		}
+		grants = append(grants, perm)
+	}
+	sort.Strings(grants)
+	return grants
+}
@@ -0,0 +1,33 @@
+package auth
+
+import "hospital-system/models"
+
+// 可复用的归属策略，配合 Authorize 处理 :own 权限
+
+// OwnsRegistration 医生看自己接诊的挂号，病人看自己挂的号
+func OwnsRegistration(reg *models.Registration) OwnershipPolicy {
+	return func(s *Subject) bool {
+		switch s.LinkedEntity() {
+		case "doctor":
+			return reg.DoctorID == s.LinkedID
+		case "patient":
+			return reg.PatientID == s.LinkedID
+		default:
+			return false
+		}
+	}
+}
+
+// OwnsPatient 病人账号关联的就是这份档案
+func OwnsPatient(patientID string) OwnershipPolicy {
+	return func(s *Subject) bool {
+		return s.LinkedEntity() == "patient" && s.LinkedID == patientID
+	}
+}
+
+// OwnsDoctor 医生账号关联的就是这份档案
+func OwnsDoctor(doctorID string) OwnershipPolicy {
+	return func(s *Subject) bool {
+		return s.LinkedEntity() == "doctor" && s.LinkedID == doctorID
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// RFC 6238 附录 B 的 SHA1 密钥 "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RFC 给的是 8 位，取后 6 位
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+		{unix: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	key, _ := totpEncoding.DecodeString(rfcSecret)
+	codeAt := func(offset int64) string { return totpCode(key, step+offset) }
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantOK   bool
+		wantStep int64
+	}{
+		{name: "current step", secret: rfcSecret, code: "005924", wantOK: true, wantStep: step},
+		{name: "previous step within skew", secret: rfcSecret, code: codeAt(-1), wantOK: true, wantStep: step - 1},
+		{name: "next step within skew", secret: rfcSecret, code: codeAt(1), wantOK: true, wantStep: step + 1},
+		{name: "two steps old", secret: rfcSecret, code: codeAt(-2), wantOK: false},
+		{name: "two steps ahead", secret: rfcSecret, code: codeAt(2), wantOK: false},
+		{name: "surrounding spaces trimmed", secret: rfcSecret, code: " 005924 ", wantOK: true, wantStep: step},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "005924", wantOK: true, wantStep: step},
+		{name: "wrong code", secret: rfcSecret, code: "000000", wantOK: false},
+		{name: "too short", secret: rfcSecret, code: "05924", wantOK: false},
+		{name: "eight digit code", secret: rfcSecret, code: "89005924", wantOK: false},
+		{name: "invalid secret", secret: "not base32!", code: "005924", wantOK: false},
+		{name: "empty secret", secret: "", code: "005924", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, ok := VerifyTOTP(tt.secret, tt.code, now)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if ok && gotStep != tt.wantStep {
+				t.Fatalf("step = %d, want %d", gotStep, tt.wantStep)
+			}
+		})
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		secret, err := GenerateTOTPSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := totpEncoding.DecodeString(secret)
+		if err != nil || len(key) != 20 {
+			t.Fatalf("secret %q does not decode to 20 bytes: %v", secret, err)
+		}
+		if seen[secret] {
+			t.Fatalf("duplicate secret %q", secret)
+		}
+		seen[secret] = true
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	raw := TOTPProvisioningURI("医院系统", "张三 doctor", rfcSecret)
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		t.Fatalf("unexpected uri %s", raw)
+	}
+	if u.Path != "/医院系统:张三 doctor" {
+		t.Fatalf("label = %q", u.Path)
+	}
+	q := u.Query()
+	want := map[string]string{"secret": rfcSecret, "issuer": "医院系统", "algorithm": "SHA1", "digits": "6", "period": "30"}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+}
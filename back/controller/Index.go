@@ -6,10 +6,18 @@ import (
 )
 
 func Index(ctx *gin.Context) {
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
 	info, err := baseinfo.GetIndexInfo(ctx)
 	if err != nil {
 		ctx.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	// 最近的病人和其他列表一样按 patient:read-pii 脱敏
+	for i := range info {
+		info[i].Patients = maskPatientsPII(subject, info[i].Patients)
+	}
 	ctx.JSON(200, info)
 }
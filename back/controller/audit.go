@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"hospital-system/auth"
+	"hospital-system/models"
+	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GetAuditLogs(ctx *gin.Context) {
+	q := services.AuditQuery{
+		EntityType: ctx.Query("entityType"),
+		EntityID:   ctx.Query("entityId"),
+		ActorID:    ctx.Query("actorId"),
+	}
+
+	var err error
+	if v := ctx.Query("from"); v != "" {
+		if q.From, err = parseQueryTime(v, false); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid from, expected RFC3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+	if v := ctx.Query("to"); v != "" {
+		if q.To, err = parseQueryTime(v, true); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid to, expected RFC3339 or YYYY-MM-DD"})
+			return
+		}
+	}
+	if v := ctx.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid limit"})
+			return
+		}
+	}
+
+	logs, err := resource.AuditService.Query(ctx, q)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, logs)
+}
+
+// recordAudit 以当前登录账号的身份记录一次变更，before/after 为 nil 分别表示新建和删除
+func recordAudit(ctx *gin.Context, entityType string, entityID string, action string, before interface{}, after interface{}) {
+	actorID, actorRole := "", ""
+	if claims, ok := auth.GetClaims(ctx); ok {
+		actorID, actorRole = claims.UserID, claims.Role
+	}
+	recordAuditAs(ctx, actorID, actorRole, entityType, entityID, action, before, after)
+}
+
+// recordChanges 删除、恢复时级联处理的每条记录也以当前账号的身份记录
+func recordChanges(ctx *gin.Context, changes []integrity.Change) {
+	for _, c := range changes {
+		recordAudit(ctx, c.EntityType, c.EntityID, c.Action, c.Before, c.After)
+	}
+}
+
+func recordAuditAs(ctx *gin.Context, actorID string, actorRole string, entityType string, entityID string, action string, before interface{}, after interface{}) {
+	changes, err := services.DiffFields(before, after)
+	if err != nil {
+		log.Println("审计日志记录失败:", err)
+		return
+	}
+	entry := models.AuditLog{
+		ActorID:    actorID,
+		ActorRole:  actorRole,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Changes:    changes,
+		ClientIP:   ctx.ClientIP(),
+	}
+	// 变更已经生效，审计写入失败只记日志，不影响本次请求的结果
+	if err := resource.AuditService.Record(ctx, &entry); err != nil {
+		log.Println("审计日志记录失败:", err)
+	}
+}
@@ -1,12 +1,17 @@
 package controllers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,12 +21,49 @@ type loginRequest struct {
 	Password string `json:"password"`
 }
 
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	All          bool   `json:"all"` // 退出所有设备
+}
+
+type changePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+type accountTargetRequest struct {
+	AccountID string `json:"accountId"`
+	Username  string `json:"username"`
+}
+
+type resetPasswordRequest struct {
+	AccountID   string `json:"accountId"`
+	Username    string `json:"username"`
+	NewPassword string `json:"newPassword"`
+}
+
 type assignDoctorAccountRequest struct {
 	DoctorID string `json:"doctorId"`
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+type createStaffAccountRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type setupRequest struct {
+	SetupToken string `json:"setupToken"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+}
+
 type upsertMyPatientProfileRequest struct {
 	Name             string `json:"name"`
 	Gender           string `json:"gender"`
@@ -33,37 +75,330 @@ type upsertMyPatientProfileRequest struct {
 	EmergencyPhone   string `json:"emergencyPhone"`
 }
 
-func LoginOrRegister(ctx *gin.Context) {
+func Login(ctx *gin.Context) {
 	var req loginRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	account, isNew, err := resource.AccountService.LoginOrRegister(ctx, req.Username, req.Password)
+	account, err := resource.LoginGuard.Login(ctx, req.Username, req.Password, ctx.ClientIP())
+	if err != nil {
+		respondLoginError(ctx, err)
+		return
+	}
+
+	if services.NeedsMFA(account) {
+		respondMFAChallenge(ctx, account)
+		return
+	}
+	respondTokens(ctx, http.StatusOK, account)
+}
+
+func respondLoginError(ctx *gin.Context, err error) {
+	var throttled *services.LoginThrottledError
+	if errors.As(err, &throttled) {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	var locked *services.AccountLockedError
+	if errors.As(err, &locked) {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(locked.Until).Seconds()))))
+		ctx.JSON(http.StatusLocked, gin.H{"error": err.Error(), "lockedUntil": locked.Until})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidCredentials) || errors.Is(err, services.ErrInvalidMFACode) {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrAccountDisabled) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// GetSetupStatus 前端据此决定登录页是否显示"初始化管理员"
+func GetSetupStatus(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"setupRequired": resource.AdminSetup.Pending(ctx)})
+}
+
+// Setup 用启动日志里的一次性初始化令牌创建第一个管理员，成功后直接登录
+func Setup(ctx *gin.Context) {
+	var req setupRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := resource.AdminSetup.Complete(ctx, req.SetupToken, req.Username, req.Password)
 	if err != nil {
-		if err.Error() == "invalid credentials" {
+		switch {
+		case errors.Is(err, services.ErrInvalidSetupToken):
 			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrSetupUnavailable):
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	recordAuditAs(ctx, account.ID, account.Role, "account", account.ID, services.AuditActionCreate, nil, account)
+	if auth.MFARequired(account.Role) {
+		respondSetupEnrollment(ctx, account)
+		return
+	}
+	respondTokens(ctx, http.StatusCreated, account)
+}
+
+// respondSetupEnrollment 管理员角色必须启用 MFA 时，只凭密码签发的令牌用不了；
+// 改为返回绑定码，第一个管理员拿它走登录过程中的绑定流程
+func respondSetupEnrollment(ctx *gin.Context, before *models.Account) {
+	account, code, expiresAt, err := resource.AccountService.IssueMFAEnrollmentCode(ctx, before.ID)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAuditAs(ctx, account.ID, account.Role, "account", account.ID, services.AuditActionUpdate, before, account)
+
+	body := accountView(account)
+	body["mfaEnrollmentRequired"] = true
+	body["enrollmentCode"] = code
+	body["enrollmentCodeExpiresAt"] = expiresAt
+	ctx.JSON(http.StatusCreated, body)
+}
+
+// Register 注册病人账号，注册成功直接返回令牌
+func Register(ctx *gin.Context) {
+	var req loginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := resource.AccountService.Register(ctx, req.Username, req.Password)
+	if err != nil {
+		if errors.Is(err, services.ErrUsernameTaken) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
 			return
 		}
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	token, err := auth.IssueToken(account.ID, account.Role, 72*time.Hour)
+	recordAuditAs(ctx, account.ID, account.Role, "account", account.ID, services.AuditActionCreate, nil, account)
+	respondTokens(ctx, http.StatusCreated, account)
+}
+
+func ChangePassword(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+
+	var req changePasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, _ := resource.AccountService.GetByID(ctx, claims.UserID)
+	account, err := resource.AccountService.ChangePassword(ctx, claims.UserID, req.OldPassword, req.NewPassword)
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "old password is incorrect"})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	// 旧令牌已随令牌版本失效，当前会话换一对新的
+	respondTokens(ctx, http.StatusOK, account)
+}
+
+func ResetPassword(ctx *gin.Context) {
+	var req resetPasswordRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := findAccount(ctx, req.AccountID, req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	account, err := resource.AccountService.ResetPassword(ctx, before.ID, req.NewPassword)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, accountView(account))
+}
+
+func UnlockAccount(ctx *gin.Context) {
+	var req accountTargetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := findAccount(ctx, req.AccountID, req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	account, err := resource.LoginGuard.Unlock(ctx, before)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, accountView(account))
+}
+
+func DisableAccount(ctx *gin.Context) {
+	setAccountDisabled(ctx, true)
+}
+
+func EnableAccount(ctx *gin.Context) {
+	setAccountDisabled(ctx, false)
+}
+
+func setAccountDisabled(ctx *gin.Context, disabled bool) {
+	var req accountTargetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := findAccount(ctx, req.AccountID, req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if disabled && before.ID == actorID(ctx) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "cannot disable your own account"})
+		return
+	}
+	account, err := resource.AccountService.SetDisabled(ctx, before.ID, disabled)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, accountView(account))
+}
+
+// findAccount 管理员接口可以用账号 ID 或用户名指定目标账号
+func findAccount(ctx *gin.Context, accountID string, username string) (*models.Account, error) {
+	if accountID != "" {
+		return resource.AccountService.GetByID(ctx, accountID)
+	}
+	if username != "" {
+		return resource.AccountService.GetByUsername(ctx, username)
+	}
+	return nil, errors.New("accountId or username is required")
+}
+
+func accountView(account *models.Account) gin.H {
+	return gin.H{
+		"id":          account.ID,
+		"username":    account.Username,
+		"role":        account.Role,
+		"linkedId":    account.LinkedID,
+		"disabled":    account.Disabled,
+		"disabledAt":  account.DisabledAt,
+		"lockedUntil": account.LockedUntil,
+		"mfaEnabled":  account.MFAEnabled,
+
+		"mustChangePassword": account.MustChangePassword,
+	}
+}
+
+func respondTokens(ctx *gin.Context, status int, account *models.Account) {
+	body, err := tokenBody(ctx, account)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	ctx.JSON(status, body)
+}
+
+func tokenBody(ctx *gin.Context, account *models.Account) (gin.H, error) {
+	tokens, err := resource.TokenService.Issue(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+		"role":         account.Role,
+		"id":           account.ID,
+
+		"mustChangePassword": account.MustChangePassword,
+	}, nil
+}
+
+func RefreshToken(ctx *gin.Context) {
+	var req refreshTokenRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RefreshToken == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "refreshToken cannot be empty"})
+		return
+	}
+
+	account, tokens, err := resource.TokenService.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
 
 	ctx.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"role":  account.Role,
-		"id":    account.ID,
-		"isNew": isNew,
+		"token":        tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"expiresIn":    tokens.ExpiresIn,
+		"role":         account.Role,
+		"id":           account.ID,
 	})
 }
 
+func Logout(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+
+	// 请求体可以为空，只吊销当前访问令牌
+	var req logoutRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := resource.TokenService.Logout(ctx, claims, req.RefreshToken, req.All); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
 func GetMe(ctx *gin.Context) {
 	claims, ok := auth.GetClaims(ctx)
 	if !ok {
@@ -77,15 +412,26 @@ func GetMe(ctx *gin.Context) {
 		return
 	}
 
+	roleInfo, _ := auth.RoleInfo(account.Role)
 	ctx.JSON(http.StatusOK, gin.H{
-		"id":       account.ID,
-		"username": account.Username,
-		"role":     account.Role,
-		"linkedId": account.LinkedID,
+		"id":           account.ID,
+		"username":     account.Username,
+		"role":         account.Role,
+		"roleLabel":    roleInfo.Label,
+		"linkedId":     account.LinkedID,
+		"linkedEntity": roleInfo.LinkedEntity,
+		"permissions":  auth.Grants(account.Role),
+		"pages":        roleInfo.Pages,
+		"mfaEnabled":   account.MFAEnabled,
+		"mfaRequired":  auth.MFARequired(account.Role),
+
+		"mustChangePassword": account.MustChangePassword,
 	})
 }
 
 func AssignDoctorAccount(ctx *gin.Context) {
+	defer integrity.LockReferences()()
+
 	var req assignDoctorAccountRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -102,11 +448,25 @@ func AssignDoctorAccount(ctx *gin.Context) {
 		return
 	}
 
+	var before *models.Account
+	if linked, err := resource.AccountService.GetByLinkedID(ctx, req.DoctorID); err == nil {
+		for i := range linked {
+			if linked[i].Role == "doctor" {
+				before = &linked[i]
+				break
+			}
+		}
+	}
 	account, err := resource.AccountService.UpsertDoctorAccount(ctx, req.DoctorID, req.Username, req.Password)
 	if err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if before != nil {
+		recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	} else {
+		recordAudit(ctx, "account", account.ID, services.AuditActionCreate, nil, account)
+	}
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"id":       account.ID,
@@ -116,6 +476,28 @@ func AssignDoctorAccount(ctx *gin.Context) {
 	})
 }
 
+// CreateStaffAccount 管理员创建前台等不关联档案的员工账号
+func CreateStaffAccount(ctx *gin.Context) {
+	var req createStaffAccountRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := resource.AccountService.CreateStaffAccount(ctx, req.Username, req.Password, req.Role)
+	if err != nil {
+		if errors.Is(err, services.ErrUsernameTaken) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionCreate, nil, account)
+	ctx.JSON(http.StatusCreated, accountView(account))
+}
+
 func UpsertMyPatientProfile(ctx *gin.Context) {
 	claims, ok := auth.GetClaims(ctx)
 	if !ok {
@@ -128,14 +510,30 @@ func UpsertMyPatientProfile(ctx *gin.Context) {
 		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
 		return
 	}
-	if account.Role != "patient" {
+	// 只有关联病人档案的角色才有"我的档案"
+	if roleInfo, _ := auth.RoleInfo(account.Role); roleInfo.LinkedEntity != "patient" {
 		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 		return
 	}
 
+	// PATCH 时在已有档案上合并；还没有档案就从空白合并，等同于只带了这些字段的创建
+	current := &upsertMyPatientProfileRequest{}
+	if account.LinkedID != "" {
+		if existing, err := resource.PatientService.GetByID(ctx, account.LinkedID); err == nil {
+			current = &upsertMyPatientProfileRequest{
+				Name:             existing.Name,
+				Gender:           existing.Gender,
+				Age:              existing.Age,
+				Phone:            existing.Phone,
+				IDCard:           existing.IDCard,
+				Address:          existing.Address,
+				EmergencyContact: existing.EmergencyContact,
+				EmergencyPhone:   existing.EmergencyPhone,
+			}
+		}
+	}
 	var req upsertMyPatientProfileRequest
-	if err := ctx.ShouldBindJSON(&req); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "patient", current, &req) {
 		return
 	}
 
@@ -151,10 +549,20 @@ func UpsertMyPatientProfile(ctx *gin.Context) {
 	}
 
 	if account.LinkedID != "" {
-		if err := resource.PatientService.Update(ctx, account.LinkedID, &patient); err != nil {
+		// 已有档案时和 PUT 一样必须带 If-Match，防止覆盖别人（比如前台）刚改过的内容
+		version, ok := ifMatchVersion(ctx, true)
+		if !ok {
+			return
+		}
+		before, _ := resource.PatientService.GetByID(ctx, account.LinkedID)
+		if err := resource.PatientService.Update(ctx, account.LinkedID, &patient, version); err != nil {
+			if respondVersionConflict(ctx, err) {
+				return
+			}
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		recordAudit(ctx, "patient", account.LinkedID, services.AuditActionUpdate, before, patient)
 		ctx.JSON(http.StatusOK, gin.H{
 			"patientId": account.LinkedID,
 			"patient":   patient,
@@ -166,15 +574,28 @@ func UpsertMyPatientProfile(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(ctx, "patient", patient.ID, services.AuditActionCreate, nil, patient)
 
 	updatedAccount, err := resource.AccountService.SetLinkedID(ctx, account.ID, patient.ID)
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, account, updatedAccount)
 
 	ctx.JSON(http.StatusOK, gin.H{
 		"patientId": updatedAccount.LinkedID,
 		"patient":   patient,
 	})
 }
+
+// GetJWKS 公开签名公钥，供网关和其他服务校验令牌
+func GetJWKS(ctx *gin.Context) {
+	set, err := auth.JWKS()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Header("Cache-Control", "public, max-age=300")
+	ctx.JSON(http.StatusOK, set)
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"errors"
+	"hospital-system/auth"
+	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondIntegrityError 删除被依赖记录阻止、恢复时引用缺失都返回 409 并列出相关记录
+func respondIntegrityError(ctx *gin.Context, err error) {
+	var blocked *integrity.BlockedError
+	if errors.As(err, &blocked) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":      blocked.Error(),
+			"entity":     blocked.Entity,
+			"id":         blocked.ID,
+			"dependents": blocked.Dependents,
+		})
+		return
+	}
+	var missing *integrity.MissingReferenceError
+	if errors.As(err, &missing) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":      missing.Error(),
+			"entity":     missing.Entity,
+			"id":         missing.ID,
+			"references": missing.References,
+		})
+		return
+	}
+	if isNotFound(err) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	var notDeleted *services.NotDeletedError
+	if errors.As(err, &notDeleted) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// isNotFound 要删除或恢复的记录不存在
+func isNotFound(err error) bool {
+	return errors.Is(err, services.ErrPatientNotFound) ||
+		errors.Is(err, services.ErrDoctorNotFound) ||
+		errors.Is(err, services.ErrDepartmentNotFound) ||
+		errors.Is(err, services.ErrDiseaseNotFound) ||
+		errors.Is(err, services.ErrRegistrationNotFound)
+}
+
+// actorID 当前操作人的账号ID
+func actorID(ctx *gin.Context) string {
+	if claims, ok := auth.GetClaims(ctx); ok {
+		return claims.UserID
+	}
+	return ""
+}
+
+// includeDeleted 解析 includeDeleted=true，能恢复该类记录（restorePerm）的人才能查看已删除的记录；
+// 返回 false 的 ok 表示已写入 403
+func includeDeleted(ctx *gin.Context, restorePerm string) (include bool, ok bool) {
+	if ctx.Query("includeDeleted") != "true" {
+		return false, true
+	}
+	claims, exists := auth.GetClaims(ctx)
+	if !exists || auth.ScopeOf(claims.Role, restorePerm) != auth.ScopeAll {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return false, false
+	}
+	return true, true
+}
+
+// currentSubject 当前登录账号及其关联档案，失败时已写入 401
+func currentSubject(ctx *gin.Context) (*auth.Subject, bool) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return nil, false
+	}
+	account, err := resource.AccountService.GetByID(ctx, claims.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
+		return nil, false
+	}
+	return &auth.Subject{AccountID: account.ID, Role: account.Role, LinkedID: account.LinkedID}, true
+}
@@ -1,20 +1,39 @@
 package controllers
 
 import (
+	"errors"
+	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 func GetDepartments(ctx *gin.Context) {
-	departments, err := resource.DepartmentService.GetAll(ctx)
+	withDeleted, ok := includeDeleted(ctx, auth.PermDepartmentRestore)
+	if !ok {
+		return
+	}
+	q, ok := parseListQuery(ctx)
+	if !ok {
+		return
+	}
+
+	var departments []models.Department
+	var err error
+	if withDeleted {
+		departments, err = resource.DepartmentService.GetAllIncludingDeleted(ctx)
+	} else {
+		departments, err = resource.DepartmentService.GetAll(ctx)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, departments)
+	respondList(ctx, departments, q, services.DepartmentSortKeys, func(d *models.Department) string { return d.ID })
 }
 
 func GetDepartment(ctx *gin.Context) {
@@ -27,6 +46,7 @@ func GetDepartment(ctx *gin.Context) {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	setETag(ctx, dept.Version)
 	ctx.JSON(http.StatusOK, dept)
 }
 
@@ -40,6 +60,8 @@ func CreateDepartment(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(ctx, "department", d.ID, services.AuditActionCreate, nil, d)
+	setETag(ctx, d.Version)
 	ctx.JSON(http.StatusCreated, d)
 }
 
@@ -48,15 +70,29 @@ func UpdateDepartment(ctx *gin.Context) {
 	if id == "" {
 		id = ctx.Query("id")
 	}
+	version, ok := ifMatchVersion(ctx, true)
+	if !ok {
+		return
+	}
+	before, _ := resource.DepartmentService.GetByID(ctx, id)
 	var d models.Department
-	if err := ctx.ShouldBindJSON(&d); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "department", before, &d) {
 		return
 	}
-	if err := resource.DepartmentService.Update(ctx, id, &d); err != nil {
+	if err := integrity.UpdateDepartment(ctx, id, &d, version); err != nil {
+		if respondVersionConflict(ctx, err) {
+			return
+		}
+		var blocked *integrity.BlockedError
+		if errors.Is(err, services.ErrDepartmentNotFound) || errors.As(err, &blocked) {
+			respondIntegrityError(ctx, err)
+			return
+		}
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	recordAudit(ctx, "department", id, services.AuditActionUpdate, before, d)
+	setETag(ctx, d.Version)
 	ctx.JSON(http.StatusOK, d)
 }
 
@@ -65,10 +101,27 @@ func DeleteDepartment(ctx *gin.Context) {
 	if id == "" {
 		id = ctx.Query("id")
 	}
-	if err := resource.DepartmentService.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := resource.DepartmentService.GetByID(ctx, id)
+	if err := integrity.DeleteDepartment(ctx, id, actorID(ctx)); err != nil {
+		respondIntegrityError(ctx, err)
 		return
 	}
+	recordAudit(ctx, "department", id, services.AuditActionDelete, before, nil)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Department deleted successfully"})
 }
 
+func RestoreDepartment(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
+	}
+
+	department, err := integrity.RestoreDepartment(ctx, id)
+	if err != nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "department", id, services.AuditActionRestore, nil, department)
+	ctx.JSON(http.StatusOK, department)
+}
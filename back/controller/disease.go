@@ -1,20 +1,40 @@
 package controllers
 
 import (
+	"errors"
+	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 func GetDiseases(ctx *gin.Context) {
-	diseases, err := resource.DiseaseService.GetAll(ctx)
+	withDeleted, ok := includeDeleted(ctx, auth.PermDiseaseRestore)
+	if !ok {
+		return
+	}
+	q, ok := parseListQuery(ctx)
+	if !ok {
+		return
+	}
+	filter := services.DiseaseFilter{Category: ctx.Query("category")}
+
+	var diseases []models.Disease
+	var err error
+	if withDeleted {
+		diseases, err = resource.DiseaseService.GetAllIncludingDeleted(ctx)
+	} else {
+		diseases, err = resource.DiseaseService.GetAll(ctx)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, diseases)
+	respondList(ctx, filter.Apply(diseases), q, services.DiseaseSortKeys, func(d *models.Disease) string { return d.ID })
 }
 
 func GetDisease(ctx *gin.Context) {
@@ -29,6 +49,7 @@ func GetDisease(ctx *gin.Context) {
 		return
 	}
 
+	setETag(ctx, disease.Version)
 	ctx.JSON(http.StatusOK, disease)
 }
 
@@ -44,6 +65,8 @@ func CreateDisease(ctx *gin.Context) {
 		return
 	}
 
+	recordAudit(ctx, "disease", disease.ID, services.AuditActionCreate, nil, disease)
+	setETag(ctx, disease.Version)
 	ctx.JSON(http.StatusCreated, disease)
 }
 
@@ -53,17 +76,31 @@ func UpdateDisease(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
+	version, ok := ifMatchVersion(ctx, true)
+	if !ok {
+		return
+	}
+
+	before, _ := resource.DiseaseService.GetByID(ctx, id)
 	var disease models.Disease
-	if err := ctx.ShouldBindJSON(&disease); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "disease", before, &disease) {
 		return
 	}
 
-	if err := resource.DiseaseService.Update(ctx, id, &disease); err != nil {
+	if err := resource.DiseaseService.Update(ctx, id, &disease, version); err != nil {
+		if respondVersionConflict(ctx, err) {
+			return
+		}
+		if errors.Is(err, services.ErrDiseaseNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recordAudit(ctx, "disease", id, services.AuditActionUpdate, before, disease)
+	setETag(ctx, disease.Version)
 	ctx.JSON(http.StatusOK, disease)
 }
 
@@ -73,10 +110,36 @@ func DeleteDisease(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
-	if err := resource.DiseaseService.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := resource.DiseaseService.GetByID(ctx, id)
+	changes, err := integrity.DeleteDisease(ctx, id, actorID(ctx))
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "disease", id, services.AuditActionDelete, before, nil)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Disease deleted successfully"})
 }
+
+func RestoreDisease(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
+	}
+
+	disease, changes, err := integrity.RestoreDisease(ctx, id)
+	// 档案已恢复而撤销级联处理时出错，已经生效的改动照样记审计
+	if err != nil && disease == nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+	recordAudit(ctx, "disease", id, services.AuditActionRestore, nil, disease)
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, disease)
+}
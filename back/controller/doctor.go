@@ -2,20 +2,44 @@ package controllers
 
 import (
 	"errors"
+	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func GetDoctors(ctx *gin.Context) {
-	doctors, err := resource.DoctorService.GetAll(ctx)
+	withDeleted, ok := includeDeleted(ctx, auth.PermDoctorRestore)
+	if !ok {
+		return
+	}
+	q, ok := parseListQuery(ctx)
+	if !ok {
+		return
+	}
+	filter := services.DoctorFilter{
+		Department: ctx.Query("department"),
+		Title:      ctx.Query("title"),
+		Disease:    ctx.Query("disease"),
+	}
+
+	var doctors []models.Doctor
+	var err error
+	if withDeleted {
+		doctors, err = resource.DoctorService.GetAllIncludingDeleted(ctx)
+	} else {
+		doctors, err = resource.DoctorService.GetAll(ctx)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, doctors)
+	respondList(ctx, filter.Apply(doctors), q, services.DoctorSortKeys, func(d *models.Doctor) string { return d.ID })
 }
 
 func GetDoctor(ctx *gin.Context) {
@@ -30,10 +54,62 @@ func GetDoctor(ctx *gin.Context) {
 		return
 	}
 
+	setETag(ctx, doctor.Version)
 	ctx.JSON(http.StatusOK, doctor)
 }
 
+// 单次最多查询的天数，避免一次生成过多号源
+const maxSlotQueryDays = 31
+
+func GetDoctorSlots(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
+	}
+
+	doctor, err := resource.DoctorService.GetByID(ctx, id)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	from := time.Now()
+	if v := ctx.Query("startDate"); v != "" {
+		from, err = time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid startDate, expected YYYY-MM-DD"})
+			return
+		}
+	}
+	to := from.AddDate(0, 0, 6)
+	if v := ctx.Query("endDate"); v != "" {
+		to, err = time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid endDate, expected YYYY-MM-DD"})
+			return
+		}
+	}
+	if to.Sub(from) > maxSlotQueryDays*24*time.Hour {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "date range cannot exceed 31 days"})
+		return
+	}
+
+	days, err := resource.RegistrationService.GetDoctorSlots(ctx, doctor, from, to)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"doctorId":    doctor.ID,
+		"slotMinutes": services.SlotMinutes,
+		"days":        days,
+	})
+}
+
 func CreateDoctor(ctx *gin.Context) {
+	defer integrity.LockReferences()()
+
 	var doctor models.Doctor
 	if err := ctx.ShouldBindJSON(&doctor); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -55,18 +131,27 @@ func CreateDoctor(ctx *gin.Context) {
 		return
 	}
 
+	recordAudit(ctx, "doctor", doctor.ID, services.AuditActionCreate, nil, doctor)
+	setETag(ctx, doctor.Version)
 	ctx.JSON(http.StatusCreated, doctor)
 }
 
 func UpdateDoctor(ctx *gin.Context) {
+	defer integrity.LockReferences()()
+
 	id := ctx.Param("id")
 	if id == "" {
 		id = ctx.Query("id")
 	}
 
+	version, ok := ifMatchVersion(ctx, true)
+	if !ok {
+		return
+	}
+
+	before, _ := resource.DoctorService.GetByID(ctx, id)
 	var doctor models.Doctor
-	if err := ctx.ShouldBindJSON(&doctor); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "doctor", before, &doctor) {
 		return
 	}
 
@@ -80,11 +165,16 @@ func UpdateDoctor(ctx *gin.Context) {
 		return
 	}
 
-	if err := resource.DoctorService.Update(ctx, id, &doctor); err != nil {
+	if err := resource.DoctorService.Update(ctx, id, &doctor, version); err != nil {
+		if respondVersionConflict(ctx, err) {
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	recordAudit(ctx, "doctor", id, services.AuditActionUpdate, before, doctor)
+	setETag(ctx, doctor.Version)
 	ctx.JSON(http.StatusOK, doctor)
 }
 
@@ -94,11 +184,15 @@ func DeleteDoctor(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
-	if err := resource.DoctorService.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := resource.DoctorService.GetByID(ctx, id)
+	changes, err := integrity.DeleteDoctor(ctx, id, actorID(ctx))
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "doctor", id, services.AuditActionDelete, before, nil)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Doctor deleted successfully"})
 }
 
@@ -130,14 +224,30 @@ func validateDoctorDepartment(ctx *gin.Context, deptName string) error {
 	if deptName == "" {
 		return errors.New("department cannot be empty")
 	}
-	departments, err := resource.DepartmentService.GetAll(ctx)
-	if err != nil {
-		return err
+	if _, err := resource.DepartmentService.GetByName(ctx, deptName); err != nil {
+		return errors.New("department not found: " + deptName)
 	}
-	for _, d := range departments {
-		if d.Name == deptName {
-			return nil
-		}
+	return nil
+}
+
+func RestoreDoctor(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
 	}
-	return errors.New("department not found: " + deptName)
+
+	doctor, changes, err := integrity.RestoreDoctor(ctx, id)
+	// 档案已恢复而撤销级联处理时出错，已经生效的改动照样记审计
+	if err != nil && doctor == nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+	recordAudit(ctx, "doctor", id, services.AuditActionRestore, nil, doctor)
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, doctor)
 }
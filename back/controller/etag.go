@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	services "hospital-system/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setETag 响应头带上记录的版本号，客户端修改时原样放进 If-Match
+func setETag(ctx *gin.Context, version int64) {
+	ctx.Header("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// ifMatchVersion 解析 If-Match，返回客户端认为的当前版本。支持 "3"、W/"3" 和 *（不检查）。
+// required 时缺少 If-Match 返回 428；值无法解析时不可能匹配，返回 412。失败时已写入响应
+func ifMatchVersion(ctx *gin.Context, required bool) (int64, bool) {
+	v := strings.TrimSpace(ctx.GetHeader("If-Match"))
+	if v == "" {
+		if required {
+			ctx.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+			return 0, false
+		}
+		return services.AnyVersion, true
+	}
+	if v == "*" {
+		return services.AnyVersion, true
+	}
+	unquoted, err := strconv.Unquote(strings.TrimPrefix(v, "W/"))
+	if err == nil {
+		if version, err := strconv.ParseInt(unquoted, 10, 64); err == nil && version >= 0 {
+			return version, true
+		}
+	}
+	ctx.JSON(http.StatusPreconditionFailed, gin.H{"error": "precondition failed", "message": "invalid If-Match: " + v})
+	return 0, false
+}
+
+// respondVersionConflict 记录已被别人修改时返回 412 和当前版本，返回 false 表示不是版本冲突
+func respondVersionConflict(ctx *gin.Context, err error) bool {
+	var conflict *services.VersionConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	setETag(ctx, conflict.Current)
+	ctx.JSON(http.StatusPreconditionFailed, gin.H{
+		"error":          "precondition failed",
+		"message":        "the record was modified by someone else, reload and try again",
+		"currentVersion": conflict.Current,
+	})
+	return true
+}
@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"hospital-system/auth"
+	"hospital-system/resource"
+	services "hospital-system/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotentReplayBodyKey   = "idempotency.replayBody"
+)
+
+// setIdempotentReplayBody 幂等记录里保存这个响应体而不是实际发出的那份，用于不该明文落盘的内容（如患者敏感信息）；
+// 之后的重试回放的也是这个版本
+func setIdempotentReplayBody(ctx *gin.Context, v interface{}) {
+	if body, err := json.Marshal(v); err == nil {
+		ctx.Set(idempotentReplayBodyKey, body)
+	}
+}
+
+// responseRecorder 在写给客户端的同时留一份响应体
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// IdempotencyMiddleware 用在创建类接口上，放在鉴权中间件之后。请求带 Idempotency-Key 时，
+// 窗口期内同一账号用同一个 key 重试会拿到第一次的响应，而不是再创建一条；不带 key 的请求照常处理
+func IdempotencyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(c.GetHeader(idempotencyKeyHeader))
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "idempotency key too long"})
+			return
+		}
+		claims, ok := auth.GetClaims(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := services.IdempotencyScope{
+			AccountID: claims.UserID,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Key:       key,
+		}
+		requestHash := hashRequestBody(c.Request.URL.RawQuery, body)
+
+		record, err := resource.IdempotencyService.Begin(c, scope, requestHash)
+		if err != nil {
+			switch {
+			case errors.Is(err, services.ErrIdempotencyKeyReused):
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			case errors.Is(err, services.ErrIdempotencyInProgress):
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+			default:
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		if record != nil {
+			c.Header(idempotencyReplayedHeader, "true")
+			if record.ETag != "" {
+				c.Header("ETag", record.ETag)
+			}
+			c.Data(record.StatusCode, record.ContentType, []byte(record.Body))
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		completed := false
+		defer func() {
+			if !completed {
+				resource.IdempotencyService.Abort(scope)
+			}
+		}()
+
+		c.Next()
+
+		completed = true
+		stored := recorder.body.Bytes()
+		if replay, ok := c.Get(idempotentReplayBodyKey); ok {
+			stored = replay.([]byte)
+		}
+		header := recorder.Header()
+		if err := resource.IdempotencyService.Complete(c, scope, requestHash, recorder.Status(), header.Get("Content-Type"), header.Get("ETag"), stored); err != nil {
+			// 响应已经发出去了，保存失败只影响之后的重试能否回放
+			log.Println("保存幂等记录失败:", err)
+		}
+	}
+}
+
+// hashRequestBody JSON 请求体先规范化（字段排序、去掉空白）再取摘要，客户端重新序列化不会被当成不同的请求
+func hashRequestBody(query string, body []byte) string {
+	normalized := body
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			normalized = b
+		}
+	}
+	sum := sha256.Sum256(append([]byte(query+"\n"), normalized...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	services "hospital-system/server"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseListQuery 解析 page / pageSize / cursor / sort，参数不对时已写入 400
+func parseListQuery(ctx *gin.Context) (services.ListQuery, bool) {
+	q := services.ListQuery{
+		Cursor: strings.TrimSpace(ctx.Query("cursor")),
+		Sort:   services.ParseSort(ctx.Query("sort")),
+	}
+	var err error
+	if v := ctx.Query("page"); v != "" {
+		if q.Page, err = strconv.Atoi(v); err != nil || q.Page < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid page"})
+			return q, false
+		}
+	}
+	if v := ctx.Query("pageSize"); v != "" {
+		if q.PageSize, err = strconv.Atoi(v); err != nil || q.PageSize < 1 || q.PageSize > services.MaxPageSize {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid pageSize, expected 1-" + strconv.Itoa(services.MaxPageSize)})
+			return q, false
+		}
+	}
+	if q.Page > 0 && q.Cursor != "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "page and cursor cannot be used together"})
+		return q, false
+	}
+	return q, true
+}
+
+// respondList 排序分页后返回。带分页参数时返回 {items,total,...}，否则和以前一样返回数组；
+// 两种情况都在 X-Total-Count 里给出过滤后的总数
+func respondList[T any](ctx *gin.Context, items []T, q services.ListQuery, keys services.SortKeys[T], idFn func(*T) string) {
+	page, err := services.Paginate(items, q, keys, idFn)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Header("X-Total-Count", strconv.Itoa(page.Total))
+	if !q.Paged() {
+		ctx.JSON(http.StatusOK, page.Items)
+		return
+	}
+	ctx.JSON(http.StatusOK, page)
+}
+
+// parseQueryTime 支持 RFC3339 和 YYYY-MM-DD，只给日期时 endOfDay 取当天结束
+func parseQueryTime(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
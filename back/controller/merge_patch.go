@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// bindUpdateBody 解析修改接口的请求体。PUT 按完整对象绑定；PATCH 按 JSON Merge Patch（RFC 7396）
+// 合并到 current 上，只需要带要改的字段，后面的校验照常针对合并后的结果。
+// current 为 nil 表示记录不存在，PATCH 时返回 404。失败时已写入响应
+func bindUpdateBody[T any](ctx *gin.Context, resourceName string, current *T, dst *T) bool {
+	if ctx.Request.Method != http.MethodPatch {
+		if err := ctx.ShouldBindJSON(dst); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		return true
+	}
+
+	if ct := ctx.ContentType(); ct != mergePatchContentType && ct != gin.MIMEJSON {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + mergePatchContentType})
+		return false
+	}
+	if current == nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": resourceName + " not found"})
+		return false
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	merged, err := mergePatch(current, body)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	var result T
+	if err := json.Unmarshal(merged, &result); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	*dst = result
+	return true
+}
+
+// mergePatch 把 patch 合并到 current 的 JSON 表示上。patch 必须是对象：整个替换掉一条记录没有意义
+func mergePatch(current interface{}, patch []byte) ([]byte, error) {
+	var p interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, errors.New("merge patch must be a JSON object")
+	}
+	raw, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	var target interface{}
+	if err := json.Unmarshal(raw, &target); err != nil {
+		return nil, err
+	}
+	return json.Marshal(applyMergePatch(target, p))
+}
+
+// applyMergePatch RFC 7396 的 MergePatch：对象逐字段递归合并，null 删除字段，其余类型（包括数组）整体替换
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = applyMergePatch(t[k], v)
+	}
+	return t
+}
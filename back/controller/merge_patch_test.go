@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMergePatch(t *testing.T) {
+	// 大部分用例取自 RFC 7396 附录 A
+	tests := []struct {
+		name    string
+		current string
+		patch   string
+		want    string
+		wantErr bool
+	}{
+		{name: "replace field", current: `{"a":"b"}`, patch: `{"a":"c"}`, want: `{"a":"c"}`},
+		{name: "add field", current: `{"a":"b"}`, patch: `{"b":"c"}`, want: `{"a":"b","b":"c"}`},
+		{name: "null removes field", current: `{"a":"b"}`, patch: `{"a":null}`, want: `{}`},
+		{name: "null keeps siblings", current: `{"a":"b","b":"c"}`, patch: `{"a":null}`, want: `{"b":"c"}`},
+		{name: "array replaced as a whole", current: `{"a":["b"]}`, patch: `{"a":["c","d"]}`, want: `{"a":["c","d"]}`},
+		{name: "nested object merged", current: `{"a":{"b":"c","d":"e"}}`, patch: `{"a":{"b":"x","d":null}}`, want: `{"a":{"b":"x"}}`},
+		{name: "object replaces scalar", current: `{"a":"b"}`, patch: `{"a":{"c":"d"}}`, want: `{"a":{"c":"d"}}`},
+		{name: "null inside new object is dropped", current: `{}`, patch: `{"a":{"bb":{"ccc":null}}}`, want: `{"a":{"bb":{}}}`},
+		{name: "empty patch keeps everything", current: `{"a":1}`, patch: `{}`, want: `{"a":1}`},
+		{name: "array patch rejected", current: `{"a":"b"}`, patch: `["c"]`, wantErr: true},
+		{name: "scalar patch rejected", current: `{"a":"b"}`, patch: `"c"`, wantErr: true},
+		{name: "invalid json rejected", current: `{"a":"b"}`, patch: `{"a":`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var current interface{}
+			if err := json.Unmarshal([]byte(tt.current), &current); err != nil {
+				t.Fatal(err)
+			}
+			got, err := mergePatch(current, []byte(tt.patch))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestBindUpdateBody(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	type record struct {
+		Name  string   `json:"name"`
+		Age   int      `json:"age"`
+		Tags  []string `json:"tags"`
+		Notes string   `json:"notes,omitempty"`
+	}
+	current := &record{Name: "张三", Age: 30, Tags: []string{"a"}, Notes: "n"}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		current     *record
+		body        string
+		wantOK      bool
+		wantStatus  int
+		want        record
+	}{
+		{name: "put binds full object", method: http.MethodPut, contentType: "application/json", current: current, body: `{"name":"李四"}`, wantOK: true, want: record{Name: "李四"}},
+		{name: "patch merges onto current", method: http.MethodPatch, contentType: mergePatchContentType, current: current, body: `{"age":31}`, wantOK: true, want: record{Name: "张三", Age: 31, Tags: []string{"a"}, Notes: "n"}},
+		{name: "patch accepts plain json", method: http.MethodPatch, contentType: "application/json", current: current, body: `{"tags":["b","c"]}`, wantOK: true, want: record{Name: "张三", Age: 30, Tags: []string{"b", "c"}, Notes: "n"}},
+		{name: "patch null clears field", method: http.MethodPatch, contentType: mergePatchContentType, current: current, body: `{"notes":null}`, wantOK: true, want: record{Name: "张三", Age: 30, Tags: []string{"a"}}},
+		{name: "patch rejects other content types", method: http.MethodPatch, contentType: "text/plain", current: current, body: `{}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "patch on missing record", method: http.MethodPatch, contentType: mergePatchContentType, current: nil, body: `{}`, wantStatus: http.StatusNotFound},
+		{name: "patch must be an object", method: http.MethodPatch, contentType: mergePatchContentType, current: current, body: `[1]`, wantStatus: http.StatusBadRequest},
+		{name: "patch result must fit the type", method: http.MethodPatch, contentType: mergePatchContentType, current: current, body: `{"age":"old"}`, wantStatus: http.StatusBadRequest},
+		{name: "put rejects invalid body", method: http.MethodPut, contentType: "application/json", current: current, body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest(tt.method, "/update", strings.NewReader(tt.body))
+			ctx.Request.Header.Set("Content-Type", tt.contentType)
+
+			var dst record
+			ok := bindUpdateBody(ctx, "record", tt.current, &dst)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v (response %d %s)", ok, tt.wantOK, w.Code, w.Body.String())
+			}
+			if !ok {
+				if w.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+				}
+				return
+			}
+			if !reflect.DeepEqual(dst, tt.want) {
+				t.Fatalf("got %+v, want %+v", dst, tt.want)
+			}
+		})
+	}
+	if current.Age != 30 || current.Notes != "n" {
+		t.Fatalf("PATCH must not modify the current record, got %+v", current)
+	}
+}
+
+func assertJSONEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid json %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
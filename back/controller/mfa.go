@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"hospital-system/auth"
+	"hospital-system/models"
+	"hospital-system/resource"
+	services "hospital-system/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+type mfaLoginRequest struct {
+	MFAToken       string `json:"mfaToken"`
+	Code           string `json:"code"`           // 验证器 App 上的 6 位验证码，或者一个恢复码
+	EnrollmentCode string `json:"enrollmentCode"` // 登录过程中绑定时需要的管理员签发的绑定码
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// respondMFAChallenge 密码已通过，返回临时令牌等待第二步；还没绑定的账号需要先走绑定流程
+func respondMFAChallenge(ctx *gin.Context, account *models.Account) {
+	token, err := resource.TokenService.IssueMFAToken(ctx, account)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"mfaRequired":           true,
+		"mfaEnrollmentRequired": !account.MFAEnabled,
+		"mfaToken":              token,
+		"expiresIn":             int64(auth.MFATokenTTL / time.Second),
+	})
+}
+
+// mfaTokenAccount 读取请求里的临时令牌，失败时已经写入 401
+func mfaTokenAccount(ctx *gin.Context, token string) (*models.Account, *auth.Claims, bool) {
+	if token == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "mfaToken cannot be empty"})
+		return nil, nil, false
+	}
+	account, claims, err := resource.TokenService.ParseMFAToken(ctx, token)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+	return account, claims, true
+}
+
+// LoginMFA 登录第二步：用临时令牌加验证码（或恢复码）换正式令牌
+func LoginMFA(ctx *gin.Context) {
+	var req mfaLoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account, claims, ok := mfaTokenAccount(ctx, req.MFAToken)
+	if !ok {
+		return
+	}
+	if !account.MFAEnabled {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "mfa enrollment required"})
+		return
+	}
+
+	verified, err := resource.LoginGuard.VerifyMFA(ctx, account, req.Code, ctx.ClientIP())
+	if err != nil {
+		respondLoginError(ctx, err)
+		return
+	}
+	if err := resource.TokenService.Revoke(ctx, claims); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondTokens(ctx, http.StatusOK, verified)
+}
+
+// LoginMFAEnroll 策略要求必须启用 MFA、但还没绑定的账号在登录过程中生成密钥。
+// 只有密码不够，还要管理员签发的绑定码，防止拿到密码的人抢先绑定自己的验证器
+func LoginMFAEnroll(ctx *gin.Context) {
+	var req mfaLoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account, _, ok := mfaTokenAccount(ctx, req.MFAToken)
+	if !ok {
+		return
+	}
+	enrollment, err := resource.AccountService.BeginMFAEnrollmentWithCode(ctx, account.ID, req.EnrollmentCode)
+	respondMFAEnrollment(ctx, enrollment, err)
+}
+
+// LoginMFAActivate 登录过程中确认绑定，成功后直接返回正式令牌和恢复码
+func LoginMFAActivate(ctx *gin.Context) {
+	var req mfaLoginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	before, claims, ok := mfaTokenAccount(ctx, req.MFAToken)
+	if !ok {
+		return
+	}
+
+	account, codes, err := resource.AccountService.ActivateMFAWithCode(ctx, before.ID, req.Code, req.EnrollmentCode)
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+	if err := resource.TokenService.Revoke(ctx, claims); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondMFAActivated(ctx, before, account, codes)
+}
+
+// EnrollMFA 已登录用户自愿开启 MFA 的第一步
+func EnrollMFA(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+	enrollment, err := resource.AccountService.BeginMFAEnrollment(ctx, claims.UserID)
+	respondMFAEnrollment(ctx, enrollment, err)
+}
+
+// ActivateMFA 已登录用户确认绑定；令牌版本会变，响应里带上新令牌
+func ActivateMFA(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+	var req mfaCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, _ := resource.AccountService.GetByID(ctx, claims.UserID)
+	account, codes, err := resource.AccountService.ActivateMFA(ctx, claims.UserID, req.Code)
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+	respondMFAActivated(ctx, before, account, codes)
+}
+
+func DisableMFA(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+	var req mfaCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, _ := resource.AccountService.GetByID(ctx, claims.UserID)
+	account, err := resource.AccountService.DisableMFA(ctx, claims.UserID, req.Code)
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, accountView(account))
+}
+
+// RegenerateRecoveryCodes 旧的恢复码全部作废，新的只显示这一次
+func RegenerateRecoveryCodes(ctx *gin.Context) {
+	claims, ok := auth.GetClaims(ctx)
+	if !ok {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
+		return
+	}
+	var req mfaCodeRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, _ := resource.AccountService.GetByID(ctx, claims.UserID)
+	account, codes, err := resource.AccountService.RegenerateRecoveryCodes(ctx, claims.UserID, req.Code)
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// ResetMFA 管理员为丢失手机的用户清除 MFA
+func ResetMFA(ctx *gin.Context) {
+	var req accountTargetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := findAccount(ctx, req.AccountID, req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	account, err := resource.AccountService.ResetMFA(ctx, before.ID)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	ctx.JSON(http.StatusOK, accountView(account))
+}
+
+// IssueMFAEnrollmentCode 管理员为必须启用 MFA 的账号签发一次性绑定码，线下交给本人，登录时凭它绑定验证器
+func IssueMFAEnrollmentCode(ctx *gin.Context) {
+	var req accountTargetRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	before, err := findAccount(ctx, req.AccountID, req.Username)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	account, code, expiresAt, err := resource.AccountService.IssueMFAEnrollmentCode(ctx, before.ID)
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "account", account.ID, services.AuditActionUpdate, before, account)
+	body := accountView(account)
+	body["enrollmentCode"] = code
+	body["enrollmentCodeExpiresAt"] = expiresAt
+	ctx.JSON(http.StatusOK, body)
+}
+
+func respondMFAEnrollment(ctx *gin.Context, enrollment *services.MFAEnrollment, err error) {
+	if err != nil {
+		respondMFAError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, enrollment)
+}
+
+func respondMFAActivated(ctx *gin.Context, before *models.Account, account *models.Account, codes []string) {
+	recordAuditAs(ctx, account.ID, account.Role, "account", account.ID, services.AuditActionUpdate, before, account)
+
+	body, err := tokenBody(ctx, account)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	body["recoveryCodes"] = codes
+	ctx.JSON(http.StatusOK, body)
+}
+
+func respondMFAError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrInvalidMFACode), errors.Is(err, services.ErrInvalidEnrollmentCode):
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrAccountNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrMFAAlreadyEnabled), errors.Is(err, services.ErrMFARequired):
+		ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
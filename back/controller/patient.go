@@ -1,21 +1,70 @@
 package controllers
 
 import (
+	"errors"
+	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 func GetPatients(ctx *gin.Context) {
-	patients, err := resource.PatientService.GetAll(ctx)
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
+	withDeleted, ok := includeDeleted(ctx, auth.PermPatientRestore)
+	if !ok {
+		return
+	}
+	q, ok := parseListQuery(ctx)
+	if !ok {
+		return
+	}
+	filter := services.PatientFilter{
+		NamePrefix:  ctx.Query("name"),
+		PhonePrefix: ctx.Query("phone"),
+	}
+	// 看不到完整电话的人不能按电话前缀筛选，否则可以逐位试出号码
+	if filter.PhonePrefix != "" && subject.Scope(auth.PermPatientReadPII) != auth.ScopeAll {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+
+	// 只有 :own 权限时列表里只有自己的档案
+	if subject.Scope(auth.PermPatientRead) == auth.ScopeOwn {
+		patients := []models.Patient{}
+		if subject.LinkedEntity() == "patient" && subject.LinkedID != "" {
+			if patient, err := resource.PatientService.GetByID(ctx, subject.LinkedID); err == nil {
+				patients = append(patients, *patient)
+			}
+		}
+		respondPatients(ctx, subject, filter.Apply(patients), q)
+		return
+	}
+
+	var patients []models.Patient
+	var err error
+	if withDeleted {
+		patients, err = resource.PatientService.GetAllIncludingDeleted(ctx)
+	} else {
+		patients, err = resource.PatientService.GetAll(ctx)
+	}
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, patients)
+	respondPatients(ctx, subject, filter.Apply(patients), q)
+}
+
+func respondPatients(ctx *gin.Context, subject *auth.Subject, patients []models.Patient, q services.ListQuery) {
+	respondList(ctx, maskPatientsPII(subject, patients), q, services.PatientSortKeys, func(p *models.Patient) string { return p.ID })
 }
 
 func GetPatient(ctx *gin.Context) {
@@ -24,13 +73,23 @@ func GetPatient(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
+	if !auth.Authorize(subject, auth.PermPatientRead, auth.OwnsPatient(id)) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+
 	patient, err := resource.PatientService.GetByID(ctx, id)
 	if err != nil {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, patient)
+	setETag(ctx, patient.Version)
+	ctx.JSON(http.StatusOK, maskPatientPII(subject, *patient))
 }
 
 func CreatePatient(ctx *gin.Context) {
@@ -45,6 +104,9 @@ func CreatePatient(ctx *gin.Context) {
 		return
 	}
 
+	recordAudit(ctx, "patient", patient.ID, services.AuditActionCreate, nil, patient)
+	setETag(ctx, patient.Version)
+	setIdempotentReplayBody(ctx, maskedPatient(patient))
 	ctx.JSON(http.StatusCreated, patient)
 }
 
@@ -54,14 +116,30 @@ func UpdatePatient(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
+	if !auth.Authorize(subject, auth.PermPatientUpdate, auth.OwnsPatient(id)) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return
+	}
+	version, ok := ifMatchVersion(ctx, true)
+	if !ok {
+		return
+	}
+
+	before, _ := resource.PatientService.GetByID(ctx, id)
 	var patient models.Patient
-	if err := ctx.ShouldBindJSON(&patient); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "patient", before, &patient) {
 		return
 	}
 
-	if err := resource.PatientService.Update(ctx, id, &patient); err != nil {
-		if err.Error() == "patient not found" {
+	if err := resource.PatientService.Update(ctx, id, &patient, version); err != nil {
+		if respondVersionConflict(ctx, err) {
+			return
+		}
+		if errors.Is(err, services.ErrPatientNotFound) {
 			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
@@ -69,6 +147,8 @@ func UpdatePatient(ctx *gin.Context) {
 		return
 	}
 
+	recordAudit(ctx, "patient", id, services.AuditActionUpdate, before, patient)
+	setETag(ctx, patient.Version)
 	ctx.JSON(http.StatusOK, patient)
 }
 
@@ -78,10 +158,71 @@ func DeletePatient(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
-	if err := resource.PatientService.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := resource.PatientService.GetByID(ctx, id)
+	changes, err := integrity.DeletePatient(ctx, id, actorID(ctx))
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "patient", id, services.AuditActionDelete, before, nil)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Patient deleted successfully"})
 }
+
+func RestorePatient(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
+	}
+
+	patient, changes, err := integrity.RestorePatient(ctx, id)
+	// 档案已恢复而撤销级联处理时出错，已经生效的改动照样记审计
+	if err != nil && patient == nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+	recordAudit(ctx, "patient", id, services.AuditActionRestore, nil, patient)
+	recordChanges(ctx, changes)
+	if err != nil {
+		respondIntegrityError(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, patient)
+}
+
+// maskPatientPII 没有 patient:read-pii 权限（或只能看自己的而这不是自己的档案）时隐去敏感字段
+func maskPatientPII(subject *auth.Subject, p models.Patient) models.Patient {
+	if auth.Authorize(subject, auth.PermPatientReadPII, auth.OwnsPatient(p.ID)) {
+		return p
+	}
+	return maskedPatient(p)
+}
+
+// maskedPatient 不看权限直接隐去敏感字段，用于不该明文保存的副本（如幂等回放记录）
+func maskedPatient(p models.Patient) models.Patient {
+	p.Phone = maskDigits(p.Phone, 3, 4)
+	p.IDCard = maskDigits(p.IDCard, 6, 4)
+	p.Address = ""
+	p.EmergencyContact = ""
+	p.EmergencyPhone = maskDigits(p.EmergencyPhone, 3, 4)
+	return p
+}
+
+func maskPatientsPII(subject *auth.Subject, patients []models.Patient) []models.Patient {
+	masked := make([]models.Patient, len(patients))
+	for i := range patients {
+		masked[i] = maskPatientPII(subject, patients[i])
+	}
+	return masked
+}
+
+// maskDigits 保留前 head 位和后 tail 位，中间用 * 代替
+func maskDigits(v string, head int, tail int) string {
+	runes := []rune(v)
+	if len(runes) <= head+tail {
+		return strings.Repeat("*", len(runes))
+	}
+	return string(runes[:head]) + strings.Repeat("*", len(runes)-head-tail) + string(runes[len(runes)-tail:])
+}
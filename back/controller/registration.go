@@ -5,6 +5,8 @@ import (
 	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"hospital-system/server/integrity"
 	"net/http"
 	"strings"
 
@@ -12,54 +14,101 @@ import (
 )
 
 func GetRegistrations(ctx *gin.Context) {
-	claims, ok := auth.GetClaims(ctx)
+	subject, ok := currentSubject(ctx)
 	if !ok {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
 		return
 	}
 
-	account, err := resource.AccountService.GetByID(ctx, claims.UserID)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
+	withDeleted, ok := includeDeleted(ctx, auth.PermRegistrationRestore)
+	if !ok {
 		return
 	}
-
-	registrations, err := resource.RegistrationService.GetAll(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	q, ok := parseListQuery(ctx)
+	if !ok {
 		return
 	}
-	if account.Role == "admin" {
-		ctx.JSON(http.StatusOK, registrations)
+	filter, ok := parseRegistrationFilter(ctx)
+	if !ok {
 		return
 	}
 
-	linkedID := account.LinkedID
+	var err error
+	if subject.Scope(auth.PermRegistrationRead) == auth.ScopeAll {
+		var registrations []models.Registration
+		if withDeleted {
+			registrations, err = resource.RegistrationService.GetAllIncludingDeleted(ctx)
+		} else {
+			registrations, err = resource.RegistrationService.GetAll(ctx)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		respondRegistrations(ctx, filter.Apply(registrations), q)
+		return
+	}
+
+	// 只有 :own 权限时按关联档案取自己的挂号
+	linkedID := subject.LinkedID
 	if linkedID == "" {
-		ctx.JSON(http.StatusOK, []models.Registration{})
+		respondRegistrations(ctx, []models.Registration{}, q)
 		return
 	}
 
-	filtered := make([]models.Registration, 0, len(registrations))
-	switch account.Role {
+	var registrations []models.Registration
+	switch subject.LinkedEntity() {
 	case "doctor":
-		for _, r := range registrations {
-			if r.DoctorID == linkedID {
-				filtered = append(filtered, r)
-			}
-		}
+		registrations, err = resource.RegistrationService.GetByDoctorID(ctx, linkedID)
 	case "patient":
-		for _, r := range registrations {
-			if r.PatientID == linkedID {
-				filtered = append(filtered, r)
-			}
-		}
+		registrations, err = resource.RegistrationService.GetByPatientID(ctx, linkedID)
 	default:
 		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 		return
 	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	ctx.JSON(http.StatusOK, filtered)
+	respondRegistrations(ctx, filter.Apply(registrations), q)
+}
+
+// parseRegistrationFilter status 可以用逗号分隔多个；visitDateFrom / visitDateTo 支持 RFC3339 或 YYYY-MM-DD
+func parseRegistrationFilter(ctx *gin.Context) (services.RegistrationFilter, bool) {
+	filter := services.RegistrationFilter{
+		DoctorID:   ctx.Query("doctorId"),
+		Department: ctx.Query("department"),
+	}
+	for _, status := range strings.Split(ctx.Query("status"), ",") {
+		status = strings.TrimSpace(status)
+		if status == "" {
+			continue
+		}
+		if !services.IsValidRegistrationStatus(status) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid status: " + status})
+			return filter, false
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+
+	var err error
+	if v := ctx.Query("visitDateFrom"); v != "" {
+		if filter.VisitFrom, err = parseQueryTime(v, false); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid visitDateFrom, expected RFC3339 or YYYY-MM-DD"})
+			return filter, false
+		}
+	}
+	if v := ctx.Query("visitDateTo"); v != "" {
+		if filter.VisitTo, err = parseQueryTime(v, true); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid visitDateTo, expected RFC3339 or YYYY-MM-DD"})
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+func respondRegistrations(ctx *gin.Context, registrations []models.Registration, q services.ListQuery) {
+	respondList(ctx, registrations, q, services.RegistrationSortKeys, func(r *models.Registration) string { return r.ID })
 }
 
 func GetRegistration(ctx *gin.Context) {
@@ -68,14 +117,8 @@ func GetRegistration(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
-	claims, ok := auth.GetClaims(ctx)
+	subject, ok := currentSubject(ctx)
 	if !ok {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
-		return
-	}
-	account, err := resource.AccountService.GetByID(ctx, claims.UserID)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
 		return
 	}
 
@@ -85,35 +128,20 @@ func GetRegistration(ctx *gin.Context) {
 		return
 	}
 
-	if account.Role == "admin" {
-		ctx.JSON(http.StatusOK, registration)
-		return
-	}
-	if account.LinkedID == "" {
-		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-		return
-	}
-	if account.Role == "doctor" && registration.DoctorID != account.LinkedID {
-		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-		return
-	}
-	if account.Role == "patient" && registration.PatientID != account.LinkedID {
+	if !auth.Authorize(subject, auth.PermRegistrationRead, auth.OwnsRegistration(registration)) {
 		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 		return
 	}
 
+	setETag(ctx, registration.Version)
 	ctx.JSON(http.StatusOK, registration)
 }
 
 func CreateRegistration(ctx *gin.Context) {
-	claims, ok := auth.GetClaims(ctx)
+	defer integrity.LockReferences()()
+
+	subject, ok := currentSubject(ctx)
 	if !ok {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
-		return
-	}
-	account, err := resource.AccountService.GetByID(ctx, claims.UserID)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
 		return
 	}
 
@@ -123,15 +151,24 @@ func CreateRegistration(ctx *gin.Context) {
 		return
 	}
 
-	switch account.Role {
-	case "admin":
-	case "patient":
-		if account.LinkedID == "" {
+	switch subject.Scope(auth.PermRegistrationCreate) {
+	case auth.ScopeAll:
+		// 前台这类不能修改挂号的角色只能新建待处理的挂号，签到和爽约走专门的接口
+		if !subject.Has(auth.PermRegistrationUpdate) {
+			registration.Status = services.RegistrationPending
+		}
+	case auth.ScopeOwn:
+		// 只能给自己挂号
+		if subject.LinkedEntity() != "patient" {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		if subject.LinkedID == "" {
 			ctx.JSON(http.StatusBadRequest, gin.H{"error": "patient profile not linked"})
 			return
 		}
-		registration.PatientID = account.LinkedID
-		registration.Status = "pending"
+		registration.PatientID = subject.LinkedID
+		registration.Status = services.RegistrationPending
 	default:
 		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 		return
@@ -168,28 +205,32 @@ func CreateRegistration(ctx *gin.Context) {
 		return
 	}
 
-	if err := resource.RegistrationService.Create(ctx, &registration); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if !registration.VisitDate.IsZero() {
+		if err := services.ValidateDoctorSchedule(doctor, registration.VisitDate, registration.TimeSlot); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := resource.RegistrationService.Create(ctx, &registration, doctor, subject.AccountID); err != nil {
+		respondRegistrationError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "registration", registration.ID, services.AuditActionCreate, nil, registration)
 	ctx.JSON(http.StatusCreated, registration)
 }
 
 func UpdateRegistration(ctx *gin.Context) {
+	defer integrity.LockReferences()()
+
 	id := ctx.Param("id")
 	if id == "" {
 		id = ctx.Query("id")
 	}
 
-	claims, ok := auth.GetClaims(ctx)
+	subject, ok := currentSubject(ctx)
 	if !ok {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "missing token"})
-		return
-	}
-	account, err := resource.AccountService.GetByID(ctx, claims.UserID)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"error": "account not found"})
 		return
 	}
 
@@ -198,24 +239,21 @@ func UpdateRegistration(ctx *gin.Context) {
 		ctx.JSON(http.StatusNotFound, gin.H{"error": "registration not found"})
 		return
 	}
+	version, ok := ifMatchVersion(ctx, true)
+	if !ok {
+		return
+	}
 
 	var registration models.Registration
-	if err := ctx.ShouldBindJSON(&registration); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if !bindUpdateBody(ctx, "registration", existing, &registration) {
 		return
 	}
 
-	switch account.Role {
-	case "admin":
-	case "doctor":
-		if account.LinkedID == "" {
-			ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-			return
-		}
-		if existing.DoctorID != account.LinkedID {
-			ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-			return
-		}
+	owns := auth.OwnsRegistration(existing)
+	switch {
+	case auth.Authorize(subject, auth.PermRegistrationUpdate, owns):
+	case auth.Authorize(subject, auth.PermRegistrationUpdateStatus, owns):
+		// 只能改状态，其余字段保持原样；PATCH 只带 status 时合并结果本来就是原样
 		registration.PatientID = existing.PatientID
 		registration.DoctorID = existing.DoctorID
 		registration.Department = existing.Department
@@ -224,13 +262,6 @@ func UpdateRegistration(ctx *gin.Context) {
 		registration.VisitDate = existing.VisitDate
 		registration.TimeSlot = existing.TimeSlot
 		registration.Symptoms = existing.Symptoms
-		if strings.TrimSpace(registration.Status) == "" {
-			registration.Status = existing.Status
-		}
-		if !isAllowedDoctorRegistrationStatusTransition(existing.Status, registration.Status) {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid status transition"})
-			return
-		}
 	default:
 		ctx.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
 		return
@@ -267,11 +298,24 @@ func UpdateRegistration(ctx *gin.Context) {
 		return
 	}
 
-	if err := resource.RegistrationService.Update(ctx, id, &registration); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 改了医生、日期或时间段才按排班重新校验，排班调整后旧挂号仍可正常流转
+	scheduleChanged := registration.DoctorID != existing.DoctorID ||
+		!registration.VisitDate.Equal(existing.VisitDate) ||
+		strings.TrimSpace(registration.TimeSlot) != strings.TrimSpace(existing.TimeSlot)
+	if scheduleChanged && !registration.VisitDate.IsZero() {
+		if err := services.ValidateDoctorSchedule(doctor, registration.VisitDate, registration.TimeSlot); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := resource.RegistrationService.Update(ctx, id, &registration, doctor, subject, version); err != nil {
+		respondRegistrationError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "registration", id, services.AuditActionUpdate, existing, registration)
+	setETag(ctx, registration.Version)
 	ctx.JSON(http.StatusOK, registration)
 }
 
@@ -281,49 +325,184 @@ func DeleteRegistration(ctx *gin.Context) {
 		id = ctx.Query("id")
 	}
 
-	if err := resource.RegistrationService.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	before, _ := resource.RegistrationService.GetByID(ctx, id)
+	if err := integrity.DeleteRegistration(ctx, id, actorID(ctx)); err != nil {
+		respondIntegrityError(ctx, err)
 		return
 	}
 
+	recordAudit(ctx, "registration", id, services.AuditActionDelete, before, nil)
 	ctx.JSON(http.StatusOK, gin.H{"message": "Registration deleted successfully"})
 }
 
-func isAllowedDoctorRegistrationStatusTransition(from string, to string) bool {
-	from = strings.TrimSpace(from)
-	to = strings.TrimSpace(to)
-	if from == "" || to == "" {
-		return false
-	}
-	if from == to {
-		return true
-	}
-	switch from {
-	case "pending":
-		return to == "confirmed" || to == "cancelled"
-	case "confirmed":
-		return to == "completed" || to == "cancelled"
-	case "completed", "cancelled":
-		return false
-	default:
-		return false
+func RestoreRegistration(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
+	}
+
+	registration, err := integrity.RestoreRegistration(ctx, id)
+	if err != nil {
+		// 恢复后与其他挂号冲突或医生号源已满，和新建挂号一样返回 409
+		var conflict *services.BookingConflictError
+		var fullyBooked *services.FullyBookedError
+		if errors.As(err, &conflict) || errors.As(err, &fullyBooked) {
+			respondRegistrationError(ctx, err)
+			return
+		}
+		respondIntegrityError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "registration", id, services.AuditActionRestore, nil, registration)
+	ctx.JSON(http.StatusOK, registration)
+}
+
+// CheckInRegistration 前台为到院的病人签到
+func CheckInRegistration(ctx *gin.Context) {
+	changeRegistrationStatus(ctx, services.RegistrationCheckedIn, "")
+}
+
+// MarkRegistrationNoShow 前台把当天没来的挂号标记为爽约
+func MarkRegistrationNoShow(ctx *gin.Context) {
+	changeRegistrationStatus(ctx, services.RegistrationNoShow, "")
+}
+
+type changeRegistrationStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// ChangeRegistrationStatus 只改挂号状态，能改到哪些状态由状态机按角色决定；取消时 reason 必填
+func ChangeRegistrationStatus(ctx *gin.Context) {
+	var req changeRegistrationStatusRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Status) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "status cannot be empty"})
+		return
 	}
+	changeRegistrationStatus(ctx, strings.TrimSpace(req.Status), req.Reason)
 }
 
-func validateDepartmentsExist(ctx *gin.Context, deptNames []string) error {
-	if len(deptNames) == 0 {
-		return nil
+func changeRegistrationStatus(ctx *gin.Context, status string, reason string) {
+	defer integrity.LockReferences()()
+
+	id := ctx.Param("id")
+	if id == "" {
+		id = ctx.Query("id")
 	}
-	departments, err := resource.DepartmentService.GetAll(ctx)
+
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
+	before, err := resource.RegistrationService.GetByID(ctx, id)
 	if err != nil {
-		return err
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "registration not found"})
+		return
 	}
-	existing := make(map[string]struct{}, len(departments))
-	for _, d := range departments {
-		existing[d.Name] = struct{}{}
+	// 看不到的挂号按不存在处理
+	if !auth.Authorize(subject, auth.PermRegistrationRead, auth.OwnsRegistration(before)) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "registration not found"})
+		return
+	}
+	// 只改状态时 If-Match 可选
+	version, ok := ifMatchVersion(ctx, false)
+	if !ok {
+		return
 	}
+
+	// 医生已删除时为 nil，只在需要重新占号时才会用到并报错
+	doctor, _ := resource.DoctorService.GetByID(ctx, before.DoctorID)
+	registration, err := resource.RegistrationService.ChangeStatus(ctx, id, status, reason, doctor, subject, version)
+	if err != nil {
+		respondRegistrationError(ctx, err)
+		return
+	}
+
+	recordAudit(ctx, "registration", id, services.AuditActionUpdate, before, registration)
+	setETag(ctx, registration.Version)
+	ctx.JSON(http.StatusOK, registration)
+}
+
+func respondRegistrationError(ctx *gin.Context, err error) {
+	if respondVersionConflict(ctx, err) {
+		return
+	}
+	var transition *services.StatusTransitionError
+	if errors.As(err, &transition) {
+		status := http.StatusConflict
+		if transition.Forbidden {
+			status = http.StatusForbidden
+		}
+		ctx.JSON(status, gin.H{
+			"error":           "invalid status transition",
+			"message":         transition.Error(),
+			"from":            transition.From,
+			"to":              transition.To,
+			"allowedStatuses": transition.Allowed,
+		})
+		return
+	}
+	var conflict *services.BookingConflictError
+	if errors.As(err, &conflict) {
+		c := conflict.Conflicting
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":                     "booking conflict",
+			"message":                   conflict.Error(),
+			"rule":                      conflict.Rule,
+			"limit":                     conflict.Limit,
+			"conflictingRegistrationId": c.ID,
+			"conflictingRegistration": gin.H{
+				"id":        c.ID,
+				"doctorId":  c.DoctorID,
+				"visitDate": c.VisitDate,
+				"timeSlot":  c.TimeSlot,
+				"status":    c.Status,
+			},
+		})
+		return
+	}
+	var fullyBooked *services.FullyBookedError
+	if errors.As(err, &fullyBooked) {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"error":       "doctor is fully booked",
+			"message":     fullyBooked.Error(),
+			"doctorId":    fullyBooked.DoctorID,
+			"visitDate":   fullyBooked.VisitDate,
+			"maxPatients": fullyBooked.MaxPatients,
+			"booked":      fullyBooked.Booked,
+			"remaining":   fullyBooked.Remaining(),
+		})
+		return
+	}
+	switch {
+	case errors.Is(err, services.ErrRegistrationNotFound), errors.Is(err, services.ErrDoctorNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case isRegistrationInputError(err):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// isRegistrationInputError 请求本身不合法（状态、原因、时间条件不满足），返回 400
+func isRegistrationInputError(err error) bool {
+	var reschedule *services.RescheduleError
+	return errors.Is(err, services.ErrInvalidRegistrationStatus) ||
+		errors.Is(err, services.ErrInvalidInitialStatus) ||
+		errors.Is(err, services.ErrCancelReasonRequired) ||
+		errors.Is(err, services.ErrCheckInNotVisitDay) ||
+		errors.Is(err, services.ErrNoShowBeforeVisitDay) ||
+		errors.As(err, &reschedule)
+}
+
+func validateDepartmentsExist(ctx *gin.Context, deptNames []string) error {
 	for _, name := range deptNames {
-		if _, ok := existing[strings.TrimSpace(name)]; !ok {
+		if _, err := resource.DepartmentService.GetByName(ctx, strings.TrimSpace(name)); err != nil {
 			return errors.New("department not found: " + name)
 		}
 	}
@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"hospital-system/auth"
+	"hospital-system/models"
+	"hospital-system/resource"
+	services "hospital-system/server"
+
+	"github.com/gin-gonic/gin"
+)
+
+// searchReadPerms 每类结果对应的读权限，没有读权限的类型搜不到
+var searchReadPerms = map[string]string{
+	services.SearchTypePatient: auth.PermPatientRead,
+	services.SearchTypeDoctor:  auth.PermDoctorRead,
+	services.SearchTypeDisease: auth.PermDiseaseRead,
+}
+
+// Search 全文检索病人、医生、病种。q 为关键词，types 可用逗号限定类型；
+// 结果按相关度排序，固定分页返回，默认每页 services.DefaultPageSize 条
+func Search(ctx *gin.Context) {
+	subject, ok := currentSubject(ctx)
+	if !ok {
+		return
+	}
+	query := strings.TrimSpace(ctx.Query("q"))
+	if query == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "q cannot be empty"})
+		return
+	}
+	q, ok := parseListQuery(ctx)
+	if !ok {
+		return
+	}
+	if !q.Paged() {
+		q.PageSize = services.DefaultPageSize
+	}
+
+	var types []string
+	for _, t := range strings.Split(ctx.Query("types"), ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if _, known := searchReadPerms[t]; !known {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid type: " + t})
+			return
+		}
+		types = append(types, t)
+	}
+
+	hits, err := resource.SearchService.Search(ctx, query, types, searchScope(subject))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range hits {
+		if p, ok := hits[i].Item.(models.Patient); ok {
+			hits[i].Item = maskPatientPII(subject, p)
+		}
+	}
+	respondList(ctx, hits, q, services.SortKeys[services.SearchHit]{}, func(h *services.SearchHit) string { return h.Type + ":" + h.ID })
+}
+
+// searchScope 按角色过滤结果：只能看自己档案的病人只搜得到自己；
+// 电话和身份证号只对能看到明文的人参与匹配，否则可以靠搜索逐位试出来
+func searchScope(subject *auth.Subject) services.SearchScope {
+	return func(docType string, id string) (bool, bool) {
+		perm := searchReadPerms[docType]
+		if docType != services.SearchTypePatient {
+			return subject.Scope(perm) == auth.ScopeAll, false
+		}
+		if !auth.Authorize(subject, perm, auth.OwnsPatient(id)) {
+			return false, false
+		}
+		return true, auth.Authorize(subject, auth.PermPatientReadPII, auth.OwnsPatient(id))
+	}
+}
@@ -2,36 +2,196 @@ package load
 
 import (
 	"context"
+	"encoding/json"
+	"hospital-system/auth"
 	"hospital-system/models"
 	"hospital-system/resource"
 	services "hospital-system/server"
+	"hospital-system/storage"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func Load(ctx context.Context) {
-	resource.PatientService = services.InitPatientService(resource.PatientService)
-	resource.DiseaseService = services.InitDiseaseService(resource.DiseaseService)
-	resource.DoctorService = services.InitDoctorService(resource.DoctorService)
-	resource.RegistrationService = services.InitRegistrationService(resource.RegistrationService)
-	resource.AccountService = services.InitAccountService(resource.AccountService)
-	resource.DepartmentService = services.InitDepartmentService(resource.DepartmentService)
+// Options 启动参数，对应命令行 --data-dir / --seed
+type Options struct {
+	DataDir string // 数据目录，为空时取 HOSPITAL_DATA_DIR，再不行用 static
+	Seed    string // 种子数据："demo" 为内置演示数据，其他值视为种子文件路径，为空时取 HOSPITAL_SEED
+}
 
-	initStorage(ctx)
-	if resource.AccountService != nil {
-		_ = resource.AccountService.EnsureAccount(ctx, "dreamstartooo", "123456", "admin")
+func Load(ctx context.Context, opts Options) {
+	if err := auth.LoadKeys(auth.KeyConfigFromEnv()); err != nil {
+		log.Fatal("加载令牌签名密钥失败:", err)
+	}
+	if kid, alg, err := auth.SigningKeyInfo(); err == nil {
+		log.Println("令牌签名密钥:", kid, alg)
+	}
+
+	cfg := storage.ConfigFromEnv()
+	if dir := strings.TrimSpace(opts.DataDir); dir != "" {
+		cfg.Dir = dir
+	}
+	rolesFile := auth.RolesFileFromEnv(cfg.Dir)
+	if err := auth.LoadRoles(rolesFile); err != nil {
+		log.Fatal("加载角色权限配置失败:", err)
 	}
+	if rolesFile != "" {
+		log.Println("角色权限配置:", rolesFile, auth.RoleNames())
+	}
+	if mfaRoles := auth.MFARequiredRolesFromEnv(); len(mfaRoles) > 0 {
+		if err := auth.SetMFARequiredRoles(mfaRoles); err != nil {
+			log.Fatal("加载 MFA 策略失败:", err)
+		}
+		log.Println("必须启用 MFA 的角色:", mfaRoles)
+	}
+	if cfg.Driver == storage.DriverJSON {
+		initStorage(ctx, cfg.Dir)
+	} else if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		log.Fatal("创建数据目录失败:", err)
+	}
+	resource.Store = mustOpenStore(ctx, cfg)
+
+	seed := strings.TrimSpace(opts.Seed)
+	if seed == "" {
+		seed = strings.TrimSpace(os.Getenv("HOSPITAL_SEED"))
+	}
+	if seed != "" {
+		bundle, err := readSeedBundle(seed)
+		if err != nil {
+			log.Fatal("读取种子数据失败:", err)
+		}
+		if err := applySeed(ctx, resource.Store, bundle); err != nil {
+			log.Fatal("写入种子数据失败:", err)
+		}
+	}
+
+	resource.PatientService = services.InitPatientService(resource.PatientService, resource.Store)
+	resource.DiseaseService = services.InitDiseaseService(resource.DiseaseService, resource.Store)
+	resource.DoctorService = services.InitDoctorService(resource.DoctorService, resource.Store)
+	resource.RegistrationService = services.InitRegistrationService(resource.RegistrationService, resource.Store)
+	bookingPolicy, err := services.BookingPolicyFromEnv()
+	if err != nil {
+		log.Fatal("加载挂号限制失败:", err)
+	}
+	resource.RegistrationService.SetBookingPolicy(bookingPolicy)
+	resource.AccountService = services.InitAccountService(resource.AccountService, resource.Store)
+	resource.DepartmentService = services.InitDepartmentService(resource.DepartmentService, resource.Store)
+	auditLog := services.AuditLogFromEnv(cfg.Dir)
+	if err := os.MkdirAll(filepath.Dir(auditLog), 0755); err != nil {
+		log.Fatal("创建审计日志目录失败:", err)
+	}
+	resource.AuditService = services.InitAuditService(resource.AuditService, auditLog)
+	log.Println("审计日志:", auditLog)
+	resource.TokenService = services.InitTokenService(resource.TokenService, resource.Store, resource.AccountService)
+	resource.LoginGuard = services.InitLoginGuard(resource.LoginGuard, resource.AccountService)
+	idempotencyTTL, err := services.IdempotencyTTLFromEnv()
+	if err != nil {
+		log.Fatal("加载幂等配置失败:", err)
+	}
+	resource.IdempotencyService = services.InitIdempotencyService(resource.IdempotencyService, resource.Store, idempotencyTTL)
+	resource.SearchService = services.InitSearchService(resource.SearchService, resource.Store, resource.PatientService, resource.DoctorService, resource.DiseaseService)
+	auth.SetTokenValidator(resource.TokenService)
+
+	resource.AdminSetup = services.InitAdminSetup(resource.AdminSetup, resource.AccountService)
+	bootstrapAdmin(ctx)
 }
 
-func initStorage(ctx context.Context) {
+// bootstrapAdmin 还没有管理员时按 HOSPITAL_ADMIN_USERNAME / HOSPITAL_ADMIN_PASSWORD 创建；
+// 没配置就启用一次性初始化令牌（可用 HOSPITAL_SETUP_TOKEN 指定）。令牌只在随机生成时打印一次，
+// 自己配置的令牌运维已经知道，不再写进日志。已有的管理员账号不会被改动
+func bootstrapAdmin(ctx context.Context) {
+	configuredToken := strings.TrimSpace(os.Getenv("HOSPITAL_SETUP_TOKEN"))
+	account, token, err := resource.AdminSetup.Bootstrap(ctx,
+		os.Getenv("HOSPITAL_ADMIN_USERNAME"),
+		os.Getenv("HOSPITAL_ADMIN_PASSWORD"),
+		configuredToken,
+	)
+	if err != nil {
+		log.Fatal("创建初始管理员失败:", err)
+	}
+	if account != nil {
+		log.Println("已创建初始管理员:", account.Username)
+		if auth.MFARequired(account.Role) {
+			_, code, _, err := resource.AccountService.IssueMFAEnrollmentCode(ctx, account.ID)
+			if err != nil {
+				log.Fatal("签发管理员 MFA 绑定码失败:", err)
+			}
+			log.Println("管理员必须启用两步验证，首次登录时使用绑定码（24 小时内有效）:", code)
+		}
+	}
+	if token != "" && configuredToken != "" {
+		log.Println("尚未创建管理员，请使用 HOSPITAL_SETUP_TOKEN 中配置的初始化令牌通过 /api/auth/setup 创建")
+	} else if token != "" {
+		log.Println("尚未创建管理员，请使用初始化令牌通过 /api/auth/setup 创建:", token)
+	}
+}
+
+func mustOpenStore(ctx context.Context, cfg storage.Config) storage.Store {
+	store, err := storage.Open(cfg)
+	if err != nil {
+		log.Fatal("存储初始化失败:", err)
+	}
+	if r, ok := store.(storage.Recoverer); ok {
+		if err := r.Recover(ctx); err != nil {
+			log.Fatal("存储恢复失败:", err)
+		}
+	}
+	if cfg.Driver == storage.DriverSQLite {
+		importJSONIfEmpty(ctx, store, cfg.Dir)
+	}
+	log.Println("存储后端:", cfg.Driver, "数据目录:", cfg.Dir)
+	return store
+}
+
+// importJSONIfEmpty 首次切换到数据库时，把原有 JSON 文件里的数据导进去
+func importJSONIfEmpty(ctx context.Context, store storage.Store, dir string) {
+	src := storage.NewJSONStore(dir)
+	for _, collection := range storage.Collections {
+		existing, err := store.List(ctx, collection)
+		if err != nil {
+			log.Fatal("读取集合失败:", collection, err)
+		}
+		if len(existing) > 0 {
+			continue
+		}
+		n, err := storage.Copy(ctx, src, store, collection)
+		if err != nil {
+			log.Fatal("导入JSON数据失败:", collection, err)
+		}
+		if n > 0 {
+			log.Printf("已从 %s/%s.json 导入 %d 条记录", dir, collection, n)
+		}
+	}
+}
+
+func initStorage(ctx context.Context, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal("创建数据目录失败:", err)
+	}
 	// 初始化JSON文件
-	initJSONFile("static/patients.json", []models.Patient{})
-	initJSONFile("static/diseases.json", []models.Disease{})
-	initJSONFile("static/doctors.json", []models.Doctor{})
-	initJSONFile("static/registrations.json", []models.Registration{})
-	initJSONFile("static/accounts.json", []models.Account{})
-	initJSONFile("static/departments.json", []models.Department{})
+	initJSONFile(filepath.Join(dir, storage.CollectionPatients+".json"), []models.Patient{})
+	initJSONFile(filepath.Join(dir, storage.CollectionDiseases+".json"), []models.Disease{})
+	initJSONFile(filepath.Join(dir, storage.CollectionDoctors+".json"), []models.Doctor{})
+	initJSONFile(filepath.Join(dir, storage.CollectionRegistrations+".json"), []models.Registration{})
+	initJSONFile(filepath.Join(dir, storage.CollectionAccounts+".json"), []models.Account{})
+	initJSONFile(filepath.Join(dir, storage.CollectionDepartments+".json"), []models.Department{})
+	initJSONFile(filepath.Join(dir, storage.CollectionRevokedTokens+".json"), []models.RevokedToken{})
+	initJSONFile(filepath.Join(dir, storage.CollectionIdempotency+".json"), []models.IdempotencyRecord{})
 }
 
 func initJSONFile(filename string, defaultData interface{}) {
-	// 如果文件不存在，创建并写入默认数据
-	// 实际实现中会检查文件是否存在并处理
+	// 如果文件不存在，创建并写入默认数据；已存在的文件不动
+	if _, err := os.Stat(filename); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		log.Fatal("检查数据文件失败:", err)
+	}
+	data, err := json.MarshalIndent(defaultData, "", "  ")
+	if err != nil {
+		log.Fatal("初始化数据文件失败:", err)
+	}
+	if err := storage.WriteFileAtomic(filename, data, 0644); err != nil {
+		log.Fatal("初始化数据文件失败:", err)
+	}
 }
@@ -0,0 +1,76 @@
+package load
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"hospital-system/models"
+	"hospital-system/storage"
+	"log"
+	"os"
+)
+
+//go:embed seed/demo.json
+var demoSeed []byte
+
+// SeedDemo 使用内置演示数据
+const SeedDemo = "demo"
+
+// seedBundle 种子数据：科室、病种和带排班的演示医生，医生通过 ID 引用病种、通过名称引用科室
+type seedBundle struct {
+	Departments []models.Department `json:"departments"`
+	Diseases    []models.Disease    `json:"diseases"`
+	Doctors     []models.Doctor     `json:"doctors"`
+}
+
+func readSeedBundle(seed string) (*seedBundle, error) {
+	data := demoSeed
+	if seed != SeedDemo {
+		var err error
+		data, err = os.ReadFile(seed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var bundle seedBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// applySeed 只往空集合里写种子数据，已有数据的集合原样保留，重复启动不会重复导入
+func applySeed(ctx context.Context, store storage.Store, bundle *seedBundle) error {
+	if err := seedCollection(ctx, store, storage.CollectionDepartments, bundle.Departments, func(d *models.Department) string { return d.ID }); err != nil {
+		return err
+	}
+	if err := seedCollection(ctx, store, storage.CollectionDiseases, bundle.Diseases, func(d *models.Disease) string { return d.ID }); err != nil {
+		return err
+	}
+	return seedCollection(ctx, store, storage.CollectionDoctors, bundle.Doctors, func(d *models.Doctor) string { return d.ID })
+}
+
+func seedCollection[T any](ctx context.Context, store storage.Store, collection string, records []T, id func(*T) string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	existing, err := store.List(ctx, collection)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return nil
+	}
+	for i := range records {
+		recordID := id(&records[i])
+		if recordID == "" {
+			return errors.New("seed record id cannot be empty in " + collection)
+		}
+		if err := storage.Save(ctx, store, collection, recordID, &records[i]); err != nil {
+			return err
+		}
+	}
+	log.Printf("已写入种子数据 %s: %d 条", collection, len(records))
+	return nil
+}
@@ -2,18 +2,30 @@ package main
 
 import (
 	"context"
+	"flag"
 	"github.com/gin-gonic/gin"
 	"hospital-system/load"
 	"hospital-system/server/httpserver"
 	"log"
 	"os"
+	"strings"
 )
 
 func main() {
+	var opts load.Options
+	flag.StringVar(&opts.DataDir, "data-dir", "", "数据目录，默认 static，也可用环境变量 HOSPITAL_DATA_DIR 指定")
+	flag.StringVar(&opts.Seed, "seed", "", "种子数据：demo 使用内置演示数据，或指定种子文件路径")
+	flag.Parse()
+
 	ctx := context.Background()
-	load.Load(ctx)
+	load.Load(ctx, opts)
 
 	router := gin.Default()
+	// 默认不信任任何代理，ClientIP 取连接的对端地址，客户端自己带的 X-Forwarded-For 不能冒充来源 IP。
+	// 部署在反向代理后面时用 TRUSTED_PROXIES 指定代理地址（逗号分隔的 IP 或 CIDR）
+	if err := router.SetTrustedProxies(trustedProxiesFromEnv()); err != nil {
+		log.Fatal("TRUSTED_PROXIES 配置错误:", err)
+	}
 
 	router.Use(corsMiddleware())
 
@@ -31,11 +43,22 @@ func main() {
 	}
 }
 
+func trustedProxiesFromEnv() []string {
+	var proxies []string
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			proxies = append(proxies, p)
+		}
+	}
+	return proxies
+}
+
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, If-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, Idempotent-Replayed, ETag")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
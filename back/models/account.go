@@ -3,12 +3,30 @@ package models
 import "time"
 
 type Account struct {
-	ID           string    `json:"id"`
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"passwordHash"`
-	Role         string    `json:"role"`
-	LinkedID     string    `json:"linkedId,omitempty"`
-	CreatedAt    time.Time `json:"createdAt"`
-	UpdatedAt    time.Time `json:"updatedAt"`
-}
+	ID           string     `json:"id"`
+	Username     string     `json:"username"`
+	PasswordHash string     `json:"passwordHash"`
+	Role         string     `json:"role"`
+	LinkedID     string     `json:"linkedId,omitempty"`
+	TokenVersion int        `json:"tokenVersion"` // 改密码、改角色或退出所有设备时加一，旧令牌随之失效
+	Disabled     bool       `json:"disabled"`
+	DisabledAt   *time.Time `json:"disabledAt,omitempty"`
+	LockedUntil  *time.Time `json:"lockedUntil,omitempty"` // 连续登录失败后的临时锁定
+
+	MustChangePassword bool `json:"mustChangePassword"` // 初始密码或管理员重置的密码，改掉之前只能访问改密码等账号接口
+
+	// 两步验证（TOTP）。密钥需要原文参与计算只能明文保存，恢复码只存 SHA-256 摘要
+	MFAEnabled       bool       `json:"mfaEnabled"`
+	MFASecret        string     `json:"mfaSecret,omitempty"`
+	MFAPendingSecret string     `json:"mfaPendingSecret,omitempty"` // 已生成但还没用验证码确认的密钥
+	MFARecoveryCodes []string   `json:"mfaRecoveryCodes,omitempty"`
+	MFALastStep      int64      `json:"mfaLastStep,omitempty"` // 最近一次用过的时间步，防止验证码重放
+	MFAEnabledAt     *time.Time `json:"mfaEnabledAt,omitempty"`
 
+	// 策略要求必须启用 MFA 的账号在登录过程中绑定时，需要管理员签发的一次性绑定码，只存 SHA-256 摘要
+	MFAEnrollmentCode      string     `json:"mfaEnrollmentCode,omitempty"`
+	MFAEnrollmentExpiresAt *time.Time `json:"mfaEnrollmentExpiresAt,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
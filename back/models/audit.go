@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+type AuditLog struct {
+	ID         string                 `json:"id"`
+	ActorID    string                 `json:"actorId"`
+	ActorRole  string                 `json:"actorRole"`
+	EntityType string                 `json:"entityType"` // patient, doctor, disease, department, registration, account
+	EntityID   string                 `json:"entityId"`
+	Action     string                 `json:"action"` // create, update, delete, restore
+	Changes    map[string]FieldChange `json:"changes,omitempty"`
+	ClientIP   string                 `json:"clientIp"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// DeleteCascade 级联删除档案时一并处理的记录，恢复档案时据此撤销
+type DeleteCascade struct {
+	Registrations []string `json:"registrations,omitempty"` // 一并软删除的挂号ID
+	Accounts      []string `json:"accounts,omitempty"`      // 解除关联的账号ID
+	Doctors       []string `json:"doctors,omitempty"`       // 从病种列表中移除了该病种的医生ID
+}
@@ -1,8 +1,12 @@
 package models
 
+import "time"
+
 type Department struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
+	ID          string     `json:"id"`
+	Version     int64      `json:"version"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	DeletedAt   *time.Time `json:"deletedAt,omitempty"`
+	DeletedBy   string     `json:"deletedBy,omitempty"` // 执行删除的账号ID
 }
-
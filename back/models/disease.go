@@ -1,10 +1,16 @@
 package models
 
+import "time"
+
 type Disease struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Category    string `json:"category"`  // 内科、外科、儿科等
-	Symptoms    string `json:"symptoms"`  // 症状描述
-	Treatment   string `json:"treatment"` // 治疗方法
+	ID            string         `json:"id"`
+	Version       int64          `json:"version"`
+	Name          string         `json:"name"`
+	Description   string         `json:"description"`
+	Category      string         `json:"category"`  // 内科、外科、儿科等
+	Symptoms      string         `json:"symptoms"`  // 症状描述
+	Treatment     string         `json:"treatment"` // 治疗方法
+	DeletedAt     *time.Time     `json:"deletedAt,omitempty"`
+	DeletedBy     string         `json:"deletedBy,omitempty"`     // 执行删除的账号ID
+	DeleteCascade *DeleteCascade `json:"deleteCascade,omitempty"` // 级联删除时一并处理的记录
 }
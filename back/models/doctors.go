@@ -1,16 +1,22 @@
 package models
 
+import "time"
+
 type Doctor struct {
-	ID           string         `json:"id"`
-	Name         string         `json:"name"`
-	Department   string         `json:"department"` // 科室
-	Title        string         `json:"title"`      // 职称
-	Introduction string         `json:"introduction"`
-	Photo        string         `json:"photo"`    // 照片URL
-	Diseases     []string       `json:"diseases"` // 管理的病种ID列表 (1-3个)
-	WorkSchedule []WorkSchedule `json:"workSchedule"`
-	MaxPatients  int            `json:"maxPatients"` // 每日最大接诊数
-	Fee          float64        `json:"fee"`         // 挂号费
+	ID            string         `json:"id"`
+	Version       int64          `json:"version"`
+	Name          string         `json:"name"`
+	Department    string         `json:"department"` // 科室
+	Title         string         `json:"title"`      // 职称
+	Introduction  string         `json:"introduction"`
+	Photo         string         `json:"photo"`    // 照片URL
+	Diseases      []string       `json:"diseases"` // 管理的病种ID列表 (1-3个)
+	WorkSchedule  []WorkSchedule `json:"workSchedule"`
+	MaxPatients   int            `json:"maxPatients"` // 每日最大接诊数
+	Fee           float64        `json:"fee"`         // 挂号费
+	DeletedAt     *time.Time     `json:"deletedAt,omitempty"`
+	DeletedBy     string         `json:"deletedBy,omitempty"`     // 执行删除的账号ID
+	DeleteCascade *DeleteCascade `json:"deleteCascade,omitempty"` // 级联删除时一并处理的记录
 }
 
 type WorkSchedule struct {
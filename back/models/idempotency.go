@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// IdempotencyRecord 带 Idempotency-Key 的请求第一次执行的结果，窗口期内重试直接回放
+type IdempotencyRecord struct {
+	ID          string    `json:"id"` // 账号、方法、路径和 key 的摘要
+	AccountID   string    `json:"accountId"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"requestHash"` // 请求体的摘要，同一个 key 换了请求体要拒绝
+	StatusCode  int       `json:"statusCode"`
+	ContentType string    `json:"contentType"`
+	ETag        string    `json:"etag,omitempty"`
+	Body        string    `json:"body"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
@@ -5,15 +5,19 @@ import (
 )
 
 type Patient struct {
-	ID               string    `json:"id"`
-	Name             string    `json:"name"`
-	Gender           string    `json:"gender"` // 男, 女
-	Age              int       `json:"age"`
-	Phone            string    `json:"phone"`
-	IDCard           string    `json:"idCard"` // 身份证号
-	Address          string    `json:"address"`
-	EmergencyContact string    `json:"emergencyContact"`
-	EmergencyPhone   string    `json:"emergencyPhone"`
-	CreatedAt        time.Time `json:"createdAt"`
-	UpdatedAt        time.Time `json:"updatedAt"`
+	ID               string         `json:"id"`
+	Version          int64          `json:"version"`
+	Name             string         `json:"name"`
+	Gender           string         `json:"gender"` // 男, 女
+	Age              int            `json:"age"`
+	Phone            string         `json:"phone"`
+	IDCard           string         `json:"idCard"` // 身份证号
+	Address          string         `json:"address"`
+	EmergencyContact string         `json:"emergencyContact"`
+	EmergencyPhone   string         `json:"emergencyPhone"`
+	CreatedAt        time.Time      `json:"createdAt"`
+	UpdatedAt        time.Time      `json:"updatedAt"`
+	DeletedAt        *time.Time     `json:"deletedAt,omitempty"`
+	DeletedBy        string         `json:"deletedBy,omitempty"`     // 执行删除的账号ID
+	DeleteCascade    *DeleteCascade `json:"deleteCascade,omitempty"` // 级联删除时一并处理的记录
 }
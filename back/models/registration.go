@@ -3,16 +3,31 @@ package models
 import "time"
 
 type Registration struct {
-	ID               string    `json:"id"`
-	PatientID        string    `json:"patientId"`
-	DoctorID         string    `json:"doctorId"`
-	Department       string    `json:"department"` // 科室
-	Departments      []string  `json:"departments,omitempty"`
-	RegistrationDate time.Time `json:"registrationDate"`
-	VisitDate        time.Time `json:"visitDate"`
-	TimeSlot         string    `json:"timeSlot"` // 时间段
-	Status           string    `json:"status"`   // pending, confirmed, completed, cancelled
-	Symptoms         string    `json:"symptoms"` // 症状描述
-	Notes            string    `json:"notes"`    // 备注
-	CreatedAt        time.Time `json:"createdAt"`
+	ID               string                     `json:"id"`
+	Version          int64                      `json:"version"`
+	PatientID        string                     `json:"patientId"`
+	DoctorID         string                     `json:"doctorId"`
+	Department       string                     `json:"department"` // 科室
+	Departments      []string                   `json:"departments,omitempty"`
+	RegistrationDate time.Time                  `json:"registrationDate"`
+	VisitDate        time.Time                  `json:"visitDate"`
+	TimeSlot         string                     `json:"timeSlot"`              // 时间段
+	Status           string                     `json:"status"`                // pending, confirmed, rescheduled, checked_in, in_consultation, completed, cancelled, no_show
+	Symptoms         string                     `json:"symptoms"`              // 症状描述
+	Notes            string                     `json:"notes"`                 // 备注
+	CheckedInAt      *time.Time                 `json:"checkedInAt,omitempty"` // 前台签到时间
+	CancelReason     string                     `json:"cancelReason,omitempty"`
+	StatusHistory    []RegistrationStatusChange `json:"statusHistory,omitempty"` // 由服务端维护，客户端传入的会被忽略
+	CreatedAt        time.Time                  `json:"createdAt"`
+	DeletedAt        *time.Time                 `json:"deletedAt,omitempty"`
+	DeletedBy        string                     `json:"deletedBy,omitempty"` // 执行删除的账号ID
+}
+
+// RegistrationStatusChange 一次状态变化，From 为空表示新建
+type RegistrationStatusChange struct {
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedBy string    `json:"changedBy,omitempty"` // 操作账号ID
+	ChangedAt time.Time `json:"changedAt"`
 }
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// RevokedToken 已吊销的令牌，过期后即可清理
+type RevokedToken struct {
+	ID        string    `json:"id"` // 令牌的 jti；整个会话被吊销时为 session:<会话ID>
+	AccountID string    `json:"accountId"`
+	Reason    string    `json:"reason"` // logout 或 rotated（刷新时被换掉）
+	ExpiresAt time.Time `json:"expiresAt"`
+	RevokedAt time.Time `json:"revokedAt"`
+}
@@ -3,6 +3,7 @@ package resource
 import (
 	"hospital-system/models"
 	services "hospital-system/server"
+	"hospital-system/storage"
 )
 
 var (
@@ -13,6 +14,8 @@ var (
 	Departments   = []models.Department{}
 )
 
+var Store storage.Store
+
 var (
 	PatientService      *services.PatientService
 	DiseaseService      *services.DiseaseService
@@ -20,4 +23,10 @@ var (
 	RegistrationService *services.RegistrationService
 	AccountService      *services.AccountService
 	DepartmentService   *services.DepartmentService
+	AuditService        *services.AuditService
+	TokenService        *services.TokenService
+	LoginGuard          *services.LoginGuard
+	AdminSetup          *services.AdminSetup
+	SearchService       *services.SearchService
+	IdempotencyService  *services.IdempotencyService
 )
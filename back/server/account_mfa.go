@@ -0,0 +1,356 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"hospital-system/auth"
+	"hospital-system/models"
+	"strings"
+	"time"
+)
+
+// ErrInvalidMFACode 验证码或恢复码不正确
+var ErrInvalidMFACode = errors.New("invalid mfa code")
+
+var (
+	ErrMFAAlreadyEnabled       = errors.New("mfa already enabled")
+	ErrMFANotEnabled           = errors.New("mfa not enabled")
+	ErrMFAEnrollmentNotStarted = errors.New("mfa enrollment not started")
+	ErrMFARequired             = errors.New("mfa is required for this role") // 策略要求必须启用，不能关闭
+	ErrInvalidEnrollmentCode   = errors.New("invalid mfa enrollment code")   // 绑定码不正确、已过期或已经用过
+)
+
+const (
+	mfaRecoveryCodeCount = 10
+	mfaEnrollmentCodeTTL = 24 * time.Hour
+)
+
+// MFAEnrollment 开始绑定时返回给前端的信息，密钥只在这一步出现
+type MFAEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"`
+}
+
+// NeedsMFA 登录时是否要走第二步：已启用 MFA，或者角色被策略要求必须启用
+func NeedsMFA(account *models.Account) bool {
+	return account.MFAEnabled || auth.MFARequired(account.Role)
+}
+
+// IssueMFAEnrollmentCode 管理员为还没绑定 MFA 的账号签发一次性绑定码，明文只返回这一次；
+// 重新签发会让上一个绑定码作废
+func (s *AccountService) IssueMFAEnrollmentCode(ctx context.Context, accountID string) (*models.Account, string, *time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if !ok {
+		return nil, "", nil, ErrAccountNotFound
+	}
+	if account.MFAEnabled {
+		return nil, "", nil, ErrMFAAlreadyEnabled
+	}
+
+	code, hash, err := newOneTimeCode()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	now := time.Now()
+	expiresAt := now.Add(mfaEnrollmentCodeTTL)
+	account.MFAEnrollmentCode = hash
+	account.MFAEnrollmentExpiresAt = &expiresAt
+	account.UpdatedAt = now
+	if err := s.save(ctx, account); err != nil {
+		return nil, "", nil, err
+	}
+	return account, code, &expiresAt, nil
+}
+
+// BeginMFAEnrollment 已登录用户生成新的待确认密钥，重复调用会覆盖上一次还没确认的密钥
+func (s *AccountService) BeginMFAEnrollment(ctx context.Context, accountID string) (*MFAEnrollment, error) {
+	return s.beginMFAEnrollment(ctx, accountID, false, "")
+}
+
+// BeginMFAEnrollmentWithCode 登录过程中绑定：只凭密码不够，还要管理员签发的绑定码
+func (s *AccountService) BeginMFAEnrollmentWithCode(ctx context.Context, accountID string, enrollmentCode string) (*MFAEnrollment, error) {
+	return s.beginMFAEnrollment(ctx, accountID, true, enrollmentCode)
+}
+
+func (s *AccountService) beginMFAEnrollment(ctx context.Context, accountID string, requireCode bool, enrollmentCode string) (*MFAEnrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if account.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if requireCode && !validEnrollmentCode(account, enrollmentCode, time.Now()) {
+		return nil, ErrInvalidEnrollmentCode
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	account.MFAPendingSecret = secret
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return &MFAEnrollment{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(auth.Issuer(), account.Username, secret),
+	}, nil
+}
+
+// ActivateMFA 用验证器 App 上的验证码确认待绑定的密钥，成功后启用 MFA 并返回一次性恢复码。
+// 启用后令牌版本加一，之前只凭密码登录的会话全部失效
+func (s *AccountService) ActivateMFA(ctx context.Context, accountID string, code string) (*models.Account, []string, error) {
+	return s.activateMFA(ctx, accountID, code, false, "")
+}
+
+// ActivateMFAWithCode 登录过程中确认绑定，绑定码在成功后作废
+func (s *AccountService) ActivateMFAWithCode(ctx context.Context, accountID string, code string, enrollmentCode string) (*models.Account, []string, error) {
+	return s.activateMFA(ctx, accountID, code, true, enrollmentCode)
+}
+
+func (s *AccountService) activateMFA(ctx context.Context, accountID string, code string, requireCode bool, enrollmentCode string) (*models.Account, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrAccountNotFound
+	}
+	if account.MFAEnabled {
+		return nil, nil, ErrMFAAlreadyEnabled
+	}
+	if requireCode && !validEnrollmentCode(account, enrollmentCode, time.Now()) {
+		return nil, nil, ErrInvalidEnrollmentCode
+	}
+	if account.MFAPendingSecret == "" {
+		return nil, nil, ErrMFAEnrollmentNotStarted
+	}
+	step, valid := auth.VerifyTOTP(account.MFAPendingSecret, code, time.Now())
+	if !valid {
+		return nil, nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	account.MFAEnabled = true
+	account.MFASecret = account.MFAPendingSecret
+	account.MFAPendingSecret = ""
+	account.MFARecoveryCodes = hashes
+	account.MFALastStep = step
+	account.MFAEnabledAt = &now
+	account.MFAEnrollmentCode = ""
+	account.MFAEnrollmentExpiresAt = nil
+	account.TokenVersion++
+	account.UpdatedAt = now
+	if err := s.save(ctx, account); err != nil {
+		return nil, nil, err
+	}
+	return account, codes, nil
+}
+
+// VerifyMFA 登录第二步：接受验证器 App 的 6 位验证码，或者一个恢复码（用过即作废）
+func (s *AccountService) VerifyMFA(ctx context.Context, accountID string, code string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if account.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	if account.LockedUntil != nil && account.LockedUntil.After(time.Now()) {
+		return nil, &AccountLockedError{Until: *account.LockedUntil}
+	}
+	if !account.MFAEnabled {
+		return nil, ErrMFANotEnabled
+	}
+	if !consumeMFACode(account, code, time.Now()) {
+		return nil, ErrInvalidMFACode
+	}
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// RegenerateRecoveryCodes 作废旧的恢复码并生成一组新的，需要当前的验证码
+func (s *AccountService) RegenerateRecoveryCodes(ctx context.Context, accountID string, code string) (*models.Account, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrAccountNotFound
+	}
+	if !account.MFAEnabled {
+		return nil, nil, ErrMFANotEnabled
+	}
+	if !consumeMFACode(account, code, time.Now()) {
+		return nil, nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	account.MFARecoveryCodes = hashes
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, nil, err
+	}
+	return account, codes, nil
+}
+
+// DisableMFA 本人关闭 MFA，需要当前的验证码；策略要求必须启用的角色不能关闭
+func (s *AccountService) DisableMFA(ctx context.Context, accountID string, code string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if !account.MFAEnabled {
+		return nil, ErrMFANotEnabled
+	}
+	if auth.MFARequired(account.Role) {
+		return nil, ErrMFARequired
+	}
+	if !consumeMFACode(account, code, time.Now()) {
+		return nil, ErrInvalidMFACode
+	}
+	clearMFA(account)
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// ResetMFA 管理员为丢失手机的用户清除 MFA，下次登录需要重新绑定；同时让该账号所有令牌失效
+func (s *AccountService) ResetMFA(ctx context.Context, accountID string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	clearMFA(account)
+	account.TokenVersion++
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func clearMFA(account *models.Account) {
+	account.MFAEnabled = false
+	account.MFASecret = ""
+	account.MFAPendingSecret = ""
+	account.MFARecoveryCodes = nil
+	account.MFALastStep = 0
+	account.MFAEnabledAt = nil
+}
+
+// consumeMFACode 校验验证码或恢复码并更新账号上的状态，调用方负责保存
+func consumeMFACode(account *models.Account, code string, now time.Time) bool {
+	code = strings.TrimSpace(code)
+	if step, ok := auth.VerifyTOTP(account.MFASecret, code, now); ok {
+		if step <= account.MFALastStep {
+			return false
+		}
+		account.MFALastStep = step
+		return true
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range account.MFARecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			account.MFARecoveryCodes = append(account.MFARecoveryCodes[:i:i], account.MFARecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes 生成一组恢复码，明文只返回这一次
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, mfaRecoveryCodeCount)
+	hashes := make([]string, 0, mfaRecoveryCodeCount)
+	for i := 0; i < mfaRecoveryCodeCount; i++ {
+		code, hash, err := newOneTimeCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hash)
+	}
+	return codes, hashes, nil
+}
+
+// newOneTimeCode 生成 xxxxx-xxxxx 格式的一次性码（恢复码、绑定码）和它的摘要
+func newOneTimeCode() (string, string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	code := raw[:5] + "-" + raw[5:]
+	return code, hashRecoveryCode(code), nil
+}
+
+// validEnrollmentCode 绑定码是否和账号上签发的一致且还没过期
+func validEnrollmentCode(account *models.Account, code string, now time.Time) bool {
+	if account.MFAEnrollmentCode == "" || account.MFAEnrollmentExpiresAt == nil || !now.Before(*account.MFAEnrollmentExpiresAt) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(account.MFAEnrollmentCode), []byte(hashRecoveryCode(code))) == 1
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
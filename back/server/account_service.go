@@ -1,71 +1,64 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"hospital-system/auth"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type AccountService struct {
-	filename string
-	mu       sync.RWMutex
+	store storage.Store
+	cache *indexedCache[models.Account]
+	mu    sync.RWMutex
 }
 
-func InitAccountService(c *AccountService) *AccountService {
-	if c == nil || c.filename == "" {
-		return &AccountService{
-			filename: "static/accounts.json",
-		}
+func InitAccountService(c *AccountService, store storage.Store) *AccountService {
+	if c == nil || c.store == nil {
+		return newAccountService(store)
 	}
 	return c
 }
 
-func (s *AccountService) readAll() ([]models.Account, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Account{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Account{}, nil
-	}
-
-	var accounts []models.Account
-	if err := json.Unmarshal(data, &accounts); err != nil {
-		return nil, err
+func newAccountService(store storage.Store) *AccountService {
+	return &AccountService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionAccounts, func(a *models.Account) string { return a.ID }).
+			withIndex("username", func(a *models.Account) string { return normalizeUsername(a.Username) }).
+			withIndex("linkedId", func(a *models.Account) string { return strings.TrimSpace(a.LinkedID) }),
 	}
+}
 
-	return accounts, nil
+func (s *AccountService) readAll(ctx context.Context) ([]models.Account, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *AccountService) GetAll(ctx context.Context) ([]models.Account, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *AccountService) GetByID(ctx context.Context, id string) (*models.Account, error) {
-	accounts, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	for _, a := range accounts {
-		if a.ID == id {
-			return &a, nil
-		}
+	if !ok {
+		return nil, ErrAccountNotFound
 	}
-	return nil, errors.New("account not found")
+	return account, nil
 }
 
 func (s *AccountService) GetByUsername(ctx context.Context, username string) (*models.Account, error) {
@@ -73,16 +66,67 @@ func (s *AccountService) GetByUsername(ctx context.Context, username string) (*m
 	if username == "" {
 		return nil, errors.New("username cannot be empty")
 	}
-	accounts, err := s.GetAll(ctx)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts, err := s.cache.lookup(ctx, "username", username)
 	if err != nil {
 		return nil, err
 	}
-	for _, a := range accounts {
-		if normalizeUsername(a.Username) == username {
-			return &a, nil
-		}
+	if len(accounts) == 0 {
+		return nil, ErrAccountNotFound
 	}
-	return nil, errors.New("account not found")
+	return &accounts[0], nil
+}
+
+func (s *AccountService) GetByLinkedID(ctx context.Context, linkedID string) ([]models.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.lookup(ctx, "linkedId", strings.TrimSpace(linkedID))
+}
+
+// ClearLinkedID 解除账号与患者/医生档案的关联，档案被删除时调用
+func (s *AccountService) ClearLinkedID(ctx context.Context, accountID string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	account.LinkedID = ""
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// RestoreLinkedID 档案恢复时重新关联级联删除时解除关联的账号。账号期间已关联到别的档案时保持不变，返回 nil
+func (s *AccountService) RestoreLinkedID(ctx context.Context, accountID string, linkedID string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if strings.TrimSpace(account.LinkedID) != "" {
+		return nil, nil
+	}
+	account.LinkedID = linkedID
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
 }
 
 func (s *AccountService) SetLinkedID(ctx context.Context, accountID string, linkedID string) (*models.Account, error) {
@@ -98,7 +142,7 @@ func (s *AccountService) SetLinkedID(ctx context.Context, accountID string, link
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	accounts, err := s.readAll()
+	accounts, err := s.readAll(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -113,83 +157,13 @@ func (s *AccountService) SetLinkedID(ctx context.Context, accountID string, link
 		if accounts[i].CreatedAt.IsZero() {
 			accounts[i].CreatedAt = now
 		}
-		if err := s.writeAll(accounts); err != nil {
+		if err := s.save(ctx, &accounts[i]); err != nil {
 			return nil, err
 		}
 		return &accounts[i], nil
 	}
 
-	return nil, errors.New("account not found")
-}
-
-func (s *AccountService) EnsureAccount(ctx context.Context, username string, password string, role string) error {
-	username = normalizeUsername(username)
-	password = strings.TrimSpace(password)
-	role = strings.TrimSpace(role)
-	if username == "" {
-		return errors.New("username cannot be empty")
-	}
-	if password == "" {
-		return errors.New("password cannot be empty")
-	}
-	switch role {
-	case "patient", "doctor", "admin":
-	default:
-		return errors.New("invalid role")
-	}
-
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	accounts, err := s.readAll()
-	if err != nil {
-		return err
-	}
-
-	for _, a := range accounts {
-		if normalizeUsername(a.Username) == username {
-			roleMatches := strings.TrimSpace(a.Role) == role
-			passwordMatches := bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
-			if roleMatches && passwordMatches {
-				return nil
-			}
-
-			hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-			if err != nil {
-				return err
-			}
-
-			now := time.Now()
-			for i := range accounts {
-				if normalizeUsername(accounts[i].Username) == username {
-					accounts[i].PasswordHash = string(hashBytes)
-					accounts[i].Role = role
-					accounts[i].UpdatedAt = now
-					if accounts[i].CreatedAt.IsZero() {
-						accounts[i].CreatedAt = now
-					}
-					break
-				}
-			}
-
-			return s.writeAll(accounts)
-		}
-	}
-
-	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return err
-	}
-	now := time.Now()
-	accounts = append(accounts, models.Account{
-		ID:           uuid.New().String(),
-		Username:     username,
-		PasswordHash: string(hashBytes),
-		Role:         role,
-		CreatedAt:    now,
-		UpdatedAt:    now,
-	})
-	return s.writeAll(accounts)
+	return nil, ErrAccountNotFound
 }
 
 func (s *AccountService) UpsertDoctorAccount(ctx context.Context, doctorID string, username string, password string) (*models.Account, error) {
@@ -202,14 +176,14 @@ func (s *AccountService) UpsertDoctorAccount(ctx context.Context, doctorID strin
 	if username == "" {
 		return nil, errors.New("username cannot be empty")
 	}
-	if password == "" {
-		return nil, errors.New("password cannot be empty")
+	if err := ValidatePassword(username, password); err != nil {
+		return nil, err
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	accounts, err := s.readAll()
+	accounts, err := s.readAll(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -229,7 +203,7 @@ func (s *AccountService) UpsertDoctorAccount(ctx context.Context, doctorID strin
 		if existingIndex >= 0 && accounts[i].ID == accounts[existingIndex].ID {
 			continue
 		}
-		return nil, errors.New("username already exists")
+		return nil, ErrUsernameTaken
 	}
 
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -243,11 +217,12 @@ func (s *AccountService) UpsertDoctorAccount(ctx context.Context, doctorID strin
 		accounts[existingIndex].PasswordHash = string(hashBytes)
 		accounts[existingIndex].Role = "doctor"
 		accounts[existingIndex].LinkedID = doctorID
+		accounts[existingIndex].TokenVersion++
 		accounts[existingIndex].UpdatedAt = now
 		if accounts[existingIndex].CreatedAt.IsZero() {
 			accounts[existingIndex].CreatedAt = now
 		}
-		if err := s.writeAll(accounts); err != nil {
+		if err := s.save(ctx, &accounts[existingIndex]); err != nil {
 			return nil, err
 		}
 		return &accounts[existingIndex], nil
@@ -262,49 +237,37 @@ func (s *AccountService) UpsertDoctorAccount(ctx context.Context, doctorID strin
 		CreatedAt:    now,
 		UpdatedAt:    now,
 	}
-	accounts = append(accounts, account)
-	if err := s.writeAll(accounts); err != nil {
+	if err := s.save(ctx, &account); err != nil {
 		return nil, err
 	}
 	return &account, nil
 }
 
-func (s *AccountService) LoginOrRegister(ctx context.Context, username string, password string) (*models.Account, bool, error) {
+// Register 注册病人账号，用户名已存在时报错，不会顶替已有账号
+func (s *AccountService) Register(ctx context.Context, username string, password string) (*models.Account, error) {
 	username = normalizeUsername(username)
 	password = strings.TrimSpace(password)
 	if username == "" {
-		return nil, false, errors.New("username cannot be empty")
+		return nil, errors.New("username cannot be empty")
 	}
-	if password == "" {
-		return nil, false, errors.New("password cannot be empty")
+	if err := ValidatePassword(username, password); err != nil {
+		return nil, err
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	accounts, err := s.readAll()
+	existing, err := s.cache.lookup(ctx, "username", username)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
-
-	for i := range accounts {
-		if normalizeUsername(accounts[i].Username) != username {
-			continue
-		}
-		if err := bcrypt.CompareHashAndPassword([]byte(accounts[i].PasswordHash), []byte(password)); err != nil {
-			return nil, false, errors.New("invalid credentials")
-		}
-		now := time.Now()
-		accounts[i].UpdatedAt = now
-		if err := s.writeAll(accounts); err != nil {
-			return nil, false, err
-		}
-		return &accounts[i], false, nil
+	if len(existing) > 0 {
+		return nil, ErrUsernameTaken
 	}
 
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 	now := time.Now()
 	account := models.Account{
@@ -315,21 +278,332 @@ func (s *AccountService) LoginOrRegister(ctx context.Context, username string, p
 		CreatedAt:    now,
 		UpdatedAt:    now,
 	}
-	accounts = append(accounts, account)
-	if err := s.writeAll(accounts); err != nil {
-		return nil, false, err
+	if err := s.save(ctx, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// CreateStaffAccount 管理员创建员工账号（如前台）。需要关联档案的角色不走这里：医生账号通过 UpsertDoctorAccount 分配，病人自己注册
+func (s *AccountService) CreateStaffAccount(ctx context.Context, username string, password string, role string) (*models.Account, error) {
+	username = normalizeUsername(username)
+	password = strings.TrimSpace(password)
+	role = strings.TrimSpace(role)
+	if username == "" {
+		return nil, errors.New("username cannot be empty")
+	}
+	roleConfig, ok := auth.RoleInfo(role)
+	if !ok {
+		return nil, errors.New("invalid role")
+	}
+	if roleConfig.LinkedEntity != "" {
+		return nil, errors.New("role requires a linked profile")
+	}
+	if err := ValidatePassword(username, password); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.cache.lookup(ctx, "username", username)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, ErrUsernameTaken
+	}
+
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	account := models.Account{
+		ID:           uuid.New().String(),
+		Username:     username,
+		PasswordHash: string(hashBytes),
+		Role:         role,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	if err := s.save(ctx, &account); err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// dummyPasswordHash 用户名不存在时也和它比较一次，响应时间不暴露用户名是否存在
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password for unknown users"), bcrypt.DefaultCost)
+
+// Login 校验用户名和密码。用户名不存在、密码错误、账号已停用返回同样的错误，且都做一次 bcrypt 比较
+func (s *AccountService) Login(ctx context.Context, username string, password string) (*models.Account, error) {
+	username = normalizeUsername(username)
+	password = strings.TrimSpace(password)
+	if username == "" {
+		return nil, errors.New("username cannot be empty")
+	}
+	if password == "" {
+		return nil, errors.New("password cannot be empty")
+	}
+
+	// lookup 返回的是副本，bcrypt 比较不需要持锁，也不再为登录改写账号文件
+	s.mu.RLock()
+	accounts, err := s.cache.lookup(ctx, "username", username)
+	s.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	account := &accounts[0]
+	passwordErr := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password))
+	if account.LockedUntil != nil && account.LockedUntil.After(time.Now()) {
+		return nil, &AccountLockedError{Until: *account.LockedUntil}
 	}
-	return &account, true, nil
+	if passwordErr != nil || account.Disabled {
+		return nil, ErrInvalidCredentials
+	}
+	// 不符合现行密码规则的旧密码（比如初始管理员的 123456）登录后必须先改密码
+	if !account.MustChangePassword && ValidatePassword(account.Username, password) != nil {
+		return s.requirePasswordChange(ctx, account.ID)
+	}
+	return account, nil
 }
 
-func (s *AccountService) writeAll(accounts []models.Account) error {
-	data, err := json.MarshalIndent(accounts, "", "  ")
+func (s *AccountService) requirePasswordChange(ctx context.Context, accountID string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	account.MustChangePassword = true
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// HasRole 是否已经存在该角色的账号（不含已停用的）
+func (s *AccountService) HasRole(ctx context.Context, role string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts, err := s.readAll(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range accounts {
+		if a.Role == role && !a.Disabled {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ErrInvalidCredentials 用户名不存在和密码错误都返回它，不区分两种情况
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrUsernameTaken 用户名已被其他账号使用
+var ErrUsernameTaken = errors.New("username already exists")
+
+// ErrAccountNotFound 账号不存在
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrAccountDisabled 已停用的账号在登录之后的步骤（MFA、刷新令牌）被拒绝；登录时按 ErrInvalidCredentials 处理
+var ErrAccountDisabled = errors.New("account disabled")
+
+// AccountLockedError 连续登录失败导致账号被临时锁定
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return "account locked until " + e.Until.Format(time.RFC3339)
+}
+
+// LockUntil 临时锁定账号，until 为零值时解除锁定
+func (s *AccountService) LockUntil(ctx context.Context, accountID string, until time.Time) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if until.IsZero() {
+		account.LockedUntil = nil
+	} else {
+		account.LockedUntil = &until
+	}
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// ChangePassword 本人修改密码，需要提供旧密码；改完后此前签发的令牌全部失效
+func (s *AccountService) ChangePassword(ctx context.Context, accountID string, oldPassword string, newPassword string) (*models.Account, error) {
+	oldPassword = strings.TrimSpace(oldPassword)
+	newPassword = strings.TrimSpace(newPassword)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(oldPassword)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if oldPassword == newPassword {
+		return nil, errors.New("new password must differ from the old one")
+	}
+	if err := s.setPassword(ctx, account, newPassword, false); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// ResetPassword 管理员重置密码，不需要旧密码；重置出来的密码管理员也知道，用户登录后要先改掉
+func (s *AccountService) ResetPassword(ctx context.Context, accountID string, newPassword string) (*models.Account, error) {
+	newPassword = strings.TrimSpace(newPassword)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if err := s.setPassword(ctx, account, newPassword, true); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (s *AccountService) setPassword(ctx context.Context, account *models.Account, password string, mustChange bool) error {
+	if err := ValidatePassword(account.Username, password); err != nil {
+		return err
+	}
+	hashBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(s.filename, data, 0644)
+	account.PasswordHash = string(hashBytes)
+	account.MustChangePassword = mustChange
+	account.TokenVersion++
+	account.UpdatedAt = time.Now()
+	return s.save(ctx, account)
+}
+
+// SetDisabled 停用或启用账号；停用后不能登录，已签发的令牌立即失效
+func (s *AccountService) SetDisabled(ctx context.Context, accountID string, disabled bool) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	if account.Disabled == disabled {
+		return account, nil
+	}
+	now := time.Now()
+	account.Disabled = disabled
+	if disabled {
+		account.DisabledAt = &now
+		account.TokenVersion++
+	} else {
+		account.DisabledAt = nil
+	}
+	account.UpdatedAt = now
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// ValidatePassword 密码强度规则：8-72 个字符，同时包含字母和数字，不能与用户名相同
+func ValidatePassword(username string, password string) error {
+	if password == "" {
+		return errors.New("password cannot be empty")
+	}
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	// bcrypt 只取前 72 字节，更长的部分不参与校验
+	if len(password) > 72 {
+		return errors.New("password must be at most 72 bytes")
+	}
+	hasLetter, hasDigit := false, false
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("password must contain both letters and digits")
+	}
+	if strings.EqualFold(password, username) {
+		return errors.New("password cannot be the same as the username")
+	}
+	return nil
+}
+
+// RevokeAllTokens 令牌版本加一，该账号此前签发的所有令牌都会失效
+func (s *AccountService) RevokeAllTokens(ctx context.Context, accountID string) (*models.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok, err := s.cache.get(ctx, strings.TrimSpace(accountID))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	account.TokenVersion++
+	account.UpdatedAt = time.Now()
+	if err := s.save(ctx, account); err != nil {
+		return nil, err
+	}
+	return account, nil
 }
 
 func normalizeUsername(username string) string {
 	return strings.ToLower(strings.TrimSpace(username))
 }
+
+func (s *AccountService) save(ctx context.Context, account *models.Account) error {
+	if err := storage.Save(ctx, s.store, storage.CollectionAccounts, account.ID, account); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
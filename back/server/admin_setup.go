@@ -0,0 +1,102 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"hospital-system/models"
+	"strings"
+	"sync"
+)
+
+// BootstrapAdminRole 首次启动时创建的管理员角色
+const BootstrapAdminRole = "admin"
+
+var (
+	ErrInvalidSetupToken = errors.New("invalid setup token")
+	ErrSetupUnavailable  = errors.New("setup not available") // 没有启用初始化令牌，或者已经有管理员了
+)
+
+// AdminSetup 首次启动时创建管理员：优先用配置里的账号密码，没有配置时生成一次性初始化令牌，
+// 通过 /api/auth/setup 用令牌创建第一个管理员。已经有管理员时什么都不做，也不会改动已有账号
+type AdminSetup struct {
+	accounts *AccountService
+	token    string
+	mu       sync.Mutex
+}
+
+func InitAdminSetup(c *AdminSetup, accounts *AccountService) *AdminSetup {
+	if c == nil || c.accounts == nil {
+		return &AdminSetup{accounts: accounts}
+	}
+	return c
+}
+
+// Bootstrap 启动时调用。username/password 都不为空时直接创建管理员；
+// 否则启用初始化令牌（token 为空时随机生成）并返回，由调用方打印出来
+func (a *AdminSetup) Bootstrap(ctx context.Context, username string, password string, token string) (*models.Account, string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	exists, err := a.accounts.HasRole(ctx, BootstrapAdminRole)
+	if err != nil || exists {
+		return nil, "", err
+	}
+
+	if strings.TrimSpace(username) != "" && strings.TrimSpace(password) != "" {
+		account, err := a.accounts.CreateStaffAccount(ctx, username, password, BootstrapAdminRole)
+		return account, "", err
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, "", err
+		}
+		token = hex.EncodeToString(b)
+	}
+	a.token = token
+	return nil, token, nil
+}
+
+// Pending 是否还在等待用初始化令牌创建管理员
+func (a *AdminSetup) Pending(ctx context.Context) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token == "" {
+		return false
+	}
+	exists, err := a.accounts.HasRole(ctx, BootstrapAdminRole)
+	return err == nil && !exists
+}
+
+// Complete 用初始化令牌创建第一个管理员，成功后令牌作废
+func (a *AdminSetup) Complete(ctx context.Context, token string, username string, password string) (*models.Account, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == "" {
+		return nil, ErrSetupUnavailable
+	}
+	exists, err := a.accounts.HasRole(ctx, BootstrapAdminRole)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		a.token = ""
+		return nil, ErrSetupUnavailable
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(a.token)) != 1 {
+		return nil, ErrInvalidSetupToken
+	}
+
+	account, err := a.accounts.CreateStaffAccount(ctx, username, password, BootstrapAdminRole)
+	if err != nil {
+		return nil, err
+	}
+	a.token = ""
+	return account, nil
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hospital-system/models"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+)
+
+// 审计日志里不落明文的字段
+var auditRedactedFields = map[string]struct{}{
+	"passwordHash":      {},
+	"mfaSecret":         {},
+	"mfaPendingSecret":  {},
+	"mfaRecoveryCodes":  {},
+	"mfaEnrollmentCode": {},
+}
+
+// AuditService 审计日志，每条一行 JSON 追加写入，只追加不修改
+type AuditService struct {
+	filename string
+	mu       sync.Mutex
+}
+
+func InitAuditService(c *AuditService, filename string) *AuditService {
+	if c == nil || c.filename == "" {
+		return &AuditService{
+			filename: filename,
+		}
+	}
+	return c
+}
+
+// AuditLogFromEnv 审计日志文件：优先 AUDIT_LOG_FILE，默认数据目录下的 audit.log。
+// 审计日志不走存储后端，用 SQLite 时也是这个只追加的文件，备份时要和数据库一起带上
+func AuditLogFromEnv(dataDir string) string {
+	if file := strings.TrimSpace(os.Getenv("AUDIT_LOG_FILE")); file != "" {
+		return file
+	}
+	return filepath.Join(dataDir, "audit.log")
+}
+
+type AuditQuery struct {
+	EntityType string
+	EntityID   string
+	ActorID    string
+	From       time.Time
+	To         time.Time
+	Limit      int
+}
+
+func (s *AuditService) Record(ctx context.Context, entry *models.AuditLog) error {
+	if entry.EntityType == "" || entry.Action == "" {
+		return errors.New("entityType/action cannot be empty")
+	}
+	entry.ID = uuid.New().String()
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Query 按条件过滤，最新的在前
+func (s *AuditService) Query(ctx context.Context, q AuditQuery) ([]models.AuditLog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []models.AuditLog{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	logs := make([]models.AuditLog, 0)
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			var entry models.AuditLog
+			// 崩溃时最后一行可能不完整，跳过解析失败的行
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr == nil && q.matches(&entry) {
+				logs = append(logs, entry)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].Timestamp.After(logs[j].Timestamp)
+	})
+	if q.Limit > 0 && len(logs) > q.Limit {
+		logs = logs[:q.Limit]
+	}
+	return logs, nil
+}
+
+func (q AuditQuery) matches(entry *models.AuditLog) bool {
+	if q.EntityType != "" && entry.EntityType != q.EntityType {
+		return false
+	}
+	if q.EntityID != "" && entry.EntityID != q.EntityID {
+		return false
+	}
+	if q.ActorID != "" && entry.ActorID != q.ActorID {
+		return false
+	}
+	if !q.From.IsZero() && entry.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.Timestamp.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// DiffFields 按 JSON 字段比较修改前后的记录，before 或 after 为 nil 分别对应新建和删除
+func DiffFields(before interface{}, after interface{}) (map[string]models.FieldChange, error) {
+	from, err := toFieldMap(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := toFieldMap(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]models.FieldChange)
+	for key, fromValue := range from {
+		toValue, ok := to[key]
+		if ok && reflect.DeepEqual(fromValue, toValue) {
+			continue
+		}
+		changes[key] = redactChange(key, models.FieldChange{From: fromValue, To: toValue})
+	}
+	for key, toValue := range to {
+		if _, ok := from[key]; ok {
+			continue
+		}
+		changes[key] = redactChange(key, models.FieldChange{To: toValue})
+	}
+	return changes, nil
+}
+
+func toFieldMap(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil()) {
+		return fields, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func redactChange(key string, change models.FieldChange) models.FieldChange {
+	if _, ok := auditRedactedFields[key]; !ok {
+		return change
+	}
+	if change.From != nil {
+		change.From = "***"
+	}
+	if change.To != nil {
+		change.To = "***"
+	}
+	return change
+}
@@ -4,39 +4,101 @@ import (
 	"context"
 	"hospital-system/models"
 	"hospital-system/resource"
+	services "hospital-system/server"
+	"time"
 )
 
+// 首页只展示最近的几条动态，其余只给总数
+const recentLimit = 6
+
 type IndexInfo struct {
-	Patients      []models.Patient      `json:"patients"`
-	Doctors       []models.Doctor       `json:"doctors"`
-	Registrations []models.Registration `json:"registrations"`
+	PatientCount       int                   `json:"patientCount"`
+	DoctorCount        int                   `json:"doctorCount"`
+	RegistrationCount  int                   `json:"registrationCount"`
+	TodayRegistrations int                   `json:"todayRegistrations"` // 今天新挂的号
+	TodayStatusCounts  map[string]int        `json:"todayStatusCounts"`  // 今天新挂的号按状态统计
+	Patients           []models.Patient      `json:"patients"`           // 最近注册的病人，以及最近挂号涉及的病人
+	Doctors            []models.Doctor       `json:"doctors"`            // 最近挂号涉及的医生
+	Registrations      []models.Registration `json:"registrations"`      // 最近的挂号
 }
 
 func GetIndexInfo(ctx context.Context) ([]IndexInfo, error) {
-	var indexInfo []IndexInfo
-
-	// 获取所有患者信息
 	patients, err := resource.PatientService.GetAll(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	// 获取所有医生信息
 	doctors, err := resource.DoctorService.GetAll(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	// 获取所有挂号信息
 	registrations, err := resource.RegistrationService.GetAll(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	indexInfo = append(indexInfo, IndexInfo{
-		Patients:      patients,
-		Doctors:       doctors,
-		Registrations: registrations,
-	})
-	return indexInfo, nil
+	info := IndexInfo{
+		PatientCount:      len(patients),
+		DoctorCount:       len(doctors),
+		RegistrationCount: len(registrations),
+		TodayStatusCounts: map[string]int{},
+	}
+	now := time.Now()
+	for _, r := range registrations {
+		if sameDay(registeredAt(&r), now) {
+			info.TodayRegistrations++
+			info.TodayStatusCounts[r.Status]++
+		}
+	}
+
+	recent := services.ListQuery{PageSize: recentLimit, Sort: []services.SortField{{Field: "registrationDate", Desc: true}}}
+	regPage, err := services.Paginate(registrations, recent, services.RegistrationSortKeys, func(r *models.Registration) string { return r.ID })
+	if err != nil {
+		return nil, err
+	}
+	info.Registrations = regPage.Items
+
+	recent.Sort = []services.SortField{{Field: "createdAt", Desc: true}}
+	patientPage, err := services.Paginate(patients, recent, services.PatientSortKeys, func(p *models.Patient) string { return p.ID })
+	if err != nil {
+		return nil, err
+	}
+
+	// 最近挂号里出现的病人和医生一并带上，前端用来显示姓名
+	patientIDs := map[string]bool{}
+	doctorIDs := map[string]bool{}
+	for _, r := range info.Registrations {
+		patientIDs[r.PatientID] = true
+		doctorIDs[r.DoctorID] = true
+	}
+	info.Patients = append([]models.Patient{}, patientPage.Items...)
+	for _, p := range patientPage.Items {
+		delete(patientIDs, p.ID)
+	}
+	for _, p := range patients {
+		if patientIDs[p.ID] {
+			info.Patients = append(info.Patients, p)
+		}
+	}
+	info.Doctors = []models.Doctor{}
+	for _, d := range doctors {
+		if doctorIDs[d.ID] {
+			info.Doctors = append(info.Doctors, d)
+		}
+	}
+
+	return []IndexInfo{info}, nil
+}
+
+// registeredAt 挂号时间，老数据没有 registrationDate 时用 createdAt
+func registeredAt(r *models.Registration) time.Time {
+	if !r.RegistrationDate.IsZero() {
+		return r.RegistrationDate
+	}
+	return r.CreatedAt
+}
+
+func sameDay(a time.Time, b time.Time) bool {
+	ay, am, ad := a.Local().Date()
+	by, bm, bd := b.Local().Date()
+	return ay == by && am == bm && ad == bd
 }
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hospital-system/models"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 病人挂号冲突的规则名，随 409 一起返回给前端
+const (
+	BookingRuleSameDoctorSameDay = "same_doctor_same_day" // 同一医生同一天只能有一个有效挂号
+	BookingRuleOverlappingSlot   = "overlapping_time_slot"
+	BookingRuleMaxPerDay         = "max_active_per_day"
+	BookingRuleMaxPerWeek        = "max_active_per_week"
+)
+
+// BookingPolicy 每个病人的挂号上限，0 表示不限制。
+// 同医生同一天重复挂号、时间段重叠这两条始终检查，不需要配置
+type BookingPolicy struct {
+	MaxActivePerDay  int
+	MaxActivePerWeek int // 按周一到周日的自然周统计
+}
+
+// BookingPolicyFromEnv 读取 BOOKING_MAX_ACTIVE_PER_DAY / BOOKING_MAX_ACTIVE_PER_WEEK
+func BookingPolicyFromEnv() (BookingPolicy, error) {
+	var p BookingPolicy
+	var err error
+	if p.MaxActivePerDay, err = envLimit("BOOKING_MAX_ACTIVE_PER_DAY"); err != nil {
+		return p, err
+	}
+	if p.MaxActivePerWeek, err = envLimit("BOOKING_MAX_ACTIVE_PER_WEEK"); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func envLimit(name string) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid " + name + ": " + v)
+	}
+	return n, nil
+}
+
+// BookingConflictError 病人的挂号和已有挂号冲突，Conflicting 是冲突的那一条
+type BookingConflictError struct {
+	Rule        string
+	Limit       int
+	Conflicting models.Registration
+}
+
+func (e *BookingConflictError) Error() string {
+	c := e.Conflicting
+	switch e.Rule {
+	case BookingRuleSameDoctorSameDay:
+		return fmt.Sprintf("patient already has registration %s with this doctor on %s", c.ID, visitDay(c.VisitDate))
+	case BookingRuleOverlappingSlot:
+		return fmt.Sprintf("time slot overlaps registration %s (%s %s)", c.ID, visitDay(c.VisitDate), c.TimeSlot)
+	case BookingRuleMaxPerDay:
+		return fmt.Sprintf("patient already has %d active registrations on %s", e.Limit, visitDay(c.VisitDate))
+	default:
+		return fmt.Sprintf("patient already has %d active registrations this week", e.Limit)
+	}
+}
+
+// SetBookingPolicy 启动时按配置设置挂号上限
+func (s *RegistrationService) SetBookingPolicy(p BookingPolicy) {
+	s.mu.Lock()
+	s.policy = p
+	s.mu.Unlock()
+}
+
+// IsActiveBooking 还占着时间的挂号；已完成、已取消、爽约的不算
+func IsActiveBooking(status string) bool {
+	switch status {
+	case RegistrationPending, RegistrationConfirmed, RegistrationRescheduled, RegistrationCheckedIn, RegistrationInConsultation:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkPatientBookings 检查病人的挂号冲突，调用方持有写锁。excludeID 为正在修改的那条
+func (s *RegistrationService) checkPatientBookings(ctx context.Context, excludeID string, registration *models.Registration) error {
+	if !IsActiveBooking(registration.Status) {
+		return nil
+	}
+	existing, err := s.cache.lookup(ctx, "patientId", registration.PatientID)
+	if err != nil {
+		return err
+	}
+
+	day := visitDay(registration.VisitDate)
+	weekStart, weekEnd := visitWeek(registration.VisitDate)
+	var sameDay, sameWeek []models.Registration
+	for _, r := range existing {
+		if r.ID == excludeID || !IsActiveBooking(r.Status) {
+			continue
+		}
+		rDay := visitDay(r.VisitDate)
+		if rDay == day {
+			if r.DoctorID == registration.DoctorID {
+				return &BookingConflictError{Rule: BookingRuleSameDoctorSameDay, Conflicting: r}
+			}
+			if timeSlotsOverlap(r.TimeSlot, registration.TimeSlot) {
+				return &BookingConflictError{Rule: BookingRuleOverlappingSlot, Conflicting: r}
+			}
+			sameDay = append(sameDay, r)
+		}
+		if rDay >= weekStart && rDay <= weekEnd {
+			sameWeek = append(sameWeek, r)
+		}
+	}
+
+	if limit := s.policy.MaxActivePerDay; limit > 0 && len(sameDay) >= limit {
+		return &BookingConflictError{Rule: BookingRuleMaxPerDay, Limit: limit, Conflicting: sameDay[len(sameDay)-1]}
+	}
+	if limit := s.policy.MaxActivePerWeek; limit > 0 && len(sameWeek) >= limit {
+		return &BookingConflictError{Rule: BookingRuleMaxPerWeek, Limit: limit, Conflicting: sameWeek[len(sameWeek)-1]}
+	}
+	return nil
+}
+
+// timeSlotsOverlap 两个时间段是否有交集，只有一个时间点的按一分钟算；解析不了时按原文是否相同判断
+func timeSlotsOverlap(a string, b string) bool {
+	aStart, aEnd, errA := ParseTimeSlot(a)
+	bStart, bEnd, errB := ParseTimeSlot(b)
+	if errA != nil || errB != nil {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	if aEnd == aStart {
+		aEnd++
+	}
+	if bEnd == bStart {
+		bEnd++
+	}
+	return aStart < bEnd && bStart < aEnd
+}
+
+// visitWeek 就诊日期所在自然周（周一到周日）的起止日期，格式同 visitDay
+func visitWeek(t time.Time) (string, string) {
+	t = t.Local()
+	offset := (int(t.Weekday()) + 6) % 7
+	start := t.AddDate(0, 0, -offset)
+	return visitDay(start), visitDay(start.AddDate(0, 0, 6))
+}
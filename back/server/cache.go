@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"hospital-system/storage"
+	"sync"
+)
+
+// indexedCache 集合的内存副本，带 ID 索引和若干二级索引。
+// 每次读取先比对存储的版本号，只有数据被改动（包括磁盘文件被外部修改）才重新加载
+type indexedCache[T any] struct {
+	store      storage.Store
+	collection string
+	id         func(*T) string
+	indexBy    map[string]func(*T) string
+	normalize  func(*T)
+	deleted    func(*T) bool
+
+	mu      sync.RWMutex
+	valid   bool
+	version string
+	items   []T
+	byID    map[string]int
+	indexes map[string]map[string][]int
+}
+
+func newIndexedCache[T any](store storage.Store, collection string, id func(*T) string) *indexedCache[T] {
+	return &indexedCache[T]{
+		store:      store,
+		collection: collection,
+		id:         id,
+		indexBy:    map[string]func(*T) string{},
+	}
+}
+
+// withIndex 注册二级索引，key 返回空串的记录不进索引
+func (c *indexedCache[T]) withIndex(name string, key func(*T) string) *indexedCache[T] {
+	c.indexBy[name] = key
+	return c
+}
+
+func (c *indexedCache[T]) withNormalize(fn func(*T)) *indexedCache[T] {
+	c.normalize = fn
+	return c
+}
+
+// withSoftDelete 注册软删除判断，all/get/lookup 默认跳过已删除的记录
+func (c *indexedCache[T]) withSoftDelete(fn func(*T) bool) *indexedCache[T] {
+	c.deleted = fn
+	return c
+}
+
+// NotDeletedError 恢复一条没有被删除的记录
+type NotDeletedError struct {
+	Entity string
+}
+
+func (e *NotDeletedError) Error() string {
+	return e.Entity + " is not deleted"
+}
+
+func (c *indexedCache[T]) isDeleted(item *T) bool {
+	return c.deleted != nil && c.deleted(item)
+}
+
+func (c *indexedCache[T]) invalidate() {
+	c.mu.Lock()
+	c.valid = false
+	c.mu.Unlock()
+}
+
+func (c *indexedCache[T]) all(ctx context.Context) ([]T, error) {
+	return c.list(ctx, false)
+}
+
+func (c *indexedCache[T]) allIncludingDeleted(ctx context.Context) ([]T, error) {
+	return c.list(ctx, true)
+}
+
+func (c *indexedCache[T]) list(ctx context.Context, includeDeleted bool) ([]T, error) {
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	items := make([]T, 0, len(c.items))
+	for i := range c.items {
+		if includeDeleted || !c.isDeleted(&c.items[i]) {
+			items = append(items, c.items[i])
+		}
+	}
+	return items, nil
+}
+
+func (c *indexedCache[T]) get(ctx context.Context, id string) (*T, bool, error) {
+	item, ok, err := c.getIncludingDeleted(ctx, id)
+	if err != nil || !ok || c.isDeleted(item) {
+		return nil, false, err
+	}
+	return item, true, nil
+}
+
+func (c *indexedCache[T]) getIncludingDeleted(ctx context.Context, id string) (*T, bool, error) {
+	if err := c.refresh(ctx); err != nil {
+		return nil, false, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	i, ok := c.byID[id]
+	if !ok {
+		return nil, false, nil
+	}
+	item := c.items[i]
+	return &item, true, nil
+}
+
+func (c *indexedCache[T]) lookup(ctx context.Context, index string, key string) ([]T, error) {
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	positions := c.indexes[index][key]
+	items := make([]T, 0, len(positions))
+	for _, i := range positions {
+		if !c.isDeleted(&c.items[i]) {
+			items = append(items, c.items[i])
+		}
+	}
+	return items, nil
+}
+
+func (c *indexedCache[T]) refresh(ctx context.Context) error {
+	version := ""
+	if v, ok := c.store.(storage.Versioner); ok {
+		current, err := v.Version(ctx, c.collection)
+		if err != nil {
+			return err
+		}
+		version = current
+	}
+
+	c.mu.RLock()
+	fresh := c.valid && version != "" && version == c.version
+	c.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	items, err := storage.LoadAll[T](ctx, c.store, c.collection)
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]int, len(items))
+	indexes := make(map[string]map[string][]int, len(c.indexBy))
+	for name := range c.indexBy {
+		indexes[name] = map[string][]int{}
+	}
+	for i := range items {
+		if c.normalize != nil {
+			c.normalize(&items[i])
+		}
+		byID[c.id(&items[i])] = i
+		for name, key := range c.indexBy {
+			if k := key(&items[i]); k != "" {
+				indexes[name][k] = append(indexes[name][k], i)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.items = items
+	c.byID = byID
+	c.indexes = indexes
+	c.version = version
+	c.valid = true
+	c.mu.Unlock()
+	return nil
+}
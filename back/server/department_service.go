@@ -1,82 +1,84 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrDepartmentNotFound 科室不存在或已删除
+var ErrDepartmentNotFound = errors.New("department not found")
+
 type DepartmentService struct {
-	filename string
-	mu       sync.RWMutex
+	store storage.Store
+	cache *indexedCache[models.Department]
+	mu    sync.RWMutex
 }
 
-func InitDepartmentService(c *DepartmentService) *DepartmentService {
-	if c == nil || c.filename == "" {
-		return &DepartmentService{
-			filename: "static/departments.json",
-		}
+func InitDepartmentService(c *DepartmentService, store storage.Store) *DepartmentService {
+	if c == nil || c.store == nil {
+		return newDepartmentService(store)
 	}
 	return c
 }
 
-func (s *DepartmentService) readAll() ([]models.Department, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Department{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Department{}, nil
+func newDepartmentService(store storage.Store) *DepartmentService {
+	return &DepartmentService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionDepartments, func(d *models.Department) string { return d.ID }).
+			withIndex("name", func(d *models.Department) string { return d.Name }).
+			withSoftDelete(func(d *models.Department) bool { return d.DeletedAt != nil }),
 	}
-
-	var departments []models.Department
-	if err := json.Unmarshal(data, &departments); err != nil {
-		return nil, err
-	}
-	return departments, nil
 }
 
-func (s *DepartmentService) writeAll(departments []models.Department) error {
-	data, err := json.MarshalIndent(departments, "", "  ")
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(s.filename, data, 0644)
+func (s *DepartmentService) readAll(ctx context.Context) ([]models.Department, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *DepartmentService) GetAll(ctx context.Context) ([]models.Department, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *DepartmentService) GetByID(ctx context.Context, id string) (*models.Department, error) {
-	departments, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	department, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-	for _, d := range departments {
-		if d.ID == id {
-			return &d, nil
-		}
+	if !ok {
+		return nil, ErrDepartmentNotFound
+	}
+	return department, nil
+}
+
+func (s *DepartmentService) GetByName(ctx context.Context, name string) (*models.Department, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	departments, err := s.cache.lookup(ctx, "name", name)
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("department not found")
+	if len(departments) == 0 {
+		return nil, ErrDepartmentNotFound
+	}
+	return &departments[0], nil
 }
 
 func (s *DepartmentService) Create(ctx context.Context, d *models.Department) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	departments, err := s.readAll()
+	departments, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -89,15 +91,17 @@ func (s *DepartmentService) Create(ctx context.Context, d *models.Department) er
 		}
 	}
 	d.ID = uuid.New().String()
-	departments = append(departments, *d)
-	return s.writeAll(departments)
+	d.Version = 0
+	d.DeletedAt = nil
+	d.DeletedBy = ""
+	return s.save(ctx, d)
 }
 
-func (s *DepartmentService) Update(ctx context.Context, id string, updated *models.Department) error {
+func (s *DepartmentService) Update(ctx context.Context, id string, updated *models.Department, expectedVersion int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	departments, err := s.readAll()
+	departments, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -113,32 +117,85 @@ func (s *DepartmentService) Update(ctx context.Context, id string, updated *mode
 	found := false
 	for i, d := range departments {
 		if d.ID == id {
+			if err := checkVersion(expectedVersion, d.Version); err != nil {
+				return err
+			}
 			updated.ID = id
+			updated.Version = d.Version
+			updated.DeletedAt = nil
+			updated.DeletedBy = ""
 			departments[i] = *updated
 			found = true
 			break
 		}
 	}
 	if !found {
-		return errors.New("department not found")
+		return ErrDepartmentNotFound
 	}
-	return s.writeAll(departments)
+	return s.save(ctx, updated)
 }
 
-func (s *DepartmentService) Delete(ctx context.Context, id string) error {
+// Delete 软删除：记录删除时间和操作人，默认查询不再返回，可通过 Restore 恢复
+func (s *DepartmentService) Delete(ctx context.Context, id string, actor string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	departments, err := s.readAll()
+	department, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return err
 	}
-	newDepartments := make([]models.Department, 0, len(departments))
-	for _, d := range departments {
-		if d.ID != id {
-			newDepartments = append(newDepartments, d)
+	if !ok {
+		return ErrDepartmentNotFound
+	}
+	now := time.Now()
+	department.DeletedAt = &now
+	department.DeletedBy = actor
+	return s.save(ctx, department)
+}
+
+func (s *DepartmentService) Restore(ctx context.Context, id string) (*models.Department, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	department, ok, err := s.cache.getIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDepartmentNotFound
+	}
+	if department.DeletedAt == nil {
+		return nil, &NotDeletedError{Entity: "department"}
+	}
+	departments, err := s.readAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range departments {
+		if existing.Name == department.Name {
+			return nil, errors.New("department name already exists")
 		}
 	}
-	return s.writeAll(newDepartments)
+	department.DeletedAt = nil
+	department.DeletedBy = ""
+	if err := s.save(ctx, department); err != nil {
+		return nil, err
+	}
+	return department, nil
+}
+
+// GetAllIncludingDeleted 包含已软删除的记录，仅供管理员查看
+func (s *DepartmentService) GetAllIncludingDeleted(ctx context.Context) ([]models.Department, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.allIncludingDeleted(ctx)
 }
 
+func (s *DepartmentService) save(ctx context.Context, department *models.Department) error {
+	department.Version++
+	if err := storage.Save(ctx, s.store, storage.CollectionDepartments, department.ID, department); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
@@ -1,81 +1,68 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrDiseaseNotFound 病种不存在或已删除
+var ErrDiseaseNotFound = errors.New("disease not found")
+
 type DiseaseService struct {
-	filename string
-	mu       sync.RWMutex
+	store storage.Store
+	cache *indexedCache[models.Disease]
+	mu    sync.RWMutex
 }
 
-func InitDiseaseService(c *DiseaseService) *DiseaseService {
-	if c == nil || c.filename == "" {
-		return &DiseaseService{
-			filename: "static/diseases.json",
-		}
+func InitDiseaseService(c *DiseaseService, store storage.Store) *DiseaseService {
+	if c == nil || c.store == nil {
+		return newDiseaseService(store)
 	}
 	return c
 }
 
-func (s *DiseaseService) readAll() ([]models.Disease, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Disease{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Disease{}, nil
-	}
-
-	var diseases []models.Disease
-	if err := json.Unmarshal(data, &diseases); err != nil {
-		return nil, err
+func newDiseaseService(store storage.Store) *DiseaseService {
+	return &DiseaseService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionDiseases, func(d *models.Disease) string { return d.ID }).
+			withSoftDelete(func(d *models.Disease) bool { return d.DeletedAt != nil }),
 	}
+}
 
-	return diseases, nil
+func (s *DiseaseService) readAll(ctx context.Context) ([]models.Disease, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *DiseaseService) GetAll(ctx context.Context) ([]models.Disease, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *DiseaseService) GetByID(ctx context.Context, id string) (*models.Disease, error) {
-	diseases, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	disease, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, disease := range diseases {
-		if disease.ID == id {
-			return &disease, nil
-		}
+	if !ok {
+		return nil, ErrDiseaseNotFound
 	}
-
-	return nil, errors.New("disease not found")
+	return disease, nil
 }
 
 func (s *DiseaseService) Create(ctx context.Context, disease *models.Disease) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	diseases, err := s.readAll()
-	if err != nil {
-		return err
-	}
-
 	if disease.Name == "" {
 		return errors.New("name cannot be empty")
 	}
@@ -84,21 +71,18 @@ func (s *DiseaseService) Create(ctx context.Context, disease *models.Disease) er
 	}
 
 	disease.ID = uuid.New().String()
-	diseases = append(diseases, *disease)
-
-	data, err := json.MarshalIndent(diseases, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	disease.Version = 0
+	disease.DeletedAt = nil
+	disease.DeletedBy = ""
+	disease.DeleteCascade = nil
+	return s.save(ctx, disease)
 }
 
-func (s *DiseaseService) Update(ctx context.Context, id string, updatedDisease *models.Disease) error {
+func (s *DiseaseService) Update(ctx context.Context, id string, updatedDisease *models.Disease, expectedVersion int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	diseases, err := s.readAll()
+	diseases, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -113,44 +97,94 @@ func (s *DiseaseService) Update(ctx context.Context, id string, updatedDisease *
 	found := false
 	for i, disease := range diseases {
 		if disease.ID == id {
+			if err := checkVersion(expectedVersion, disease.Version); err != nil {
+				return err
+			}
 			updatedDisease.ID = id
+			updatedDisease.Version = disease.Version
+			updatedDisease.DeletedAt = nil
+			updatedDisease.DeletedBy = ""
+			updatedDisease.DeleteCascade = nil
 			diseases[i] = *updatedDisease
 			found = true
 			break
 		}
 	}
 	if !found {
-		return errors.New("disease not found")
+		return ErrDiseaseNotFound
 	}
 
-	data, err := json.MarshalIndent(diseases, "", "  ")
+	return s.save(ctx, updatedDisease)
+}
+
+// Delete 软删除：记录删除时间和操作人，默认查询不再返回，可通过 Restore 恢复。cascade 为级联处理过的记录
+func (s *DiseaseService) Delete(ctx context.Context, id string, actor string, cascade *models.DeleteCascade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	disease, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	if !ok {
+		return ErrDiseaseNotFound
+	}
+	now := time.Now()
+	disease.DeletedAt = &now
+	disease.DeletedBy = actor
+	disease.DeleteCascade = cascade
+	return s.save(ctx, disease)
 }
 
-func (s *DiseaseService) Delete(ctx context.Context, id string) error {
+func (s *DiseaseService) Restore(ctx context.Context, id string) (*models.Disease, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	diseases, err := s.readAll()
+	disease, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	newDiseases := make([]models.Disease, 0, len(diseases))
-	for _, disease := range diseases {
-		if disease.ID != id {
-			newDiseases = append(newDiseases, disease)
-		}
+	if !ok {
+		return nil, ErrDiseaseNotFound
+	}
+	if disease.DeletedAt == nil {
+		return nil, &NotDeletedError{Entity: "disease"}
 	}
+	disease.DeletedAt = nil
+	disease.DeletedBy = ""
+	disease.DeleteCascade = nil
+	if err := s.save(ctx, disease); err != nil {
+		return nil, err
+	}
+	return disease, nil
+}
 
-	data, err := json.MarshalIndent(newDiseases, "", "  ")
+func (s *DiseaseService) GetByIDIncludingDeleted(ctx context.Context, id string) (*models.Disease, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	disease, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDiseaseNotFound
 	}
+	return disease, nil
+}
 
-	return os.WriteFile(s.filename, data, 0644)
+// GetAllIncludingDeleted 包含已软删除的记录，仅供管理员查看
+func (s *DiseaseService) GetAllIncludingDeleted(ctx context.Context) ([]models.Disease, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.allIncludingDeleted(ctx)
+}
+
+func (s *DiseaseService) save(ctx context.Context, disease *models.Disease) error {
+	disease.Version++
+	if err := storage.Save(ctx, s.store, storage.CollectionDiseases, disease.ID, disease); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
 }
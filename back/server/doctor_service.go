@@ -1,81 +1,75 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrDoctorNotFound 医生不存在或已删除
+var ErrDoctorNotFound = errors.New("doctor not found")
+
 type DoctorService struct {
-	filename string
-	mu       sync.RWMutex
+	store storage.Store
+	cache *indexedCache[models.Doctor]
+	mu    sync.RWMutex
 }
 
-func InitDoctorService(c *DoctorService) *DoctorService {
-	if c == nil || c.filename == "" {
-		return &DoctorService{
-			filename: "static/doctors.json",
-		}
+func InitDoctorService(c *DoctorService, store storage.Store) *DoctorService {
+	if c == nil || c.store == nil {
+		return newDoctorService(store)
 	}
 	return c
 }
 
-func (s *DoctorService) readAll() ([]models.Doctor, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Doctor{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Doctor{}, nil
-	}
-
-	var doctors []models.Doctor
-	if err := json.Unmarshal(data, &doctors); err != nil {
-		return nil, err
+func newDoctorService(store storage.Store) *DoctorService {
+	return &DoctorService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionDoctors, func(d *models.Doctor) string { return d.ID }).
+			withIndex("department", func(d *models.Doctor) string { return d.Department }).
+			withSoftDelete(func(d *models.Doctor) bool { return d.DeletedAt != nil }),
 	}
+}
 
-	return doctors, nil
+func (s *DoctorService) readAll(ctx context.Context) ([]models.Doctor, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *DoctorService) GetAll(ctx context.Context) ([]models.Doctor, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *DoctorService) GetByID(ctx context.Context, id string) (*models.Doctor, error) {
-	doctors, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	doctor, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, doctor := range doctors {
-		if doctor.ID == id {
-			return &doctor, nil
-		}
+	if !ok {
+		return nil, ErrDoctorNotFound
 	}
+	return doctor, nil
+}
 
-	return nil, errors.New("doctor not found")
+func (s *DoctorService) GetByDepartment(ctx context.Context, department string) ([]models.Doctor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.lookup(ctx, "department", department)
 }
 
 func (s *DoctorService) Create(ctx context.Context, doctor *models.Doctor) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	doctors, err := s.readAll()
-	if err != nil {
-		return err
-	}
-
 	if doctor.Name == "" {
 		return errors.New("name cannot be empty")
 	}
@@ -99,21 +93,18 @@ func (s *DoctorService) Create(ctx context.Context, doctor *models.Doctor) error
 	}
 
 	doctor.ID = uuid.New().String()
-	doctors = append(doctors, *doctor)
-
-	data, err := json.MarshalIndent(doctors, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	doctor.Version = 0
+	doctor.DeletedAt = nil
+	doctor.DeletedBy = ""
+	doctor.DeleteCascade = nil
+	return s.save(ctx, doctor)
 }
 
-func (s *DoctorService) Update(ctx context.Context, id string, updatedDoctor *models.Doctor) error {
+func (s *DoctorService) Update(ctx context.Context, id string, updatedDoctor *models.Doctor, expectedVersion int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	doctors, err := s.readAll()
+	doctors, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -143,46 +134,87 @@ func (s *DoctorService) Update(ctx context.Context, id string, updatedDoctor *mo
 	found := false
 	for i, doctor := range doctors {
 		if doctor.ID == id {
+			if err := checkVersion(expectedVersion, doctor.Version); err != nil {
+				return err
+			}
 			updatedDoctor.ID = id
+			updatedDoctor.Version = doctor.Version
+			updatedDoctor.DeletedAt = nil
+			updatedDoctor.DeletedBy = ""
+			updatedDoctor.DeleteCascade = nil
 			doctors[i] = *updatedDoctor
 			found = true
 			break
 		}
 	}
 	if !found {
-		return errors.New("doctor not found")
+		return ErrDoctorNotFound
 	}
 
-	data, err := json.MarshalIndent(doctors, "", "  ")
+	return s.save(ctx, updatedDoctor)
+}
+
+// Delete 软删除：记录删除时间和操作人，默认查询不再返回，可通过 Restore 恢复。cascade 为级联处理过的记录
+func (s *DoctorService) Delete(ctx context.Context, id string, actor string, cascade *models.DeleteCascade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	doctor, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	if !ok {
+		return ErrDoctorNotFound
+	}
+	now := time.Now()
+	doctor.DeletedAt = &now
+	doctor.DeletedBy = actor
+	doctor.DeleteCascade = cascade
+	return s.save(ctx, doctor)
 }
 
-func (s *DoctorService) Delete(ctx context.Context, id string) error {
+func (s *DoctorService) Restore(ctx context.Context, id string) (*models.Doctor, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	doctors, err := s.readAll()
+	doctor, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	newDoctors := make([]models.Doctor, 0, len(doctors))
-	for _, doctor := range doctors {
-		if doctor.ID != id {
-			newDoctors = append(newDoctors, doctor)
-		}
+	if !ok {
+		return nil, ErrDoctorNotFound
+	}
+	if doctor.DeletedAt == nil {
+		return nil, &NotDeletedError{Entity: "doctor"}
+	}
+	doctor.DeletedAt = nil
+	doctor.DeletedBy = ""
+	doctor.DeleteCascade = nil
+	if err := s.save(ctx, doctor); err != nil {
+		return nil, err
 	}
+	return doctor, nil
+}
+
+func (s *DoctorService) GetByIDIncludingDeleted(ctx context.Context, id string) (*models.Doctor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	data, err := json.MarshalIndent(newDoctors, "", "  ")
+	doctor, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDoctorNotFound
 	}
+	return doctor, nil
+}
 
-	return os.WriteFile(s.filename, data, 0644)
+// GetAllIncludingDeleted 包含已软删除的记录，仅供管理员查看
+func (s *DoctorService) GetAllIncludingDeleted(ctx context.Context) ([]models.Doctor, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.allIncludingDeleted(ctx)
 }
 
 func defaultDoctorWorkSchedule() []models.WorkSchedule {
@@ -196,3 +228,12 @@ func defaultDoctorWorkSchedule() []models.WorkSchedule {
 		{DayOfWeek: "周日", StartTime: "09:00", EndTime: "17:00", IsAvailable: false},
 	}
 }
+
+func (s *DoctorService) save(ctx context.Context, doctor *models.Doctor) error {
+	doctor.Version++
+	if err := storage.Save(ctx, s.store, storage.CollectionDoctors, doctor.ID, doctor); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
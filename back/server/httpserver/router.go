@@ -11,64 +11,110 @@ import (
 )
 
 func SetupRoutes(router *gin.Engine) {
-	// 首页展示信息
+	// 首页展示信息，里面有病人记录，需要登录并有首页权限
 	index := router.Group("/index")
 	{
-		index.GET("/", controllers.Index)
+		index.GET("/", auth.GinPermissionMiddleware(auth.PermDashboardRead), controllers.Index)
 	}
 
 	// 患者管理
 	patientGroup := router.Group("/api/patients")
 	{
-		patientGroup.GET("/getPatients", auth.GinAuthMiddleware("admin", "doctor"), controllers.GetPatients)
-		patientGroup.GET("/getPatient", auth.GinAuthMiddleware("admin", "doctor"), controllers.GetPatient)
-		patientGroup.POST("/createPatient", auth.GinAuthMiddleware("admin"), controllers.CreatePatient)
-		patientGroup.PUT("/updatePatient", auth.GinAuthMiddleware("admin"), controllers.UpdatePatient)
-		patientGroup.DELETE("/deletePatient", auth.GinAuthMiddleware("admin"), controllers.DeletePatient)
+		patientGroup.GET("/getPatients", auth.GinPermissionMiddleware(auth.PermPatientRead), controllers.GetPatients)
+		patientGroup.GET("/getPatient", auth.GinPermissionMiddleware(auth.PermPatientRead), controllers.GetPatient)
+		patientGroup.POST("/createPatient", auth.GinPermissionMiddleware(auth.PermPatientCreate), controllers.IdempotencyMiddleware(), controllers.CreatePatient)
+		patientGroup.PUT("/updatePatient", auth.GinPermissionMiddleware(auth.PermPatientUpdate), controllers.UpdatePatient)
+		patientGroup.PATCH("/updatePatient", auth.GinPermissionMiddleware(auth.PermPatientUpdate), controllers.UpdatePatient)
+		patientGroup.DELETE("/deletePatient", auth.GinPermissionMiddleware(auth.PermPatientDelete), controllers.DeletePatient)
+		patientGroup.POST("/restorePatient", auth.GinPermissionMiddleware(auth.PermPatientRestore), controllers.RestorePatient)
 	}
 
 	diseaseGroup := router.Group("/api/diseases")
 	{
-		diseaseGroup.GET("/getDiseases", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDiseases)
-		diseaseGroup.GET("/getDisease", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDisease)
-		diseaseGroup.POST("/createDisease", auth.GinAuthMiddleware("admin", "doctor"), controllers.CreateDisease)
-		diseaseGroup.PUT("/updateDisease", auth.GinAuthMiddleware("admin", "doctor"), controllers.UpdateDisease)
-		diseaseGroup.DELETE("/deleteDisease", auth.GinAuthMiddleware("admin", "doctor"), controllers.DeleteDisease)
+		diseaseGroup.GET("/getDiseases", auth.GinPermissionMiddleware(auth.PermDiseaseRead), controllers.GetDiseases)
+		diseaseGroup.GET("/getDisease", auth.GinPermissionMiddleware(auth.PermDiseaseRead), controllers.GetDisease)
+		diseaseGroup.POST("/createDisease", auth.GinPermissionMiddleware(auth.PermDiseaseCreate), controllers.IdempotencyMiddleware(), controllers.CreateDisease)
+		diseaseGroup.PUT("/updateDisease", auth.GinPermissionMiddleware(auth.PermDiseaseUpdate), controllers.UpdateDisease)
+		diseaseGroup.PATCH("/updateDisease", auth.GinPermissionMiddleware(auth.PermDiseaseUpdate), controllers.UpdateDisease)
+		diseaseGroup.DELETE("/deleteDisease", auth.GinPermissionMiddleware(auth.PermDiseaseDelete), controllers.DeleteDisease)
+		diseaseGroup.POST("/restoreDisease", auth.GinPermissionMiddleware(auth.PermDiseaseRestore), controllers.RestoreDisease)
 	}
 
 	doctorGroup := router.Group("/api/doctors")
 	{
-		doctorGroup.GET("/getDoctors", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDoctors)
-		doctorGroup.GET("/getDoctor", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDoctor)
-		doctorGroup.POST("/createDoctor", auth.GinAuthMiddleware("admin"), controllers.CreateDoctor)
-		doctorGroup.PUT("/updateDoctor", auth.GinAuthMiddleware("admin"), controllers.UpdateDoctor)
-		doctorGroup.DELETE("/deleteDoctor", auth.GinAuthMiddleware("admin"), controllers.DeleteDoctor)
+		doctorGroup.GET("/getDoctors", auth.GinPermissionMiddleware(auth.PermDoctorRead), controllers.GetDoctors)
+		doctorGroup.GET("/getDoctor", auth.GinPermissionMiddleware(auth.PermDoctorRead), controllers.GetDoctor)
+		doctorGroup.GET("/getDoctorSlots", auth.GinPermissionMiddleware(auth.PermDoctorRead), controllers.GetDoctorSlots)
+		doctorGroup.POST("/createDoctor", auth.GinPermissionMiddleware(auth.PermDoctorCreate), controllers.IdempotencyMiddleware(), controllers.CreateDoctor)
+		doctorGroup.PUT("/updateDoctor", auth.GinPermissionMiddleware(auth.PermDoctorUpdate), controllers.UpdateDoctor)
+		doctorGroup.PATCH("/updateDoctor", auth.GinPermissionMiddleware(auth.PermDoctorUpdate), controllers.UpdateDoctor)
+		doctorGroup.DELETE("/deleteDoctor", auth.GinPermissionMiddleware(auth.PermDoctorDelete), controllers.DeleteDoctor)
+		doctorGroup.POST("/restoreDoctor", auth.GinPermissionMiddleware(auth.PermDoctorRestore), controllers.RestoreDoctor)
 	}
 
 	departmentGroup := router.Group("/api/departments")
 	{
-		departmentGroup.GET("/getDepartments", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDepartments)
-		departmentGroup.GET("/getDepartment", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetDepartment)
-		departmentGroup.POST("/createDepartment", auth.GinAuthMiddleware("admin"), controllers.CreateDepartment)
-		departmentGroup.PUT("/updateDepartment", auth.GinAuthMiddleware("admin"), controllers.UpdateDepartment)
-		departmentGroup.DELETE("/deleteDepartment", auth.GinAuthMiddleware("admin"), controllers.DeleteDepartment)
+		departmentGroup.GET("/getDepartments", auth.GinPermissionMiddleware(auth.PermDepartmentRead), controllers.GetDepartments)
+		departmentGroup.GET("/getDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentRead), controllers.GetDepartment)
+		departmentGroup.POST("/createDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentCreate), controllers.IdempotencyMiddleware(), controllers.CreateDepartment)
+		departmentGroup.PUT("/updateDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentUpdate), controllers.UpdateDepartment)
+		departmentGroup.PATCH("/updateDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentUpdate), controllers.UpdateDepartment)
+		departmentGroup.DELETE("/deleteDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentDelete), controllers.DeleteDepartment)
+		departmentGroup.POST("/restoreDepartment", auth.GinPermissionMiddleware(auth.PermDepartmentRestore), controllers.RestoreDepartment)
 	}
 
 	registrationGroup := router.Group("/api/registrations")
 	{
-		registrationGroup.GET("/getRegistrations", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetRegistrations)
-		registrationGroup.GET("/getRegistration", auth.GinAuthMiddleware("admin", "doctor", "patient"), controllers.GetRegistration)
-		registrationGroup.POST("/createRegistration", auth.GinAuthMiddleware("admin", "patient"), controllers.CreateRegistration)
-		registrationGroup.PUT("/updateRegistration", auth.GinAuthMiddleware("admin", "doctor"), controllers.UpdateRegistration)
-		registrationGroup.DELETE("/deleteRegistration", auth.GinAuthMiddleware("admin"), controllers.DeleteRegistration)
+		registrationGroup.GET("/getRegistrations", auth.GinPermissionMiddleware(auth.PermRegistrationRead), controllers.GetRegistrations)
+		registrationGroup.GET("/getRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationRead), controllers.GetRegistration)
+		registrationGroup.POST("/createRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationCreate), controllers.IdempotencyMiddleware(), controllers.CreateRegistration)
+		registrationGroup.PUT("/updateRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationUpdate, auth.PermRegistrationUpdateStatus), controllers.UpdateRegistration)
+		registrationGroup.PATCH("/updateRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationUpdate, auth.PermRegistrationUpdateStatus), controllers.UpdateRegistration)
+		registrationGroup.POST("/checkIn", auth.GinPermissionMiddleware(auth.PermRegistrationCheckIn), controllers.CheckInRegistration)
+		registrationGroup.POST("/markNoShow", auth.GinPermissionMiddleware(auth.PermRegistrationMarkNoShow), controllers.MarkRegistrationNoShow)
+		registrationGroup.POST("/changeStatus", auth.GinPermissionMiddleware(auth.PermRegistrationUpdate, auth.PermRegistrationUpdateStatus, auth.PermRegistrationCheckIn, auth.PermRegistrationMarkNoShow, auth.PermRegistrationCancel), controllers.ChangeRegistrationStatus)
+		registrationGroup.DELETE("/deleteRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationDelete), controllers.DeleteRegistration)
+		registrationGroup.POST("/restoreRegistration", auth.GinPermissionMiddleware(auth.PermRegistrationRestore), controllers.RestoreRegistration)
 	}
 
+	// 全文检索，结果按调用者能看的类型过滤
+	router.GET("/api/search", auth.GinPermissionMiddleware(auth.PermPatientRead, auth.PermDoctorRead, auth.PermDiseaseRead), controllers.Search)
+
+	router.GET("/.well-known/jwks.json", controllers.GetJWKS)
+
 	authGroup := router.Group("/api/auth")
 	{
-		authGroup.POST("/login", controllers.LoginOrRegister)
+		authGroup.GET("/setup", controllers.GetSetupStatus)
+		authGroup.POST("/setup", controllers.Setup)
+		authGroup.POST("/register", controllers.Register)
+		authGroup.POST("/login", controllers.Login)
+		authGroup.POST("/refresh", controllers.RefreshToken)
+		authGroup.POST("/login/mfa", controllers.LoginMFA)
+		authGroup.POST("/login/mfa/enroll", controllers.LoginMFAEnroll)
+		authGroup.POST("/login/mfa/activate", controllers.LoginMFAActivate)
+		authGroup.POST("/logout", auth.GinAuthMiddleware(), controllers.Logout)
+		authGroup.GET("/jwks", controllers.GetJWKS)
 		authGroup.GET("/me", auth.GinAuthMiddleware(), controllers.GetMe)
-		authGroup.POST("/assignDoctorAccount", auth.GinAuthMiddleware("admin"), controllers.AssignDoctorAccount)
-		authGroup.POST("/upsertMyPatientProfile", auth.GinAuthMiddleware("patient"), controllers.UpsertMyPatientProfile)
+		authGroup.POST("/changePassword", auth.GinAuthMiddleware(), controllers.ChangePassword)
+		authGroup.POST("/mfa/enroll", auth.GinAuthMiddleware(), controllers.EnrollMFA)
+		authGroup.POST("/mfa/activate", auth.GinAuthMiddleware(), controllers.ActivateMFA)
+		authGroup.POST("/mfa/disable", auth.GinAuthMiddleware(), controllers.DisableMFA)
+		authGroup.POST("/mfa/recoveryCodes", auth.GinAuthMiddleware(), controllers.RegenerateRecoveryCodes)
+		authGroup.POST("/resetPassword", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.ResetPassword)
+		authGroup.POST("/disableAccount", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.DisableAccount)
+		authGroup.POST("/enableAccount", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.EnableAccount)
+		authGroup.POST("/resetMfa", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.ResetMFA)
+		authGroup.POST("/issueMfaEnrollmentCode", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.IssueMFAEnrollmentCode)
+		authGroup.POST("/unlockAccount", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.UnlockAccount)
+		authGroup.POST("/createStaffAccount", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.CreateStaffAccount)
+		authGroup.POST("/assignDoctorAccount", auth.GinPermissionMiddleware(auth.PermAccountManage), controllers.AssignDoctorAccount)
+		authGroup.POST("/upsertMyPatientProfile", auth.GinPermissionMiddleware(auth.PermPatientUpdate), controllers.UpsertMyPatientProfile)
+		authGroup.PATCH("/upsertMyPatientProfile", auth.GinPermissionMiddleware(auth.PermPatientUpdate), controllers.UpsertMyPatientProfile)
+	}
+
+	auditGroup := router.Group("/api/audit")
+	{
+		auditGroup.GET("/getAuditLogs", auth.GinPermissionMiddleware(auth.PermAuditRead), controllers.GetAuditLogs)
 	}
 }
 
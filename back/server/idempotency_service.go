@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hospital-system/models"
+	"hospital-system/storage"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyTTL 同一个 Idempotency-Key 的结果保留多久，可用 IDEMPOTENCY_KEY_TTL 调整
+const DefaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyPurgeInterval 多久整体清理一次过期记录。查到的记录过期时当场删除，不用等整体清理
+const idempotencyPurgeInterval = time.Hour
+
+var (
+	ErrIdempotencyKeyReused  = errors.New("idempotency key reused with a different request")
+	ErrIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+)
+
+// IdempotencyTTLFromEnv 读取 IDEMPOTENCY_KEY_TTL，格式同 time.ParseDuration，例如 "12h"
+func IdempotencyTTLFromEnv() (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv("IDEMPOTENCY_KEY_TTL"))
+	if v == "" {
+		return DefaultIdempotencyTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return 0, errors.New("invalid IDEMPOTENCY_KEY_TTL: " + v)
+	}
+	return ttl, nil
+}
+
+// IdempotencyScope 同一个 key 只在同一账号、同一接口下生效，不同账号用了相同的 key 互不影响
+type IdempotencyScope struct {
+	AccountID string
+	Method    string
+	Path      string
+	Key       string
+}
+
+func (s IdempotencyScope) id() string {
+	sum := sha256.Sum256([]byte(s.AccountID + "\n" + s.Method + "\n" + s.Path + "\n" + s.Key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IdempotencyService 保存带 Idempotency-Key 的写请求的结果，重试时回放第一次的响应
+type IdempotencyService struct {
+	store     storage.Store
+	cache     *indexedCache[models.IdempotencyRecord]
+	ttl       time.Duration
+	inflight  map[string]bool
+	lastPurge time.Time
+	mu        sync.Mutex
+}
+
+func InitIdempotencyService(c *IdempotencyService, store storage.Store, ttl time.Duration) *IdempotencyService {
+	if c == nil || c.store == nil {
+		if ttl <= 0 {
+			ttl = DefaultIdempotencyTTL
+		}
+		return &IdempotencyService{
+			store:    store,
+			cache:    newIndexedCache(store, storage.CollectionIdempotency, func(r *models.IdempotencyRecord) string { return r.ID }),
+			ttl:      ttl,
+			inflight: map[string]bool{},
+		}
+	}
+	return c
+}
+
+// Begin 请求执行前调用：已有结果时返回记录供回放；同一个 key 换了请求体、或者第一次请求还没结束时返回错误。
+// 返回 nil, nil 表示可以执行，执行完必须调用 Complete 或 Abort
+func (s *IdempotencyService) Begin(ctx context.Context, scope IdempotencyScope, requestHash string) (*models.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPurge) >= idempotencyPurgeInterval {
+		if err := s.purgeExpired(ctx, now); err != nil {
+			return nil, err
+		}
+		s.lastPurge = now
+	}
+	id := scope.id()
+	record, ok, err := s.cache.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if ok && !record.ExpiresAt.After(now) {
+		if err := s.store.Delete(ctx, storage.CollectionIdempotency, id); err != nil {
+			return nil, err
+		}
+		s.cache.invalidate()
+		ok = false
+	}
+	if ok {
+		if record.RequestHash != requestHash {
+			return nil, ErrIdempotencyKeyReused
+		}
+		return record, nil
+	}
+	if s.inflight[id] {
+		return nil, ErrIdempotencyInProgress
+	}
+	s.inflight[id] = true
+	return nil, nil
+}
+
+// Complete 保存第一次执行的结果。5xx、409、429 不保存，客户端重试时会重新执行
+func (s *IdempotencyService) Complete(ctx context.Context, scope IdempotencyScope, requestHash string, status int, contentType string, etag string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := scope.id()
+	delete(s.inflight, id)
+	if !replayableStatus(status) {
+		return nil
+	}
+	now := time.Now()
+	record := models.IdempotencyRecord{
+		ID:          id,
+		AccountID:   scope.AccountID,
+		Method:      scope.Method,
+		Path:        scope.Path,
+		Key:         scope.Key,
+		RequestHash: requestHash,
+		StatusCode:  status,
+		ContentType: contentType,
+		ETag:        etag,
+		Body:        string(body),
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.ttl),
+	}
+	if err := storage.Save(ctx, s.store, storage.CollectionIdempotency, record.ID, &record); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
+
+// Abort 请求没有正常结束（例如 panic），放开这个 key 允许重试
+func (s *IdempotencyService) Abort(scope IdempotencyScope) {
+	s.mu.Lock()
+	delete(s.inflight, scope.id())
+	s.mu.Unlock()
+}
+
+// purgeExpired 清理过了窗口期的记录，之后同一个 key 会被当作新请求。要扫描全部记录，由 Begin 按 idempotencyPurgeInterval 调用
+func (s *IdempotencyService) purgeExpired(ctx context.Context, now time.Time) error {
+	records, err := s.cache.all(ctx)
+	if err != nil {
+		return err
+	}
+	purged := false
+	for _, r := range records {
+		if r.ExpiresAt.After(now) {
+			continue
+		}
+		if err := s.store.Delete(ctx, storage.CollectionIdempotency, r.ID); err != nil {
+			return err
+		}
+		purged = true
+	}
+	if purged {
+		s.cache.invalidate()
+	}
+	return nil
+}
+
+// replayableStatus 哪些响应值得保存下来回放。5xx、409（冲突，比如号满了）和 429（限流）都可能是暂时的，
+// 重试时应该重新处理而不是一直拿到同一个失败
+func replayableStatus(status int) bool {
+	return status < 500 && status != http.StatusConflict && status != http.StatusTooManyRequests
+}
@@ -0,0 +1,566 @@
+package integrity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hospital-system/models"
+	"hospital-system/resource"
+	services "hospital-system/server"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	EntityPatient    = "patient"
+	EntityDoctor     = "doctor"
+	EntityDepartment = "department"
+	EntityDisease    = "disease"
+)
+
+// Policy 删除时遇到依赖记录的处理方式
+type Policy string
+
+const (
+	// PolicyRestrict 存在依赖记录时拒绝删除，并列出阻塞的记录。挂号只有还占着时间的（待就诊、已签到等）算依赖，
+	// 已完成、已取消、爽约的挂号是历史记录，保留原样继续指向被软删除的档案
+	PolicyRestrict Policy = "restrict"
+	// PolicyCascade 级联处理依赖记录：软删除其挂号、解除账号关联、从医生病种列表中移除
+	PolicyCascade Policy = "cascade"
+)
+
+// DefaultPolicies 各实体默认的删除策略，可用环境变量 DELETE_POLICY_<ENTITY> 覆盖，
+// 例如 DELETE_POLICY_PATIENT=cascade。科室被医生按名称引用，无法自动级联，始终按 restrict 处理
+var DefaultPolicies = map[string]Policy{
+	EntityPatient:    PolicyRestrict,
+	EntityDoctor:     PolicyRestrict,
+	EntityDepartment: PolicyRestrict,
+	EntityDisease:    PolicyCascade,
+}
+
+func PolicyFor(entity string) Policy {
+	if v := strings.ToLower(strings.TrimSpace(os.Getenv("DELETE_POLICY_" + strings.ToUpper(entity)))); v != "" {
+		switch Policy(v) {
+		case PolicyRestrict, PolicyCascade:
+			return Policy(v)
+		}
+	}
+	if p, ok := DefaultPolicies[entity]; ok {
+		return p
+	}
+	return PolicyRestrict
+}
+
+// Dependent 引用了待删除记录的一条记录
+type Dependent struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// BlockedError 删除被依赖记录阻止
+type BlockedError struct {
+	Entity     string      `json:"entity"`
+	ID         string      `json:"id"`
+	Dependents []Dependent `json:"dependents"`
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("%s %s is still referenced by %d record(s)", e.Entity, e.ID, len(e.Dependents))
+}
+
+// Change 级联处理时改动的一条记录，调用方以当前操作人的身份为每条写审计日志。
+// Before/After 为 nil 分别表示恢复和删除
+type Change struct {
+	EntityType string
+	EntityID   string
+	Action     string
+	Before     interface{}
+	After      interface{}
+}
+
+// mu 让删除前的依赖检查和删除成为一个整体：删除和恢复持有写锁，
+// 写入引用其他档案的记录时通过 LockReferences 持有读锁，检查之后不会再出现新的引用
+var mu sync.RWMutex
+
+// LockReferences 新建或修改挂号、医生、医生账号前调用，从检查被引用的档案存在到写入完成期间持有，返回解锁函数
+func LockReferences() func() {
+	mu.RLock()
+	return mu.RUnlock
+}
+
+// DeletePatient 返回级联处理改动的记录
+func DeletePatient(ctx context.Context, id string, actor string) ([]Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := resource.PatientService.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+	registrations, err := resource.RegistrationService.GetByPatientID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := resource.AccountService.GetByLinkedID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if PolicyFor(EntityPatient) == PolicyRestrict {
+		dependents := registrationDependents(registrations)
+		dependents = append(dependents, accountDependents(accounts, "patient")...)
+		if len(dependents) > 0 {
+			return nil, &BlockedError{Entity: EntityPatient, ID: id, Dependents: dependents}
+		}
+		// restrict 不动依赖记录，历史挂号原样保留
+		registrations = nil
+	}
+
+	cascade, changes, err := cascadeDelete(ctx, id, registrations, accounts, "patient", actor)
+	if err != nil {
+		return nil, err
+	}
+	if err := resource.PatientService.Delete(ctx, id, actor, cascade); err != nil {
+		rollbackCascade(ctx, cascade, id)
+		return nil, err
+	}
+	return changes, nil
+}
+
+// DeleteDoctor 返回级联处理改动的记录
+func DeleteDoctor(ctx context.Context, id string, actor string) ([]Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := resource.DoctorService.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+	registrations, err := resource.RegistrationService.GetByDoctorID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := resource.AccountService.GetByLinkedID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if PolicyFor(EntityDoctor) == PolicyRestrict {
+		dependents := registrationDependents(registrations)
+		dependents = append(dependents, accountDependents(accounts, "doctor")...)
+		if len(dependents) > 0 {
+			return nil, &BlockedError{Entity: EntityDoctor, ID: id, Dependents: dependents}
+		}
+		// restrict 不动依赖记录，历史挂号原样保留
+		registrations = nil
+	}
+
+	cascade, changes, err := cascadeDelete(ctx, id, registrations, accounts, "doctor", actor)
+	if err != nil {
+		return nil, err
+	}
+	if err := resource.DoctorService.Delete(ctx, id, actor, cascade); err != nil {
+		rollbackCascade(ctx, cascade, id)
+		return nil, err
+	}
+	return changes, nil
+}
+
+func DeleteDepartment(ctx context.Context, id string, actor string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	department, err := resource.DepartmentService.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	doctors, err := resource.DoctorService.GetByDepartment(ctx, department.Name)
+	if err != nil {
+		return err
+	}
+	registrations, err := resource.RegistrationService.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	dependents := make([]Dependent, 0)
+	for _, d := range doctors {
+		dependents = append(dependents, Dependent{Type: EntityDoctor, ID: d.ID, Detail: d.Name})
+	}
+	for _, r := range registrations {
+		if !services.IsActiveBooking(r.Status) {
+			continue
+		}
+		for _, name := range r.Departments {
+			if name == department.Name {
+				dependents = append(dependents, Dependent{Type: "registration", ID: r.ID, Detail: r.Status})
+				break
+			}
+		}
+	}
+	if len(dependents) > 0 {
+		return &BlockedError{Entity: EntityDepartment, ID: id, Dependents: dependents}
+	}
+	return resource.DepartmentService.Delete(ctx, id, actor)
+}
+
+// UpdateDepartment 医生按名称引用科室，科室下还有医生时不能改名，否则这些医生会指向不存在的科室
+func UpdateDepartment(ctx context.Context, id string, updated *models.Department, expectedVersion int64) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	current, err := resource.DepartmentService.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if updated.Name != current.Name {
+		doctors, err := resource.DoctorService.GetByDepartment(ctx, current.Name)
+		if err != nil {
+			return err
+		}
+		if len(doctors) > 0 {
+			dependents := make([]Dependent, 0, len(doctors))
+			for _, d := range doctors {
+				dependents = append(dependents, Dependent{Type: EntityDoctor, ID: d.ID, Detail: d.Name})
+			}
+			return &BlockedError{Entity: EntityDepartment, ID: id, Dependents: dependents}
+		}
+	}
+	return resource.DepartmentService.Update(ctx, id, updated, expectedVersion)
+}
+
+// DeleteDisease 返回级联处理改动的记录
+func DeleteDisease(ctx context.Context, id string, actor string) ([]Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, err := resource.DiseaseService.GetByID(ctx, id); err != nil {
+		return nil, err
+	}
+	doctors, err := resource.DoctorService.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	referencing := make([]models.Doctor, 0)
+	dependents := make([]Dependent, 0)
+	blocking := make([]Dependent, 0)
+	for _, d := range doctors {
+		if !containsString(d.Diseases, id) {
+			continue
+		}
+		referencing = append(referencing, d)
+		dependents = append(dependents, Dependent{Type: EntityDoctor, ID: d.ID, Detail: d.Name})
+		// 医生至少要管理一个病种，只剩这一个时无法级联移除
+		if len(d.Diseases) == 1 {
+			blocking = append(blocking, Dependent{Type: EntityDoctor, ID: d.ID, Detail: d.Name + " manages no other disease"})
+		}
+	}
+
+	if PolicyFor(EntityDisease) == PolicyRestrict && len(dependents) > 0 {
+		return nil, &BlockedError{Entity: EntityDisease, ID: id, Dependents: dependents}
+	}
+	if len(blocking) > 0 {
+		return nil, &BlockedError{Entity: EntityDisease, ID: id, Dependents: blocking}
+	}
+
+	var cascade *models.DeleteCascade
+	changes := make([]Change, 0, len(referencing))
+	for i := range referencing {
+		before := referencing[i]
+		doctor := before
+		kept := make([]string, 0, len(doctor.Diseases))
+		for _, diseaseID := range doctor.Diseases {
+			if diseaseID != id {
+				kept = append(kept, diseaseID)
+			}
+		}
+		doctor.Diseases = kept
+		if err := resource.DoctorService.Update(ctx, doctor.ID, &doctor, services.AnyVersion); err != nil {
+			rollbackDoctorChanges(ctx, changes)
+			return nil, err
+		}
+		changes = append(changes, Change{EntityType: EntityDoctor, EntityID: doctor.ID, Action: services.AuditActionUpdate, Before: before, After: doctor})
+		if cascade == nil {
+			cascade = &models.DeleteCascade{}
+		}
+		cascade.Doctors = append(cascade.Doctors, doctor.ID)
+	}
+	if err := resource.DiseaseService.Delete(ctx, id, actor, cascade); err != nil {
+		rollbackDoctorChanges(ctx, changes)
+		return nil, err
+	}
+	return changes, nil
+}
+
+func DeleteRegistration(ctx context.Context, id string, actor string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return resource.RegistrationService.Delete(ctx, id, actor)
+}
+
+// 恢复操作同样要保证引用完整：恢复的记录所引用的记录必须仍然存在。
+// 级联删除过的患者、医生、病种，恢复时一并撤销级联处理
+
+// RestorePatient 返回撤销级联处理时改动的记录
+func RestorePatient(ctx context.Context, id string) (*models.Patient, []Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	deleted, err := resource.PatientService.GetByIDIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	patient, err := resource.PatientService.Restore(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := undoCascade(ctx, deleted.DeleteCascade, id)
+	return patient, changes, err
+}
+
+// RestoreDoctor 返回撤销级联处理时改动的记录
+func RestoreDoctor(ctx context.Context, id string) (*models.Doctor, []Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	doctor, err := resource.DoctorService.GetByIDIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	dependents := make([]Dependent, 0)
+	if _, err := resource.DepartmentService.GetByName(ctx, doctor.Department); err != nil {
+		dependents = append(dependents, Dependent{Type: EntityDepartment, Detail: doctor.Department + " not found"})
+	}
+	for _, diseaseID := range doctor.Diseases {
+		if _, err := resource.DiseaseService.GetByID(ctx, diseaseID); err != nil {
+			dependents = append(dependents, Dependent{Type: EntityDisease, ID: diseaseID, Detail: "not found"})
+		}
+	}
+	if len(dependents) > 0 {
+		return nil, nil, &MissingReferenceError{Entity: EntityDoctor, ID: id, References: dependents}
+	}
+	restored, err := resource.DoctorService.Restore(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := undoCascade(ctx, doctor.DeleteCascade, id)
+	return restored, changes, err
+}
+
+func RestoreDepartment(ctx context.Context, id string) (*models.Department, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return resource.DepartmentService.Restore(ctx, id)
+}
+
+// RestoreDisease 返回撤销级联处理时改动的记录
+func RestoreDisease(ctx context.Context, id string) (*models.Disease, []Change, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	deleted, err := resource.DiseaseService.GetByIDIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	disease, err := resource.DiseaseService.Restore(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes := make([]Change, 0)
+	if deleted.DeleteCascade == nil {
+		return disease, changes, nil
+	}
+	// 放回被移除了该病种的医生名下；医生已删除、已重新添加或病种已满 3 个时保持现状
+	for _, doctorID := range deleted.DeleteCascade.Doctors {
+		doctor, err := resource.DoctorService.GetByID(ctx, doctorID)
+		if err != nil || containsString(doctor.Diseases, id) {
+			continue
+		}
+		if len(doctor.Diseases) >= 3 {
+			log.Printf("医生 %s 的病种已满，未放回病种 %s", doctorID, id)
+			continue
+		}
+		before := *doctor
+		doctor.Diseases = append(append([]string{}, doctor.Diseases...), id)
+		if err := resource.DoctorService.Update(ctx, doctor.ID, doctor, services.AnyVersion); err != nil {
+			return disease, changes, err
+		}
+		changes = append(changes, Change{EntityType: EntityDoctor, EntityID: doctor.ID, Action: services.AuditActionUpdate, Before: before, After: *doctor})
+	}
+	return disease, changes, nil
+}
+
+func RestoreRegistration(ctx context.Context, id string) (*models.Registration, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registration, err := resource.RegistrationService.GetByIDIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	dependents := make([]Dependent, 0)
+	if _, err := resource.PatientService.GetByID(ctx, registration.PatientID); err != nil {
+		dependents = append(dependents, Dependent{Type: EntityPatient, ID: registration.PatientID, Detail: "not found"})
+	}
+	doctor, err := resource.DoctorService.GetByID(ctx, registration.DoctorID)
+	if err != nil {
+		dependents = append(dependents, Dependent{Type: EntityDoctor, ID: registration.DoctorID, Detail: "not found"})
+	}
+	if len(dependents) > 0 {
+		return nil, &MissingReferenceError{Entity: "registration", ID: id, References: dependents}
+	}
+	return resource.RegistrationService.Restore(ctx, id, doctor)
+}
+
+// MissingReferenceError 恢复的记录引用了已不存在的记录
+type MissingReferenceError struct {
+	Entity     string      `json:"entity"`
+	ID         string      `json:"id"`
+	References []Dependent `json:"references"`
+}
+
+func (e *MissingReferenceError) Error() string {
+	return fmt.Sprintf("%s %s references %d missing record(s)", e.Entity, e.ID, len(e.References))
+}
+
+// registrationDependents 只列出还占着时间的挂号，历史挂号不阻止删除
+func registrationDependents(registrations []models.Registration) []Dependent {
+	dependents := make([]Dependent, 0, len(registrations))
+	for _, r := range registrations {
+		if !services.IsActiveBooking(r.Status) {
+			continue
+		}
+		dependents = append(dependents, Dependent{
+			Type:   "registration",
+			ID:     r.ID,
+			Detail: r.VisitDate.Local().Format("2006-01-02") + " " + r.TimeSlot + " " + r.Status,
+		})
+	}
+	return dependents
+}
+
+func accountDependents(accounts []models.Account, role string) []Dependent {
+	dependents := make([]Dependent, 0, len(accounts))
+	for _, a := range accounts {
+		if a.Role == role {
+			dependents = append(dependents, Dependent{Type: "account", ID: a.ID, Detail: a.Username})
+		}
+	}
+	return dependents
+}
+
+// cascadeDelete 软删除档案的挂号、解除账号关联，返回处理过的记录（记在档案上供恢复时撤销）和改动。
+// 中途失败时撤销已经做过的部分，档案和依赖记录保持删除前的样子
+func cascadeDelete(ctx context.Context, linkedID string, registrations []models.Registration, accounts []models.Account, role string, actor string) (*models.DeleteCascade, []Change, error) {
+	cascade := &models.DeleteCascade{}
+	changes := make([]Change, 0)
+	for _, r := range registrations {
+		if err := resource.RegistrationService.Delete(ctx, r.ID, actor); err != nil {
+			rollbackCascade(ctx, cascade, linkedID)
+			return nil, nil, err
+		}
+		cascade.Registrations = append(cascade.Registrations, r.ID)
+		changes = append(changes, Change{EntityType: "registration", EntityID: r.ID, Action: services.AuditActionDelete, Before: r})
+	}
+	for _, a := range accounts {
+		if a.Role != role {
+			continue
+		}
+		account, err := resource.AccountService.ClearLinkedID(ctx, a.ID)
+		if err != nil {
+			rollbackCascade(ctx, cascade, linkedID)
+			return nil, nil, err
+		}
+		cascade.Accounts = append(cascade.Accounts, a.ID)
+		changes = append(changes, Change{EntityType: "account", EntityID: a.ID, Action: services.AuditActionUpdate, Before: a, After: *account})
+	}
+	if len(cascade.Registrations) == 0 && len(cascade.Accounts) == 0 {
+		return nil, changes, nil
+	}
+	return cascade, changes, nil
+}
+
+// undoCascade 档案恢复后撤销级联删除：恢复一并删除的挂号，重新关联解除关联的账号。
+// 期间已单独恢复的挂号、引用的另一方已删除或已与其他挂号冲突的挂号、已关联到别的档案或已删除的账号保持现状
+func undoCascade(ctx context.Context, cascade *models.DeleteCascade, linkedID string) ([]Change, error) {
+	changes := make([]Change, 0)
+	if cascade == nil {
+		return changes, nil
+	}
+	for _, registrationID := range cascade.Registrations {
+		registration, err := resource.RegistrationService.GetByIDIncludingDeleted(ctx, registrationID)
+		if err != nil || registration.DeletedAt == nil {
+			continue
+		}
+		if _, err := resource.PatientService.GetByID(ctx, registration.PatientID); err != nil {
+			log.Printf("挂号 %s 的患者已不存在，未恢复", registrationID)
+			continue
+		}
+		doctor, err := resource.DoctorService.GetByID(ctx, registration.DoctorID)
+		if err != nil {
+			log.Printf("挂号 %s 的医生已不存在，未恢复", registrationID)
+			continue
+		}
+		restored, err := resource.RegistrationService.Restore(ctx, registrationID, doctor)
+		if err != nil {
+			var conflict *services.BookingConflictError
+			var fullyBooked *services.FullyBookedError
+			if errors.As(err, &conflict) || errors.As(err, &fullyBooked) {
+				log.Printf("挂号 %s 未恢复: %v", registrationID, err)
+				continue
+			}
+			return changes, err
+		}
+		changes = append(changes, Change{EntityType: "registration", EntityID: registrationID, Action: services.AuditActionRestore, After: *restored})
+	}
+	for _, accountID := range cascade.Accounts {
+		before, err := resource.AccountService.GetByID(ctx, accountID)
+		if err != nil {
+			continue
+		}
+		account, err := resource.AccountService.RestoreLinkedID(ctx, accountID, linkedID)
+		if err != nil {
+			return changes, err
+		}
+		if account != nil {
+			changes = append(changes, Change{EntityType: "account", EntityID: accountID, Action: services.AuditActionUpdate, Before: *before, After: *account})
+		}
+	}
+	return changes, nil
+}
+
+// rollbackCascade 删除没能完成时撤销已经做过的级联处理。撤销本身失败只能记日志，由人工按审计日志处理
+func rollbackCascade(ctx context.Context, cascade *models.DeleteCascade, linkedID string) {
+	if cascade == nil {
+		return
+	}
+	if _, err := undoCascade(ctx, cascade, linkedID); err != nil {
+		log.Printf("撤销未完成的级联删除失败 (%s): %v", linkedID, err)
+	}
+}
+
+// rollbackDoctorChanges 病种删除没能完成时，把已经移除了该病种的医生改回去
+func rollbackDoctorChanges(ctx context.Context, changes []Change) {
+	for _, change := range changes {
+		before, ok := change.Before.(models.Doctor)
+		if !ok {
+			continue
+		}
+		if err := resource.DoctorService.Update(ctx, before.ID, &before, services.AnyVersion); err != nil {
+			log.Printf("撤销医生 %s 的病种改动失败: %v", before.ID, err)
+		}
+	}
+}
+
+func containsString(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
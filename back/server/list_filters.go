@@ -0,0 +1,142 @@
+package services
+
+import (
+	"hospital-system/models"
+	"strings"
+	"time"
+)
+
+// 各列表接口支持的过滤条件，空值表示不过滤
+
+type PatientFilter struct {
+	NamePrefix  string
+	PhonePrefix string
+}
+
+type DoctorFilter struct {
+	Department string
+	Title      string
+	Disease    string // 病种ID
+}
+
+type DiseaseFilter struct {
+	Category string
+}
+
+type RegistrationFilter struct {
+	Statuses   []string
+	DoctorID   string
+	Department string
+	VisitFrom  time.Time
+	VisitTo    time.Time
+}
+
+var PatientSortKeys = SortKeys[models.Patient]{
+	"name":      func(a, b *models.Patient) int { return compareStrings(a.Name, b.Name) },
+	"age":       func(a, b *models.Patient) int { return compareInts(a.Age, b.Age) },
+	"createdAt": func(a, b *models.Patient) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"updatedAt": func(a, b *models.Patient) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+}
+
+var DoctorSortKeys = SortKeys[models.Doctor]{
+	"name":        func(a, b *models.Doctor) int { return compareStrings(a.Name, b.Name) },
+	"department":  func(a, b *models.Doctor) int { return compareStrings(a.Department, b.Department) },
+	"title":       func(a, b *models.Doctor) int { return compareStrings(a.Title, b.Title) },
+	"fee":         func(a, b *models.Doctor) int { return compareFloats(a.Fee, b.Fee) },
+	"maxPatients": func(a, b *models.Doctor) int { return compareInts(a.MaxPatients, b.MaxPatients) },
+}
+
+var DiseaseSortKeys = SortKeys[models.Disease]{
+	"name":     func(a, b *models.Disease) int { return compareStrings(a.Name, b.Name) },
+	"category": func(a, b *models.Disease) int { return compareStrings(a.Category, b.Category) },
+}
+
+var DepartmentSortKeys = SortKeys[models.Department]{
+	"name": func(a, b *models.Department) int { return compareStrings(a.Name, b.Name) },
+}
+
+var RegistrationSortKeys = SortKeys[models.Registration]{
+	"visitDate":        func(a, b *models.Registration) int { return a.VisitDate.Compare(b.VisitDate) },
+	"registrationDate": func(a, b *models.Registration) int { return a.RegistrationDate.Compare(b.RegistrationDate) },
+	"createdAt":        func(a, b *models.Registration) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"status":           func(a, b *models.Registration) int { return compareStrings(a.Status, b.Status) },
+	"department":       func(a, b *models.Registration) int { return compareStrings(a.Department, b.Department) },
+	"doctorId":         func(a, b *models.Registration) int { return compareStrings(a.DoctorID, b.DoctorID) },
+}
+
+// filterList 原地过滤，返回保留下来的部分
+func filterList[T any](items []T, keep func(*T) bool) []T {
+	out := items[:0]
+	for i := range items {
+		if keep(&items[i]) {
+			out = append(out, items[i])
+		}
+	}
+	return out
+}
+
+func (f PatientFilter) Apply(patients []models.Patient) []models.Patient {
+	name := strings.ToLower(strings.TrimSpace(f.NamePrefix))
+	phone := strings.TrimSpace(f.PhonePrefix)
+	return filterList(patients, func(p *models.Patient) bool {
+		if name != "" && !strings.HasPrefix(strings.ToLower(p.Name), name) {
+			return false
+		}
+		if phone != "" && !strings.HasPrefix(p.Phone, phone) {
+			return false
+		}
+		return true
+	})
+}
+
+func (f DoctorFilter) Apply(doctors []models.Doctor) []models.Doctor {
+	return filterList(doctors, func(d *models.Doctor) bool {
+		if f.Department != "" && d.Department != f.Department {
+			return false
+		}
+		if f.Title != "" && d.Title != f.Title {
+			return false
+		}
+		if f.Disease != "" && !containsString(d.Diseases, f.Disease) {
+			return false
+		}
+		return true
+	})
+}
+
+func (f DiseaseFilter) Apply(diseases []models.Disease) []models.Disease {
+	return filterList(diseases, func(d *models.Disease) bool {
+		return f.Category == "" || d.Category == f.Category
+	})
+}
+
+// Apply 科室同时匹配主科室和多科室挂号里的任意一个；就诊日期区间两端都包含
+func (f RegistrationFilter) Apply(registrations []models.Registration) []models.Registration {
+	return filterList(registrations, func(r *models.Registration) bool {
+		if len(f.Statuses) > 0 && !containsString(f.Statuses, r.Status) {
+			return false
+		}
+		if f.DoctorID != "" && r.DoctorID != f.DoctorID {
+			return false
+		}
+		if f.Department != "" && r.Department != f.Department && !containsString(r.Departments, f.Department) {
+			return false
+		}
+		if !f.VisitFrom.IsZero() && r.VisitDate.Before(f.VisitFrom) {
+			return false
+		}
+		if !f.VisitTo.IsZero() && r.VisitDate.After(f.VisitTo) {
+			return false
+		}
+		return true
+	})
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
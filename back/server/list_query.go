@@ -0,0 +1,178 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// ListQuery 列表接口通用的分页和排序参数。Page 和 Cursor 二选一，都不给时返回全部
+type ListQuery struct {
+	Page     int
+	PageSize int
+	Cursor   string
+	Sort     []SortField
+}
+
+// SortField 排序字段，对应 sort=name,-visitDate 里的一项，"-" 表示倒序
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ListPage 分页结果，NextCursor 为空表示已经是最后一页
+type ListPage[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`
+	Page       int    `json:"page,omitempty"`
+	PageSize   int    `json:"pageSize"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// SortKeys 可排序的字段及其比较函数，返回值含义同 strings.Compare
+type SortKeys[T any] map[string]func(a *T, b *T) int
+
+// Paged 是否带了分页参数
+func (q ListQuery) Paged() bool {
+	return q.Page > 0 || q.PageSize > 0 || q.Cursor != ""
+}
+
+// ParseSort 解析 sort=name,-visitDate
+func ParseSort(v string) []SortField {
+	var fields []SortField
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := SortField{Field: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// Paginate 排序后取出一页。没有排序参数时保持原有顺序；相同排序值按 ID 排，保证翻页稳定。
+// 不分页时 Items 是排好序的全部记录
+func Paginate[T any](items []T, q ListQuery, keys SortKeys[T], idFn func(*T) string) (ListPage[T], error) {
+	for _, f := range q.Sort {
+		if _, ok := keys[f.Field]; !ok {
+			return ListPage[T]{}, errors.New("invalid sort field: " + f.Field)
+		}
+	}
+	if len(q.Sort) > 0 {
+		sort.SliceStable(items, func(i, j int) bool {
+			for _, f := range q.Sort {
+				c := keys[f.Field](&items[i], &items[j])
+				if f.Desc {
+					c = -c
+				}
+				if c != 0 {
+					return c < 0
+				}
+			}
+			return idFn(&items[i]) < idFn(&items[j])
+		})
+	}
+
+	page := ListPage[T]{Items: items, Total: len(items)}
+	if !q.Paged() {
+		page.PageSize = len(items)
+		return page, nil
+	}
+
+	size := q.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	page.PageSize = size
+
+	start := 0
+	if q.Cursor != "" {
+		offset, lastID, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return ListPage[T]{}, err
+		}
+		start = cursorStart(items, offset, lastID, idFn)
+	} else {
+		p := q.Page
+		if p <= 0 {
+			p = 1
+		}
+		page.Page = p
+		start = (p - 1) * size
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + size
+	if end > len(items) {
+		end = len(items)
+	}
+	page.Items = items[start:end]
+	if end < len(items) && end > start {
+		page.NextCursor = encodeCursor(end, idFn(&items[end-1]))
+	}
+	return page, nil
+}
+
+// 游标记录上一页最后一条的位置和 ID。中间有增删时按 ID 重新定位，那条记录不在了才退回位置
+func encodeCursor(offset int, lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset) + ":" + lastID))
+}
+
+func decodeCursor(cursor string) (int, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", errors.New("invalid cursor")
+	}
+	offset, lastID, found := strings.Cut(string(raw), ":")
+	n, err := strconv.Atoi(offset)
+	if !found || err != nil || n < 0 {
+		return 0, "", errors.New("invalid cursor")
+	}
+	return n, lastID, nil
+}
+
+func cursorStart[T any](items []T, offset int, lastID string, idFn func(*T) string) int {
+	for i := range items {
+		if idFn(&items[i]) == lastID {
+			return i + 1
+		}
+	}
+	return offset
+}
+
+// compareStrings / compareInts 等给各实体的 SortKeys 用
+func compareStrings(a string, b string) int {
+	return strings.Compare(a, b)
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hospital-system/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 登录防暴力破解的阈值：失败若干次后每次都要等待一段逐渐加长的时间，
+// 用户名失败次数到上限后锁定账号，IP 失败次数到上限后暂时拒绝该 IP 的登录
+const (
+	loginFailureWindow   = 15 * time.Minute
+	loginLockDuration    = 15 * time.Minute
+	loginUserDelayAfter  = 3
+	loginUserMaxFailures = 5
+	loginIPDelayAfter    = 10
+	loginIPMaxFailures   = 30
+	loginMaxDelay        = 30 * time.Second
+)
+
+// LoginThrottledError 登录过于频繁，需要等待 RetryAfter 之后再试
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %d seconds", int(e.RetryAfter.Seconds()+0.5))
+}
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard 按用户名和来源 IP 统计登录失败次数，计数只在内存里，账号锁定会落到账号上
+type LoginGuard struct {
+	accounts  *AccountService
+	attempts  map[string]*loginAttempts
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+func InitLoginGuard(c *LoginGuard, accounts *AccountService) *LoginGuard {
+	if c == nil || c.accounts == nil {
+		return &LoginGuard{
+			accounts: accounts,
+			attempts: map[string]*loginAttempts{},
+		}
+	}
+	return c
+}
+
+// Login 在 AccountService.Login 外面加上节流、失败计数和锁定
+func (g *LoginGuard) Login(ctx context.Context, username string, password string, ip string) (*models.Account, error) {
+	now := time.Now()
+	attempt, err := g.reserve(now, "user:"+normalizeUsername(username), "ip:"+strings.TrimSpace(ip))
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := g.accounts.Login(ctx, username, password)
+	if err == nil {
+		// 已启用 MFA 的账号要等第二步也通过才清计数，否则知道密码就能不断重置验证码的试错次数
+		g.release(attempt, !account.MFAEnabled)
+		return account, nil
+	}
+	if !errors.Is(err, ErrInvalidCredentials) {
+		g.release(attempt, false)
+		return nil, err
+	}
+	return nil, g.lockIfReached(ctx, attempt, username, err)
+}
+
+// VerifyMFA 登录第二步，验证码错误和密码错误一样计入失败次数
+func (g *LoginGuard) VerifyMFA(ctx context.Context, account *models.Account, code string, ip string) (*models.Account, error) {
+	now := time.Now()
+	attempt, err := g.reserve(now, "user:"+normalizeUsername(account.Username), "ip:"+strings.TrimSpace(ip))
+	if err != nil {
+		return nil, err
+	}
+
+	verified, err := g.accounts.VerifyMFA(ctx, account.ID, code)
+	if err == nil {
+		g.release(attempt, true)
+		return verified, nil
+	}
+	if !errors.Is(err, ErrInvalidMFACode) {
+		g.release(attempt, false)
+		return nil, err
+	}
+	return nil, g.lockIfReached(ctx, attempt, account.Username, err)
+}
+
+// lockIfReached 这次失败已经在 reserve 里计过数；达到上限时把账号锁定并返回 AccountLockedError，否则原样返回 err
+func (g *LoginGuard) lockIfReached(ctx context.Context, attempt *loginAttempt, username string, err error) error {
+	if attempt.userLockedUntil.IsZero() {
+		return err
+	}
+	// 用户名存在才锁账号，不存在的用户名只在内存里挡住，返回的错误一样，不暴露用户名是否存在
+	if target, lookupErr := g.accounts.GetByUsername(ctx, username); lookupErr == nil {
+		if _, lockErr := g.accounts.LockUntil(ctx, target.ID, attempt.userLockedUntil); lockErr != nil {
+			return lockErr
+		}
+	}
+	return &AccountLockedError{Until: attempt.userLockedUntil}
+}
+
+// Unlock 管理员解锁：清掉该用户名的失败计数和账号上的锁定
+func (g *LoginGuard) Unlock(ctx context.Context, account *models.Account) (*models.Account, error) {
+	g.mu.Lock()
+	delete(g.attempts, "user:"+normalizeUsername(account.Username))
+	g.mu.Unlock()
+	return g.accounts.LockUntil(ctx, account.ID, time.Time{})
+}
+
+// loginAttempt reserve 预先计入的一次尝试，结束后由 release 撤销或保留
+type loginAttempt struct {
+	userKey         string
+	ipKey           string
+	userLockedUntil time.Time // 这次尝试让用户名达到上限时的锁定截止时间
+	ipLocked        bool
+}
+
+// reserve 在同一个临界区里检查节流和锁定，并先把这次尝试当作失败计数。
+// 这样并发的请求能看到彼此，不会全部在计数之前通过检查，绕开等待和锁定
+func (g *LoginGuard) reserve(now time.Time, userKey string, ipKey string) (*loginAttempt, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range []string{userKey, ipKey} {
+		a, ok := g.attempts[key]
+		if !ok {
+			continue
+		}
+		if a.lockedUntil.After(now) {
+			if key == userKey {
+				return nil, &AccountLockedError{Until: a.lockedUntil}
+			}
+			if d := a.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+		if d := a.lastFailure.Add(loginDelay(key, a.failures)).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		return nil, &LoginThrottledError{RetryAfter: wait}
+	}
+
+	g.prune(now)
+	attempt := &loginAttempt{userKey: userKey, ipKey: ipKey}
+	for _, key := range []string{userKey, ipKey} {
+		a, ok := g.attempts[key]
+		if !ok || now.Sub(a.lastFailure) > loginFailureWindow {
+			a = &loginAttempts{}
+			g.attempts[key] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		if a.failures >= loginMaxFailures(key) {
+			a.lockedUntil = now.Add(loginLockDuration)
+			a.failures = 0
+			if key == userKey {
+				attempt.userLockedUntil = a.lockedUntil
+			} else {
+				attempt.ipLocked = true
+			}
+		}
+	}
+	return attempt, nil
+}
+
+// release 这次尝试不算失败时撤销 reserve 的计数。clearUser 为 true 表示登录成功，
+// 清掉用户名的全部计数；IP 只撤销这一次，避免用一个有效账号给整个 IP 洗白
+func (g *LoginGuard) release(attempt *loginAttempt, clearUser bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if clearUser {
+		delete(g.attempts, attempt.userKey)
+	} else {
+		undoAttempt(g.attempts[attempt.userKey], !attempt.userLockedUntil.IsZero(), loginUserMaxFailures)
+	}
+	undoAttempt(g.attempts[attempt.ipKey], attempt.ipLocked, loginIPMaxFailures)
+}
+
+func undoAttempt(a *loginAttempts, locked bool, maxFailures int) {
+	if a == nil {
+		return
+	}
+	if locked {
+		// 这次尝试触发了锁定，撤销时解除锁定并恢复到上限前一次
+		a.lockedUntil = time.Time{}
+		a.failures = maxFailures - 1
+		return
+	}
+	if a.failures > 0 {
+		a.failures--
+	}
+}
+
+func (g *LoginGuard) prune(now time.Time) {
+	if now.Sub(g.lastPrune) < time.Minute {
+		return
+	}
+	g.lastPrune = now
+	for key, a := range g.attempts {
+		if now.Sub(a.lastFailure) > loginFailureWindow && now.After(a.lockedUntil) {
+			delete(g.attempts, key)
+		}
+	}
+}
+
+// loginDelay 超过阈值后每多失败一次，等待时间翻倍，最长 loginMaxDelay
+func loginDelay(key string, failures int) time.Duration {
+	delayAfter := loginUserDelayAfter
+	if strings.HasPrefix(key, "ip:") {
+		delayAfter = loginIPDelayAfter
+	}
+	if failures < delayAfter {
+		return 0
+	}
+	shift := failures - delayAfter
+	if shift > 5 {
+		return loginMaxDelay
+	}
+	delay := time.Second << shift
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+	return delay
+}
+
+func loginMaxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return loginIPMaxFailures
+	}
+	return loginUserMaxFailures
+}
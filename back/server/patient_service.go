@@ -1,12 +1,10 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
 	"regexp"
 	"sync"
 	"time"
@@ -14,96 +12,81 @@ import (
 	"github.com/google/uuid"
 )
 
+// ErrPatientNotFound 患者不存在或已删除
+var ErrPatientNotFound = errors.New("patient not found")
+
 type PatientService struct {
-	filename string
-	mu       sync.RWMutex
+	store storage.Store
+	cache *indexedCache[models.Patient]
+	mu    sync.RWMutex
 }
 
-func InitPatientService(c *PatientService) *PatientService {
-	if c == nil || c.filename == "" {
-		return &PatientService{
-			filename: "static/patients.json",
-		}
+func InitPatientService(c *PatientService, store storage.Store) *PatientService {
+	if c == nil || c.store == nil {
+		return newPatientService(store)
 	}
 	return c
 }
 
-func (s *PatientService) readAll() ([]models.Patient, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Patient{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Patient{}, nil
-	}
-
-	var patients []models.Patient
-	if err := json.Unmarshal(data, &patients); err != nil {
-		return nil, err
+func newPatientService(store storage.Store) *PatientService {
+	return &PatientService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionPatients, func(p *models.Patient) string { return p.ID }).
+			withSoftDelete(func(p *models.Patient) bool { return p.DeletedAt != nil }),
 	}
+}
 
-	return patients, nil
+func (s *PatientService) readAll(ctx context.Context) ([]models.Patient, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *PatientService) GetAll(ctx context.Context) ([]models.Patient, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *PatientService) GetByID(ctx context.Context, id string) (*models.Patient, error) {
-	patients, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	patient, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, patient := range patients {
-		if patient.ID == id {
-			return &patient, nil
-		}
+	if !ok {
+		return nil, ErrPatientNotFound
 	}
-
-	return nil, errors.New("patient not found")
+	return patient, nil
 }
 
 func (s *PatientService) Create(ctx context.Context, patient *models.Patient) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	patients, err := s.readAll()
-	if err != nil {
-		return err
-	}
-
 	if ok, err := checkPatientValidity(patient); !ok {
 		return err
 	}
 
 	patient.ID = uuid.New().String()
+	patient.Version = 0
+	patient.DeletedAt = nil
+	patient.DeletedBy = ""
+	patient.DeleteCascade = nil
 	now := time.Now()
 	if patient.CreatedAt.IsZero() {
 		patient.CreatedAt = now
 	}
 	patient.UpdatedAt = now
 
-	patients = append(patients, *patient)
-
-	data, err := json.MarshalIndent(patients, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	return s.save(ctx, patient)
 }
 
-func (s *PatientService) Update(ctx context.Context, id string, updatedPatient *models.Patient) error {
+func (s *PatientService) Update(ctx context.Context, id string, updatedPatient *models.Patient, expectedVersion int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	patients, err := s.readAll()
+	patients, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -116,7 +99,14 @@ func (s *PatientService) Update(ctx context.Context, id string, updatedPatient *
 	found := false
 	for i, patient := range patients {
 		if patient.ID == id {
+			if err := checkVersion(expectedVersion, patient.Version); err != nil {
+				return err
+			}
 			updatedPatient.ID = id
+			updatedPatient.Version = patient.Version
+			updatedPatient.DeletedAt = nil
+			updatedPatient.DeletedBy = ""
+			updatedPatient.DeleteCascade = nil
 			now := time.Now()
 			if updatedPatient.CreatedAt.IsZero() {
 				updatedPatient.CreatedAt = patient.CreatedAt
@@ -129,39 +119,73 @@ func (s *PatientService) Update(ctx context.Context, id string, updatedPatient *
 	}
 
 	if !found {
-		return errors.New("patient not found")
+		return ErrPatientNotFound
 	}
 
-	data, err := json.MarshalIndent(patients, "", "  ")
+	return s.save(ctx, updatedPatient)
+}
+
+// Delete 软删除：记录删除时间和操作人，默认查询不再返回，可通过 Restore 恢复。cascade 为级联处理过的记录
+func (s *PatientService) Delete(ctx context.Context, id string, actor string, cascade *models.DeleteCascade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	patient, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return err
 	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	if !ok {
+		return ErrPatientNotFound
+	}
+	now := time.Now()
+	patient.DeletedAt = &now
+	patient.DeletedBy = actor
+	patient.DeleteCascade = cascade
+	return s.save(ctx, patient)
 }
 
-func (s *PatientService) Delete(ctx context.Context, id string) error {
+func (s *PatientService) Restore(ctx context.Context, id string) (*models.Patient, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	patients, err := s.readAll()
+	patient, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	var newPatients = []models.Patient{}
-	for _, patient := range patients {
-		if patient.ID != id {
-			newPatients = append(newPatients, patient)
-		}
+	if !ok {
+		return nil, ErrPatientNotFound
+	}
+	if patient.DeletedAt == nil {
+		return nil, &NotDeletedError{Entity: "patient"}
+	}
+	patient.DeletedAt = nil
+	patient.DeletedBy = ""
+	patient.DeleteCascade = nil
+	if err := s.save(ctx, patient); err != nil {
+		return nil, err
 	}
+	return patient, nil
+}
+
+func (s *PatientService) GetByIDIncludingDeleted(ctx context.Context, id string) (*models.Patient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	data, err := json.MarshalIndent(newPatients, "", "  ")
+	patient, ok, err := s.cache.getIncludingDeleted(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrPatientNotFound
 	}
+	return patient, nil
+}
 
-	return os.WriteFile(s.filename, data, 0644)
+// GetAllIncludingDeleted 包含已软删除的记录，仅供管理员查看
+func (s *PatientService) GetAllIncludingDeleted(ctx context.Context) ([]models.Patient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.allIncludingDeleted(ctx)
 }
 
 func checkPatientValidity(patient *models.Patient) (ok bool, err error) {
@@ -196,3 +220,12 @@ func checkPatientValidity(patient *models.Patient) (ok bool, err error) {
 
 	return true, nil
 }
+
+func (s *PatientService) save(ctx context.Context, patient *models.Patient) error {
+	patient.Version++
+	if err := storage.Save(ctx, s.store, storage.CollectionPatients, patient.ID, patient); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
@@ -1,32 +1,67 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
+	"hospital-system/auth"
 	"hospital-system/models"
-	"os"
+	"hospital-system/storage"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// ErrRegistrationNotFound 挂号不存在或已删除
+var ErrRegistrationNotFound = errors.New("registration not found")
+
 type RegistrationService struct {
-	filename string
-	mu       sync.RWMutex
+	store  storage.Store
+	cache  *indexedCache[models.Registration]
+	policy BookingPolicy
+	mu     sync.RWMutex
 }
 
-func InitRegistrationService(c *RegistrationService) *RegistrationService {
-	if c == nil || c.filename == "" {
-		return &RegistrationService{
-			filename: "static/registrations.json",
-		}
+// FullyBookedError 医生当日号源已满
+type FullyBookedError struct {
+	DoctorID    string
+	VisitDate   string
+	MaxPatients int
+	Booked      int
+}
+
+func (e *FullyBookedError) Error() string {
+	return fmt.Sprintf("doctor is fully booked on %s (%d/%d booked, %d remaining)", e.VisitDate, e.Booked, e.MaxPatients, e.Remaining())
+}
+
+func (e *FullyBookedError) Remaining() int {
+	if e.Booked >= e.MaxPatients {
+		return 0
+	}
+	return e.MaxPatients - e.Booked
+}
+
+func InitRegistrationService(c *RegistrationService, store storage.Store) *RegistrationService {
+	if c == nil || c.store == nil {
+		return newRegistrationService(store)
 	}
 	return c
 }
 
+func newRegistrationService(store storage.Store) *RegistrationService {
+	return &RegistrationService{
+		store: store,
+		cache: newIndexedCache(store, storage.CollectionRegistrations, func(r *models.Registration) string { return r.ID }).
+			withIndex("doctorId", func(r *models.Registration) string { return r.DoctorID }).
+			withIndex("patientId", func(r *models.Registration) string { return r.PatientID }).
+			withIndex("visitDate", func(r *models.Registration) string { return visitDay(r.VisitDate) }).
+			withNormalize(normalizeDepartments).
+			withSoftDelete(func(r *models.Registration) bool { return r.DeletedAt != nil }),
+	}
+}
+
 func normalizeDepartments(r *models.Registration) {
 	if r == nil {
 		return
@@ -39,60 +74,35 @@ func normalizeDepartments(r *models.Registration) {
 	}
 }
 
-func (s *RegistrationService) readAll() ([]models.Registration, error) {
-	data, err := os.ReadFile(s.filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return []models.Registration{}, nil
-		}
-		return nil, err
-	}
-	if len(bytes.TrimSpace(data)) == 0 {
-		return []models.Registration{}, nil
-	}
-
-	var registrations []models.Registration
-	if err := json.Unmarshal(data, &registrations); err != nil {
-		return nil, err
-	}
-
-	for i := range registrations {
-		normalizeDepartments(&registrations[i])
-	}
-
-	return registrations, nil
+func (s *RegistrationService) readAll(ctx context.Context) ([]models.Registration, error) {
+	return s.cache.all(ctx)
 }
 
 func (s *RegistrationService) GetAll(ctx context.Context) ([]models.Registration, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.readAll()
+	return s.readAll(ctx)
 }
 
 func (s *RegistrationService) GetByID(ctx context.Context, id string) (*models.Registration, error) {
-	registrations, err := s.GetAll(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	registration, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-
-	for _, registration := range registrations {
-		if registration.ID == id {
-			return &registration, nil
-		}
+	if !ok {
+		return nil, ErrRegistrationNotFound
 	}
-
-	return nil, errors.New("registration not found")
+	return registration, nil
 }
 
-func (s *RegistrationService) Create(ctx context.Context, registration *models.Registration) error {
+// Create 新建挂号，actor 为操作账号ID，记在状态历史的第一条
+func (s *RegistrationService) Create(ctx context.Context, registration *models.Registration, doctor *models.Doctor, actor string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	registrations, err := s.readAll()
-	if err != nil {
-		return err
-	}
-
 	normalizeDepartments(registration)
 
 	if registration.PatientID == "" {
@@ -111,14 +121,27 @@ func (s *RegistrationService) Create(ctx context.Context, registration *models.R
 		return errors.New("timeSlot cannot be empty")
 	}
 	if registration.Status == "" {
-		registration.Status = "pending"
+		registration.Status = RegistrationPending
 	}
-	if registration.Status != "pending" && registration.Status != "confirmed" && registration.Status != "completed" && registration.Status != "cancelled" {
-		return errors.New("invalid status")
+	if !IsValidInitialRegistrationStatus(registration.Status) {
+		return ErrInvalidInitialStatus
+	}
+	// 在写锁内检查冲突和统计号源，避免两个请求同时抢到同一个时间或最后一个号
+	if err := s.checkPatientBookings(ctx, "", registration); err != nil {
+		return err
+	}
+	if err := s.checkDoctorCapacity(ctx, "", registration, doctor); err != nil {
+		return err
 	}
 
 	registration.ID = uuid.New().String()
+	registration.Version = 0
+	registration.DeletedAt = nil
+	registration.DeletedBy = ""
+	registration.CheckedInAt = nil
+	registration.CancelReason = ""
 	now := time.Now()
+	registration.StatusHistory = []models.RegistrationStatusChange{{To: registration.Status, ChangedBy: actor, ChangedAt: now}}
 	if registration.RegistrationDate.IsZero() {
 		registration.RegistrationDate = now
 	}
@@ -126,21 +149,16 @@ func (s *RegistrationService) Create(ctx context.Context, registration *models.R
 		registration.CreatedAt = now
 	}
 
-	registrations = append(registrations, *registration)
-
-	data, err := json.MarshalIndent(registrations, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(s.filename, data, 0644)
+	return s.save(ctx, registration)
 }
 
-func (s *RegistrationService) Update(ctx context.Context, id string, updatedRegistration *models.Registration) error {
+// Update 修改挂号。状态变化交给状态机按 subject 的权限检查，改了医生、日期或时间段的挂号先转为已改期；
+// 取消原因取自 updatedRegistration.CancelReason，状态历史、签到时间由服务端维护
+func (s *RegistrationService) Update(ctx context.Context, id string, updatedRegistration *models.Registration, doctor *models.Doctor, subject *auth.Subject, expectedVersion int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	registrations, err := s.readAll()
+	registrations, err := s.readAll(ctx)
 	if err != nil {
 		return err
 	}
@@ -162,17 +180,38 @@ func (s *RegistrationService) Update(ctx context.Context, id string, updatedRegi
 	if updatedRegistration.TimeSlot == "" {
 		return errors.New("timeSlot cannot be empty")
 	}
-	if updatedRegistration.Status == "" {
-		updatedRegistration.Status = "pending"
-	}
-	if updatedRegistration.Status != "pending" && updatedRegistration.Status != "confirmed" && updatedRegistration.Status != "completed" && updatedRegistration.Status != "cancelled" {
-		return errors.New("invalid status")
+	if updatedRegistration.Status != "" && !IsValidRegistrationStatus(updatedRegistration.Status) {
+		return ErrInvalidRegistrationStatus
 	}
 
 	found := false
 	for i, registration := range registrations {
 		if registration.ID == id {
+			if err := checkVersion(expectedVersion, registration.Version); err != nil {
+				return err
+			}
+			if err := s.applyStatusUpdate(&registration, updatedRegistration, subject); err != nil {
+				return err
+			}
+			// 换了病人、医生、日期、时间段，或者从不占时间的状态改回来时重新检查冲突
+			if registration.PatientID != updatedRegistration.PatientID || registration.DoctorID != updatedRegistration.DoctorID ||
+				visitDay(registration.VisitDate) != visitDay(updatedRegistration.VisitDate) || registration.TimeSlot != updatedRegistration.TimeSlot ||
+				!IsActiveBooking(registration.Status) {
+				if err := s.checkPatientBookings(ctx, id, updatedRegistration); err != nil {
+					return err
+				}
+			}
+			// 换了医生或就诊日期，或者从爽约等不占号的状态改回来时重新占号，原来的号可能已经被别人挂走
+			if registration.DoctorID != updatedRegistration.DoctorID || visitDay(registration.VisitDate) != visitDay(updatedRegistration.VisitDate) ||
+				!IsActiveBooking(registration.Status) {
+				if err := s.checkDoctorCapacity(ctx, id, updatedRegistration, doctor); err != nil {
+					return err
+				}
+			}
 			updatedRegistration.ID = id
+			updatedRegistration.Version = registration.Version
+			updatedRegistration.DeletedAt = nil
+			updatedRegistration.DeletedBy = ""
 			if updatedRegistration.RegistrationDate.IsZero() {
 				updatedRegistration.RegistrationDate = registration.RegistrationDate
 			}
@@ -185,37 +224,239 @@ func (s *RegistrationService) Update(ctx context.Context, id string, updatedRegi
 		}
 	}
 	if !found {
-		return errors.New("registration not found")
+		return ErrRegistrationNotFound
 	}
 
-	data, err := json.MarshalIndent(registrations, "", "  ")
+	return s.save(ctx, updatedRegistration)
+}
+
+// ChangeStatus 只改状态，比如签到、标记爽约、医生接诊、取消。doctor 为挂号的医生，从不占号的状态回来时检查号源。
+// expectedVersion 为 AnyVersion 时不检查版本
+func (s *RegistrationService) ChangeStatus(ctx context.Context, id string, to string, reason string, doctor *models.Doctor, subject *auth.Subject, expectedVersion int64) (*models.Registration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	registration, ok, err := s.cache.get(ctx, id)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRegistrationNotFound
 	}
+	if err := checkVersion(expectedVersion, registration.Version); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := CheckRegistrationTransition(subject, registration, to, reason, now); err != nil {
+		return nil, err
+	}
+	// 爽约后补签等从不占号的状态回来时，和新建一样检查病人的其他挂号和医生的号源
+	if !IsActiveBooking(registration.Status) && IsActiveBooking(to) {
+		next := *registration
+		next.Status = to
+		if err := s.checkPatientBookings(ctx, id, &next); err != nil {
+			return nil, err
+		}
+		if err := s.checkDoctorCapacity(ctx, id, &next, doctor); err != nil {
+			return nil, err
+		}
+	}
+	applyRegistrationTransition(registration, to, reason, subject.AccountID, now)
+	if err := s.save(ctx, registration); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
 
-	return os.WriteFile(s.filename, data, 0644)
+// applyStatusUpdate 整条修改时的状态处理，在 Update 的写锁内调用。current 为库里的记录，updated 为客户端提交的内容
+func (s *RegistrationService) applyStatusUpdate(current *models.Registration, updated *models.Registration, subject *auth.Subject) error {
+	requested := strings.TrimSpace(updated.Status)
+	reason := updated.CancelReason
+
+	// 状态、历史、签到时间、取消原因都从库里的记录开始，只能通过状态机改
+	updated.Status = current.Status
+	updated.StatusHistory = append([]models.RegistrationStatusChange(nil), current.StatusHistory...)
+	updated.CheckedInAt = current.CheckedInAt
+	updated.CancelReason = current.CancelReason
+	actor := ""
+	if subject != nil {
+		actor = subject.AccountID
+	}
+
+	now := time.Now()
+	if scheduleChanged(current, updated) && updated.Status != RegistrationRescheduled {
+		if err := CheckRegistrationTransition(subject, updated, RegistrationRescheduled, "", now); err != nil {
+			var transitionErr *StatusTransitionError
+			if errors.As(err, &transitionErr) && !transitionErr.Forbidden {
+				return &RescheduleError{Status: current.Status}
+			}
+			return err
+		}
+		applyRegistrationTransition(updated, RegistrationRescheduled, "", actor, now)
+	}
+	if requested != "" && requested != updated.Status && !(requested == current.Status && updated.Status == RegistrationRescheduled) {
+		if err := CheckRegistrationTransition(subject, updated, requested, reason, now); err != nil {
+			return err
+		}
+		applyRegistrationTransition(updated, requested, reason, actor, now)
+	}
+	return nil
 }
 
-func (s *RegistrationService) Delete(ctx context.Context, id string) error {
+// Delete 软删除：记录删除时间和操作人，默认查询不再返回，可通过 Restore 恢复
+func (s *RegistrationService) Delete(ctx context.Context, id string, actor string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	registrations, err := s.readAll()
+	registration, ok, err := s.cache.get(ctx, id)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		return ErrRegistrationNotFound
+	}
+	now := time.Now()
+	registration.DeletedAt = &now
+	registration.DeletedBy = actor
+	return s.save(ctx, registration)
+}
 
-	newRegistrations := make([]models.Registration, 0, len(registrations))
-	for _, registration := range registrations {
-		if registration.ID != id {
-			newRegistrations = append(newRegistrations, registration)
-		}
+// Restore 恢复软删除的挂号。恢复后重新占用号源，和新建一样检查病人的挂号冲突和医生的号源
+func (s *RegistrationService) Restore(ctx context.Context, id string, doctor *models.Doctor) (*models.Registration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	registration, ok, err := s.cache.getIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	if registration.DeletedAt == nil {
+		return nil, &NotDeletedError{Entity: "registration"}
+	}
+	if err := s.checkPatientBookings(ctx, id, registration); err != nil {
+		return nil, err
+	}
+	if err := s.checkDoctorCapacity(ctx, id, registration, doctor); err != nil {
+		return nil, err
+	}
+	registration.DeletedAt = nil
+	registration.DeletedBy = ""
+	if err := s.save(ctx, registration); err != nil {
+		return nil, err
+	}
+	return registration, nil
+}
+
+func (s *RegistrationService) GetByIDIncludingDeleted(ctx context.Context, id string) (*models.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	registration, ok, err := s.cache.getIncludingDeleted(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrRegistrationNotFound
+	}
+	return registration, nil
+}
+
+// GetAllIncludingDeleted 包含已软删除的记录，仅供管理员查看
+func (s *RegistrationService) GetAllIncludingDeleted(ctx context.Context) ([]models.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.allIncludingDeleted(ctx)
+}
+
+func (s *RegistrationService) GetByDoctorID(ctx context.Context, doctorID string) ([]models.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.lookup(ctx, "doctorId", doctorID)
+}
+
+func (s *RegistrationService) GetByPatientID(ctx context.Context, patientID string) ([]models.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.lookup(ctx, "patientId", patientID)
+}
+
+// GetByVisitDate 按就诊日期（服务器本地时区的自然日）查询
+func (s *RegistrationService) GetByVisitDate(ctx context.Context, visitDate time.Time) ([]models.Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cache.lookup(ctx, "visitDate", visitDay(visitDate))
+}
+
+// GetDoctorSlots 查询医生在日期范围内可预约的时间段
+func (s *RegistrationService) GetDoctorSlots(ctx context.Context, doctor *models.Doctor, from time.Time, to time.Time) ([]DoctorDaySlots, error) {
+	if doctor == nil {
+		return nil, ErrDoctorNotFound
+	}
+	if to.Before(from) {
+		return nil, errors.New("endDate must not be before startDate")
 	}
+	registrations, err := s.GetByDoctorID(ctx, doctor.ID)
+	if err != nil {
+		return nil, err
+	}
+	return BuildDoctorSlots(doctor, registrations, from, to, time.Now()), nil
+}
 
-	data, err := json.MarshalIndent(newRegistrations, "", "  ")
+func (s *RegistrationService) checkDoctorCapacity(ctx context.Context, excludeID string, registration *models.Registration, doctor *models.Doctor) error {
+	if doctor == nil {
+		return ErrDoctorNotFound
+	}
+	if !IsActiveBooking(registration.Status) {
+		return nil
+	}
+	maxPatients := doctor.MaxPatients
+	if maxPatients < 1 {
+		maxPatients = 30
+	}
+	registrations, err := s.cache.lookup(ctx, "doctorId", doctor.ID)
 	if err != nil {
 		return err
 	}
+	day := visitDay(registration.VisitDate)
+	booked := countActiveBookings(registrations, excludeID, doctor.ID, day)
+	if booked >= maxPatients {
+		return &FullyBookedError{
+			DoctorID:    doctor.ID,
+			VisitDate:   day,
+			MaxPatients: maxPatients,
+			Booked:      booked,
+		}
+	}
+	return nil
+}
 
-	return os.WriteFile(s.filename, data, 0644)
+// countActiveBookings 与 /slots 的口径一致，只统计 IsActiveBooking 的挂号
+func countActiveBookings(registrations []models.Registration, excludeID string, doctorID string, day string) int {
+	count := 0
+	for _, r := range registrations {
+		if r.ID == excludeID || r.DoctorID != doctorID || !IsActiveBooking(r.Status) {
+			continue
+		}
+		if visitDay(r.VisitDate) == day {
+			count++
+		}
+	}
+	return count
+}
+
+// visitDay 按服务器本地时区取就诊日期，前端传的是本地零点转成的UTC时间
+func visitDay(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+func (s *RegistrationService) save(ctx context.Context, registration *models.Registration) error {
+	registration.Version++
+	if err := storage.Save(ctx, s.store, storage.CollectionRegistrations, registration.ID, registration); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
 }
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"hospital-system/auth"
+	"hospital-system/models"
+	"strings"
+	"time"
+)
+
+// 挂号状态
+const (
+	RegistrationPending        = "pending"
+	RegistrationConfirmed      = "confirmed"
+	RegistrationRescheduled    = "rescheduled" // 改了医生、日期或时间段，等待重新确认
+	RegistrationCheckedIn      = "checked_in"
+	RegistrationInConsultation = "in_consultation"
+	RegistrationCompleted      = "completed"
+	RegistrationCancelled      = "cancelled"
+	RegistrationNoShow         = "no_show"
+)
+
+// registrationStatuses 全部状态，按流程顺序排列，返回可选状态时也按这个顺序
+var registrationStatuses = []string{
+	RegistrationPending, RegistrationConfirmed, RegistrationRescheduled, RegistrationCheckedIn,
+	RegistrationInConsultation, RegistrationCompleted, RegistrationCancelled, RegistrationNoShow,
+}
+
+// 挂号请求本身不合法时返回的错误，接口据此返回 400
+var (
+	ErrInvalidRegistrationStatus = errors.New("invalid status")
+	ErrInvalidInitialStatus      = errors.New("invalid initial status")
+	ErrCancelReasonRequired      = errors.New("a reason is required to cancel a registration")
+	ErrCheckInNotVisitDay        = errors.New("check-in is only allowed on the visit date")
+	ErrNoShowBeforeVisitDay      = errors.New("cannot mark no-show before the visit date")
+)
+
+// RescheduleError 当前状态的挂号不能再改医生、日期或时间段
+type RescheduleError struct {
+	Status string
+}
+
+func (e *RescheduleError) Error() string {
+	return "cannot reschedule a registration in status " + e.Status
+}
+
+// registrationTransition 一条允许的状态变化：有 perms 中任一权限即可（own 权限要求挂号属于自己），guard 检查时间等附加条件
+type registrationTransition struct {
+	perms []string
+	guard func(reg *models.Registration, now time.Time) error
+}
+
+var (
+	// 医生确认、接诊、完成就诊；能修改整条挂号的角色也可以
+	doctorStatusPerms = []string{auth.PermRegistrationUpdate, auth.PermRegistrationUpdateStatus}
+	cancelPerms       = []string{auth.PermRegistrationUpdate, auth.PermRegistrationUpdateStatus, auth.PermRegistrationCancel}
+	reschedulePerms   = []string{auth.PermRegistrationUpdate}
+	checkInPerms      = []string{auth.PermRegistrationCheckIn}
+	noShowPerms       = []string{auth.PermRegistrationMarkNoShow}
+)
+
+// awaitingArrivalTransitions 待处理、已确认、已改期的挂号病人还没到院，三者的出口相同
+func awaitingArrivalTransitions() map[string]registrationTransition {
+	return map[string]registrationTransition{
+		RegistrationConfirmed:   {perms: doctorStatusPerms},
+		RegistrationRescheduled: {perms: reschedulePerms},
+		RegistrationCheckedIn:   {perms: checkInPerms, guard: onVisitDay},
+		RegistrationNoShow:      {perms: noShowPerms, guard: onOrAfterVisitDay},
+		RegistrationCancelled:   {perms: cancelPerms},
+	}
+}
+
+// registrationTransitions 当前状态 -> 目标状态。completed 和 cancelled 是终态
+var registrationTransitions = map[string]map[string]registrationTransition{
+	RegistrationPending:     awaitingArrivalTransitions(),
+	RegistrationConfirmed:   awaitingArrivalTransitions(),
+	RegistrationRescheduled: awaitingArrivalTransitions(),
+	RegistrationCheckedIn: {
+		RegistrationInConsultation: {perms: doctorStatusPerms},
+		RegistrationCompleted:      {perms: doctorStatusPerms},
+		RegistrationCancelled:      {perms: []string{auth.PermRegistrationUpdate}}, // 签到后离开，只有管理员能取消
+	},
+	RegistrationInConsultation: {
+		RegistrationCompleted: {perms: doctorStatusPerms},
+	},
+	RegistrationNoShow: {
+		RegistrationCheckedIn: {perms: checkInPerms, guard: onVisitDay}, // 当天迟到补签
+	},
+}
+
+func onVisitDay(reg *models.Registration, now time.Time) error {
+	if visitDay(reg.VisitDate) != visitDay(now) {
+		return ErrCheckInNotVisitDay
+	}
+	return nil
+}
+
+func onOrAfterVisitDay(reg *models.Registration, now time.Time) error {
+	if visitDay(reg.VisitDate) > visitDay(now) {
+		return ErrNoShowBeforeVisitDay
+	}
+	return nil
+}
+
+// StatusTransitionError 状态机不允许的变化。Forbidden 为 true 时变化本身合法，只是当前账号没有对应权限；
+// Allowed 是当前账号此时可以改到的状态
+type StatusTransitionError struct {
+	From      string
+	To        string
+	Forbidden bool
+	Allowed   []string
+}
+
+func (e *StatusTransitionError) Error() string {
+	if e.Forbidden {
+		return fmt.Sprintf("not allowed to change status from %s to %s", e.From, e.To)
+	}
+	return fmt.Sprintf("invalid status transition from %s to %s", e.From, e.To)
+}
+
+// IsValidRegistrationStatus 是否为已知状态
+func IsValidRegistrationStatus(status string) bool {
+	for _, s := range registrationStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidInitialRegistrationStatus 新建挂号只能是待处理或已确认，其余状态都要按流程走到
+func IsValidInitialRegistrationStatus(status string) bool {
+	return status == RegistrationPending || status == RegistrationConfirmed
+}
+
+// CheckRegistrationTransition 检查 subject 能否把 reg 从当前状态改到 to，不修改 reg。取消必须填写原因
+func CheckRegistrationTransition(subject *auth.Subject, reg *models.Registration, to string, reason string, now time.Time) error {
+	if !IsValidRegistrationStatus(to) {
+		return ErrInvalidRegistrationStatus
+	}
+	t, ok := registrationTransitions[reg.Status][to]
+	if !ok {
+		return &StatusTransitionError{From: reg.Status, To: to, Allowed: NextRegistrationStatuses(subject, reg, now)}
+	}
+	if !canTransition(subject, reg, t) {
+		return &StatusTransitionError{From: reg.Status, To: to, Forbidden: true, Allowed: NextRegistrationStatuses(subject, reg, now)}
+	}
+	if to == RegistrationCancelled && strings.TrimSpace(reason) == "" {
+		return ErrCancelReasonRequired
+	}
+	if t.guard != nil {
+		return t.guard(reg, now)
+	}
+	return nil
+}
+
+// NextRegistrationStatuses subject 现在可以把 reg 改到哪些状态，前端据此显示操作按钮
+func NextRegistrationStatuses(subject *auth.Subject, reg *models.Registration, now time.Time) []string {
+	next := make([]string, 0)
+	transitions := registrationTransitions[reg.Status]
+	for _, to := range registrationStatuses {
+		t, ok := transitions[to]
+		if !ok || !canTransition(subject, reg, t) {
+			continue
+		}
+		if t.guard != nil && t.guard(reg, now) != nil {
+			continue
+		}
+		next = append(next, to)
+	}
+	return next
+}
+
+func canTransition(subject *auth.Subject, reg *models.Registration, t registrationTransition) bool {
+	if subject == nil {
+		return false
+	}
+	for _, perm := range t.perms {
+		if auth.Authorize(subject, perm, auth.OwnsRegistration(reg)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyRegistrationTransition 改状态并追加一条历史，调用方已经用 CheckRegistrationTransition 检查过
+func applyRegistrationTransition(reg *models.Registration, to string, reason string, actor string, now time.Time) {
+	reg.StatusHistory = append(reg.StatusHistory, models.RegistrationStatusChange{
+		From:      reg.Status,
+		To:        to,
+		Reason:    strings.TrimSpace(reason),
+		ChangedBy: actor,
+		ChangedAt: now,
+	})
+	reg.Status = to
+	switch to {
+	case RegistrationCancelled:
+		reg.CancelReason = strings.TrimSpace(reason)
+	case RegistrationCheckedIn:
+		reg.CheckedInAt = &now
+	}
+}
+
+// scheduleChanged 换了医生、就诊日期或时间段
+func scheduleChanged(before *models.Registration, after *models.Registration) bool {
+	return before.DoctorID != after.DoctorID ||
+		visitDay(before.VisitDate) != visitDay(after.VisitDate) ||
+		strings.TrimSpace(before.TimeSlot) != strings.TrimSpace(after.TimeSlot)
+}
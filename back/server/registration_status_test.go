@@ -0,0 +1,171 @@
+package services
+
+import (
+	"errors"
+	"hospital-system/auth"
+	"hospital-system/models"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckRegistrationTransition(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.Local)
+	today := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	tomorrow := today.AddDate(0, 0, 1)
+
+	admin := &auth.Subject{AccountID: "a1", Role: "admin"}
+	doctor := &auth.Subject{AccountID: "a2", Role: "doctor", LinkedID: "d1"}
+	otherDoctor := &auth.Subject{AccountID: "a3", Role: "doctor", LinkedID: "d2"}
+	patient := &auth.Subject{AccountID: "a4", Role: "patient", LinkedID: "p1"}
+	desk := &auth.Subject{AccountID: "a5", Role: "receptionist"}
+
+	tests := []struct {
+		name      string
+		subject   *auth.Subject
+		from      string
+		visit     time.Time
+		to        string
+		reason    string
+		wantErr   error
+		forbidden bool // 期望 StatusTransitionError 且 Forbidden 为 true
+		invalid   bool // 期望 StatusTransitionError 且 Forbidden 为 false
+	}{
+		{name: "doctor confirms own", subject: doctor, from: RegistrationPending, visit: tomorrow, to: RegistrationConfirmed},
+		{name: "doctor cannot confirm another doctor's", subject: otherDoctor, from: RegistrationPending, visit: tomorrow, to: RegistrationConfirmed, forbidden: true},
+		{name: "patient cancels own with reason", subject: patient, from: RegistrationConfirmed, visit: tomorrow, to: RegistrationCancelled, reason: "busy"},
+		{name: "cancel requires a reason", subject: patient, from: RegistrationPending, visit: tomorrow, to: RegistrationCancelled, reason: "  ", wantErr: ErrCancelReasonRequired},
+		{name: "patient cannot confirm", subject: patient, from: RegistrationPending, visit: tomorrow, to: RegistrationConfirmed, forbidden: true},
+		{name: "check-in on visit day", subject: desk, from: RegistrationConfirmed, visit: today, to: RegistrationCheckedIn},
+		{name: "check-in before visit day", subject: desk, from: RegistrationConfirmed, visit: tomorrow, to: RegistrationCheckedIn, wantErr: ErrCheckInNotVisitDay},
+		{name: "no-show before visit day", subject: desk, from: RegistrationPending, visit: tomorrow, to: RegistrationNoShow, wantErr: ErrNoShowBeforeVisitDay},
+		{name: "no-show on visit day", subject: desk, from: RegistrationPending, visit: today, to: RegistrationNoShow},
+		{name: "late check-in after no-show", subject: desk, from: RegistrationNoShow, visit: today, to: RegistrationCheckedIn},
+		{name: "only admin cancels after check-in", subject: desk, from: RegistrationCheckedIn, visit: today, to: RegistrationCancelled, reason: "left", forbidden: true},
+		{name: "admin cancels after check-in", subject: admin, from: RegistrationCheckedIn, visit: today, to: RegistrationCancelled, reason: "left"},
+		{name: "completed is terminal", subject: admin, from: RegistrationCompleted, visit: today, to: RegistrationCancelled, reason: "x", invalid: true},
+		{name: "skip consultation is invalid from pending", subject: admin, from: RegistrationPending, visit: today, to: RegistrationCompleted, invalid: true},
+		{name: "unknown status", subject: admin, from: RegistrationPending, visit: today, to: "archived", wantErr: ErrInvalidRegistrationStatus},
+		{name: "nil subject", subject: nil, from: RegistrationPending, visit: today, to: RegistrationConfirmed, forbidden: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &models.Registration{ID: "r1", PatientID: "p1", DoctorID: "d1", Status: tt.from, VisitDate: tt.visit}
+			err := CheckRegistrationTransition(tt.subject, reg, tt.to, tt.reason, now)
+
+			var transition *StatusTransitionError
+			switch {
+			case tt.forbidden || tt.invalid:
+				if !errors.As(err, &transition) {
+					t.Fatalf("got %v, want StatusTransitionError", err)
+				}
+				if transition.Forbidden != tt.forbidden {
+					t.Fatalf("Forbidden = %v, want %v", transition.Forbidden, tt.forbidden)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if reg.Status != tt.from {
+				t.Fatalf("check must not modify the registration, status is %s", reg.Status)
+			}
+		})
+	}
+}
+
+func TestNextRegistrationStatuses(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.Local)
+	today := time.Date(2026, 3, 2, 0, 0, 0, 0, time.Local)
+	tomorrow := today.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name    string
+		subject *auth.Subject
+		from    string
+		visit   time.Time
+		want    []string
+	}{
+		{
+			name:    "admin on visit day",
+			subject: &auth.Subject{Role: "admin"},
+			from:    RegistrationPending,
+			visit:   today,
+			want:    []string{RegistrationConfirmed, RegistrationRescheduled, RegistrationCheckedIn, RegistrationCancelled, RegistrationNoShow},
+		},
+		{
+			name:    "receptionist before visit day",
+			subject: &auth.Subject{Role: "receptionist"},
+			from:    RegistrationConfirmed,
+			visit:   tomorrow,
+			want:    []string{RegistrationCancelled},
+		},
+		{
+			name:    "doctor during consultation",
+			subject: &auth.Subject{Role: "doctor", LinkedID: "d1"},
+			from:    RegistrationInConsultation,
+			visit:   today,
+			want:    []string{RegistrationCompleted},
+		},
+		{
+			name:    "terminal status",
+			subject: &auth.Subject{Role: "admin"},
+			from:    RegistrationCancelled,
+			visit:   today,
+			want:    []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &models.Registration{PatientID: "p1", DoctorID: "d1", Status: tt.from, VisitDate: tt.visit}
+			got := NextRegistrationStatuses(tt.subject, reg, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRegistrationTransition(t *testing.T) {
+	now := time.Date(2026, 3, 2, 10, 0, 0, 0, time.Local)
+
+	tests := []struct {
+		name       string
+		to         string
+		reason     string
+		wantReason string
+		checkedIn  bool
+	}{
+		{name: "cancel records trimmed reason", to: RegistrationCancelled, reason: " busy ", wantReason: "busy"},
+		{name: "check-in records time", to: RegistrationCheckedIn, checkedIn: true},
+		{name: "confirm", to: RegistrationConfirmed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &models.Registration{Status: RegistrationPending}
+			applyRegistrationTransition(reg, tt.to, tt.reason, "a1", now)
+
+			if reg.Status != tt.to {
+				t.Fatalf("status = %s, want %s", reg.Status, tt.to)
+			}
+			if reg.CancelReason != tt.wantReason {
+				t.Fatalf("cancel reason = %q, want %q", reg.CancelReason, tt.wantReason)
+			}
+			if (reg.CheckedInAt != nil) != tt.checkedIn {
+				t.Fatalf("checkedInAt = %v, want set=%v", reg.CheckedInAt, tt.checkedIn)
+			}
+			if len(reg.StatusHistory) != 1 {
+				t.Fatalf("history has %d entries, want 1", len(reg.StatusHistory))
+			}
+			h := reg.StatusHistory[0]
+			if h.From != RegistrationPending || h.To != tt.to || h.ChangedBy != "a1" || !h.ChangedAt.Equal(now) {
+				t.Fatalf("unexpected history entry %+v", h)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"hospital-system/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 与 WorkSchedule.DayOfWeek 的取值保持一致，下标对应 time.Weekday
+var weekdayNames = [...]string{"周日", "周一", "周二", "周三", "周四", "周五", "周六"}
+
+func WeekdayName(t time.Time) string {
+	return weekdayNames[t.Local().Weekday()]
+}
+
+// ParseTimeSlot 解析 "09:00-09:30" 形式的时间段，返回从零点开始的分钟数；
+// 只写一个时间点 "09:00" 时起止相同
+func ParseTimeSlot(slot string) (start int, end int, err error) {
+	slot = strings.TrimSpace(slot)
+	if slot == "" {
+		return 0, 0, errors.New("timeSlot cannot be empty")
+	}
+	parts := strings.Split(slot, "-")
+	if len(parts) > 2 {
+		return 0, 0, errors.New("invalid timeSlot: " + slot)
+	}
+	start, err = parseClock(parts[0])
+	if err != nil {
+		return 0, 0, errors.New("invalid timeSlot: " + slot)
+	}
+	end = start
+	if len(parts) == 2 {
+		end, err = parseClock(parts[1])
+		if err != nil {
+			return 0, 0, errors.New("invalid timeSlot: " + slot)
+		}
+	}
+	if end < start {
+		return 0, 0, errors.New("invalid timeSlot: " + slot)
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	hm := strings.Split(s, ":")
+	if len(hm) != 2 {
+		return 0, errors.New("invalid time: " + s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, errors.New("invalid time: " + s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.New("invalid time: " + s)
+	}
+	return h*60 + m, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// AvailableSchedules 返回医生在就诊日期当天可出诊的排班
+func AvailableSchedules(doctor *models.Doctor, visitDate time.Time) []models.WorkSchedule {
+	day := WeekdayName(visitDate)
+	schedules := make([]models.WorkSchedule, 0, 1)
+	for _, ws := range doctor.WorkSchedule {
+		if ws.IsAvailable && strings.TrimSpace(ws.DayOfWeek) == day {
+			schedules = append(schedules, ws)
+		}
+	}
+	return schedules
+}
+
+// ValidateDoctorSchedule 校验挂号时间段是否落在医生当天的出诊时间内
+func ValidateDoctorSchedule(doctor *models.Doctor, visitDate time.Time, timeSlot string) error {
+	if doctor == nil {
+		return ErrDoctorNotFound
+	}
+	start, end, err := ParseTimeSlot(timeSlot)
+	if err != nil {
+		return err
+	}
+
+	day := WeekdayName(visitDate)
+	schedules := AvailableSchedules(doctor, visitDate)
+	if len(schedules) == 0 {
+		return fmt.Errorf("doctor %s is not available on %s", doctor.Name, day)
+	}
+
+	hours := make([]string, 0, len(schedules))
+	for _, ws := range schedules {
+		wsStart, err := parseClock(ws.StartTime)
+		if err != nil {
+			continue
+		}
+		wsEnd, err := parseClock(ws.EndTime)
+		if err != nil {
+			continue
+		}
+		hours = append(hours, formatClock(wsStart)+"-"+formatClock(wsEnd))
+		if start >= wsStart && end <= wsEnd && start < wsEnd {
+			return nil
+		}
+	}
+	return fmt.Errorf("timeSlot %s is outside doctor %s's working hours on %s (%s)", strings.TrimSpace(timeSlot), doctor.Name, day, strings.Join(hours, ", "))
+}
+
+// SlotMinutes 号源时间段长度（分钟）
+const SlotMinutes = 30
+
+type DoctorSlot struct {
+	TimeSlot  string `json:"timeSlot"`
+	Booked    int    `json:"booked"`
+	Available bool   `json:"available"`
+}
+
+type DoctorDaySlots struct {
+	Date        string       `json:"date"`
+	DayOfWeek   string       `json:"dayOfWeek"`
+	MaxPatients int          `json:"maxPatients"`
+	Booked      int          `json:"booked"`
+	Remaining   int          `json:"remaining"`
+	Slots       []DoctorSlot `json:"slots"`
+}
+
+// BuildDoctorSlots 按排班把 [from, to] 内每天切成固定长度的时间段，并扣掉已有的挂号
+func BuildDoctorSlots(doctor *models.Doctor, registrations []models.Registration, from time.Time, to time.Time, now time.Time) []DoctorDaySlots {
+	maxPatients := doctor.MaxPatients
+	if maxPatients < 1 {
+		maxPatients = 30
+	}
+
+	bookedByDay := make(map[string][]models.Registration)
+	for _, r := range registrations {
+		if r.DoctorID != doctor.ID || !IsActiveBooking(r.Status) {
+			continue
+		}
+		day := visitDay(r.VisitDate)
+		bookedByDay[day] = append(bookedByDay[day], r)
+	}
+
+	from = startOfDay(from)
+	to = startOfDay(to)
+	days := make([]DoctorDaySlots, 0)
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		date := d.Format("2006-01-02")
+		booked := bookedByDay[date]
+		remaining := maxPatients - len(booked)
+		if remaining < 0 {
+			remaining = 0
+		}
+		day := DoctorDaySlots{
+			Date:        date,
+			DayOfWeek:   WeekdayName(d),
+			MaxPatients: maxPatients,
+			Booked:      len(booked),
+			Remaining:   remaining,
+			Slots:       []DoctorSlot{},
+		}
+
+		for _, ws := range AvailableSchedules(doctor, d) {
+			wsStart, err := parseClock(ws.StartTime)
+			if err != nil {
+				continue
+			}
+			wsEnd, err := parseClock(ws.EndTime)
+			if err != nil {
+				continue
+			}
+			for start := wsStart; start+SlotMinutes <= wsEnd; start += SlotMinutes {
+				end := start + SlotMinutes
+				count := 0
+				for _, r := range booked {
+					rStart, _, err := ParseTimeSlot(r.TimeSlot)
+					if err == nil && rStart >= start && rStart < end {
+						count++
+					}
+				}
+				slotStart := d.Add(time.Duration(start) * time.Minute)
+				day.Slots = append(day.Slots, DoctorSlot{
+					TimeSlot:  formatClock(start) + "-" + formatClock(end),
+					Booked:    count,
+					Available: remaining > 0 && slotStart.After(now),
+				})
+			}
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
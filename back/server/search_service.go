@@ -0,0 +1,339 @@
+package services
+
+import (
+	"context"
+	"hospital-system/storage"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	SearchTypePatient = "patient"
+	SearchTypeDoctor  = "doctor"
+	SearchTypeDisease = "disease"
+)
+
+// SearchTypes 搜索结果里的实体类型，同分时按这个顺序排
+var SearchTypes = []string{SearchTypePatient, SearchTypeDoctor, SearchTypeDisease}
+
+// SearchHit 一条搜索结果，Item 是对应的病人/医生/病种记录
+type SearchHit struct {
+	Type          string      `json:"type"`
+	ID            string      `json:"id"`
+	Score         int         `json:"score"`
+	MatchedFields []string    `json:"matchedFields"`
+	Item          interface{} `json:"item"`
+}
+
+// SearchScope 调用方决定哪些记录能搜到：visible 为 false 的跳过，pii 为 false 时不匹配敏感字段
+type SearchScope func(docType string, id string) (visible bool, pii bool)
+
+// SearchService 病人、医生、病种的全文检索。倒排索引放在内存里，
+// 三个集合任何一个的存储版本号变了就整体重建，和 indexedCache 的刷新规则一致
+type SearchService struct {
+	store    storage.Store
+	patients *PatientService
+	doctors  *DoctorService
+	diseases *DiseaseService
+
+	mu       sync.Mutex
+	versions map[string]string
+	index    *searchIndex
+}
+
+func InitSearchService(c *SearchService, store storage.Store, patients *PatientService, doctors *DoctorService, diseases *DiseaseService) *SearchService {
+	if c == nil || c.store == nil {
+		return &SearchService{
+			store:    store,
+			patients: patients,
+			doctors:  doctors,
+			diseases: diseases,
+		}
+	}
+	return c
+}
+
+// 字段权重：名字最重要，长文本最低
+const (
+	weightName   = 10
+	weightID     = 8 // 电话、身份证号
+	weightTag    = 5 // 科室、病种分类
+	weightDetail = 3 // 症状
+	weightText   = 1 // 简介、治疗方法、医生负责病种的描述
+)
+
+type searchField struct {
+	name   string
+	value  string // 已经过 normalizeSearchText
+	weight int
+	pii    bool
+}
+
+type searchDoc struct {
+	docType string
+	id      string
+	fields  []searchField
+	item    interface{}
+}
+
+type searchIndex struct {
+	docs     []searchDoc
+	postings map[string][]int // n-gram -> 文档下标，升序且不重复
+}
+
+// Search 按空白切分关键词，每个词都要命中（可以落在不同字段），按匹配程度和字段权重打分排序。
+// types 为空表示全部类型
+func (s *SearchService) Search(ctx context.Context, query string, types []string, scope SearchScope) ([]SearchHit, error) {
+	index, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := strings.Fields(normalizeSearchText(query))
+	hits := []SearchHit{}
+	if len(terms) == 0 {
+		return hits, nil
+	}
+
+	for _, i := range index.candidates(terms) {
+		doc := &index.docs[i]
+		if len(types) > 0 && !containsString(types, doc.docType) {
+			continue
+		}
+		visible, pii := scope(doc.docType, doc.id)
+		if !visible {
+			continue
+		}
+		score, matched := doc.score(terms, pii)
+		if score == 0 {
+			continue
+		}
+		hits = append(hits, SearchHit{Type: doc.docType, ID: doc.id, Score: score, MatchedFields: matched, Item: doc.item})
+	}
+
+	sort.SliceStable(hits, func(a, b int) bool {
+		if hits[a].Score != hits[b].Score {
+			return hits[a].Score > hits[b].Score
+		}
+		if hits[a].Type != hits[b].Type {
+			return searchTypeOrder(hits[a].Type) < searchTypeOrder(hits[b].Type)
+		}
+		return hits[a].ID < hits[b].ID
+	})
+	return hits, nil
+}
+
+// current 返回最新的索引，数据没变时直接复用
+func (s *SearchService) current(ctx context.Context) (*searchIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 先取版本号再读数据：中间有写入时下次会再重建一次，不会漏
+	versions := map[string]string{}
+	fresh := s.index != nil
+	if v, ok := s.store.(storage.Versioner); ok {
+		for _, collection := range []string{storage.CollectionPatients, storage.CollectionDoctors, storage.CollectionDiseases} {
+			version, err := v.Version(ctx, collection)
+			if err != nil {
+				return nil, err
+			}
+			versions[collection] = version
+			if version == "" || version != s.versions[collection] {
+				fresh = false
+			}
+		}
+	} else {
+		fresh = false
+	}
+	if fresh {
+		return s.index, nil
+	}
+
+	index, err := s.build(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.index = index
+	s.versions = versions
+	return index, nil
+}
+
+func (s *SearchService) build(ctx context.Context) (*searchIndex, error) {
+	patients, err := s.patients.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doctors, err := s.doctors.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	diseases, err := s.diseases.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &searchIndex{postings: map[string][]int{}}
+	for _, p := range patients {
+		index.add(searchDoc{docType: SearchTypePatient, id: p.ID, item: p, fields: []searchField{
+			{name: "name", value: normalizeSearchText(p.Name), weight: weightName},
+			{name: "phone", value: normalizeSearchText(p.Phone), weight: weightID, pii: true},
+			{name: "idCard", value: normalizeSearchText(p.IDCard), weight: weightID, pii: true},
+		}})
+	}
+
+	// 医生额外带上所负责病种的名称和症状，病人可以按症状找到医生
+	diseaseText := make(map[string]string, len(diseases))
+	for _, d := range diseases {
+		diseaseText[d.ID] = d.Name + " " + d.Symptoms
+	}
+	for _, d := range doctors {
+		var related []string
+		for _, id := range d.Diseases {
+			if text, ok := diseaseText[id]; ok {
+				related = append(related, text)
+			}
+		}
+		index.add(searchDoc{docType: SearchTypeDoctor, id: d.ID, item: d, fields: []searchField{
+			{name: "name", value: normalizeSearchText(d.Name), weight: weightName},
+			{name: "department", value: normalizeSearchText(d.Department), weight: weightTag},
+			{name: "introduction", value: normalizeSearchText(d.Introduction), weight: weightText},
+			{name: "diseases", value: normalizeSearchText(strings.Join(related, " ")), weight: weightText},
+		}})
+	}
+
+	for _, d := range diseases {
+		index.add(searchDoc{docType: SearchTypeDisease, id: d.ID, item: d, fields: []searchField{
+			{name: "name", value: normalizeSearchText(d.Name), weight: weightName},
+			{name: "category", value: normalizeSearchText(d.Category), weight: weightTag},
+			{name: "symptoms", value: normalizeSearchText(d.Symptoms), weight: weightDetail},
+			{name: "treatment", value: normalizeSearchText(d.Treatment), weight: weightText},
+		}})
+	}
+	return index, nil
+}
+
+func (idx *searchIndex) add(doc searchDoc) {
+	n := len(idx.docs)
+	idx.docs = append(idx.docs, doc)
+	for _, f := range doc.fields {
+		for _, gram := range searchGrams(f.value, true) {
+			list := idx.postings[gram]
+			if len(list) > 0 && list[len(list)-1] == n {
+				continue
+			}
+			idx.postings[gram] = append(list, n)
+		}
+	}
+}
+
+// candidates 所有关键词的所有 n-gram 都出现过的文档，之后还要逐字段确认是真正的子串
+func (idx *searchIndex) candidates(terms []string) []int {
+	var result []int
+	first := true
+	for _, term := range terms {
+		for _, gram := range searchGrams(term, false) {
+			list := idx.postings[gram]
+			if first {
+				result = append([]int(nil), list...)
+				first = false
+			} else {
+				result = intersectSorted(result, list)
+			}
+			if len(result) == 0 {
+				return nil
+			}
+		}
+	}
+	return result
+}
+
+// score 每个关键词取得分最高的字段：完全相同 ×4、前缀 ×3、后缀 ×2（身份证尾号）、包含 ×1。
+// 有关键词没命中任何可见字段时返回 0
+func (doc *searchDoc) score(terms []string, pii bool) (int, []string) {
+	total := 0
+	var matched []string
+	for _, term := range terms {
+		best, bestField := 0, ""
+		for _, f := range doc.fields {
+			if f.pii && !pii {
+				continue
+			}
+			s := 0
+			switch {
+			case f.value == term:
+				s = 4
+			case strings.HasPrefix(f.value, term):
+				s = 3
+			case strings.HasSuffix(f.value, term):
+				s = 2
+			case strings.Contains(f.value, term):
+				s = 1
+			}
+			if s*f.weight > best {
+				best, bestField = s*f.weight, f.name
+			}
+		}
+		if best == 0 {
+			return 0, nil
+		}
+		total += best
+		if !containsString(matched, bestField) {
+			matched = append(matched, bestField)
+		}
+	}
+	return total, matched
+}
+
+// normalizeSearchText 转小写，字母数字和汉字以外的字符都当作分隔符
+func normalizeSearchText(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// searchGrams 字符 n-gram，中文不用分词也能按任意片段检索。
+// 建索引时每个字和每两个相邻字都收进去；查询时单字查单字，多字按相邻两字查
+func searchGrams(text string, indexing bool) []string {
+	var grams []string
+	for _, word := range strings.Fields(text) {
+		runes := []rune(word)
+		if indexing || len(runes) == 1 {
+			for _, r := range runes {
+				grams = append(grams, string(r))
+			}
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			grams = append(grams, string(runes[i:i+2]))
+		}
+	}
+	return grams
+}
+
+func intersectSorted(a []int, b []int) []int {
+	out := a[:0]
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, a[i])
+			i++
+			j++
+		case a[i] < b[j]:
+			i++
+		default:
+			j++
+		}
+	}
+	return out
+}
+
+func searchTypeOrder(t string) int {
+	for i, v := range SearchTypes {
+		if v == t {
+			return i
+		}
+	}
+	return len(SearchTypes)
+}
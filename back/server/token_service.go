@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"hospital-system/auth"
+	"hospital-system/models"
+	"hospital-system/storage"
+	"sync"
+	"time"
+)
+
+const (
+	revokeReasonLogout  = "logout"
+	revokeReasonRotated = "rotated"
+)
+
+// revokedTokenPurgeInterval 多久清理一次过期的吊销记录，不在每次退出、刷新时都扫一遍
+const revokedTokenPurgeInterval = time.Hour
+
+// TokenService 维护令牌吊销名单，并负责刷新令牌的轮换
+type TokenService struct {
+	store     storage.Store
+	cache     *indexedCache[models.RevokedToken]
+	accounts  *AccountService
+	lastPurge time.Time
+	mu        sync.Mutex
+}
+
+func InitTokenService(c *TokenService, store storage.Store, accounts *AccountService) *TokenService {
+	if c == nil || c.store == nil {
+		return &TokenService{
+			store:    store,
+			cache:    newIndexedCache(store, storage.CollectionRevokedTokens, func(t *models.RevokedToken) string { return t.ID }),
+			accounts: accounts,
+		}
+	}
+	return c
+}
+
+// Issue 按账号当前的角色和令牌版本签发一对新令牌，开始一个新会话
+func (s *TokenService) Issue(ctx context.Context, account *models.Account) (*auth.TokenPair, error) {
+	return auth.IssueTokenPair(account.ID, account.Role, account.TokenVersion, account.MustChangePassword, "")
+}
+
+// sessionRevocationID 会话被吊销时在吊销名单里的记录ID，和令牌的 jti 区分开
+func sessionRevocationID(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// isSessionRevoked 令牌所属的会话是否已经退出登录。旧版本签发的令牌没有会话ID
+func (s *TokenService) isSessionRevoked(ctx context.Context, claims *auth.Claims) (bool, error) {
+	if claims.SessionID == "" {
+		return false, nil
+	}
+	return s.IsRevoked(ctx, sessionRevocationID(claims.SessionID))
+}
+
+// ValidateToken 供鉴权中间件调用：令牌未被吊销，且与账号当前的角色、令牌版本一致
+func (s *TokenService) ValidateToken(ctx context.Context, claims *auth.Claims) error {
+	revoked, err := s.IsRevoked(ctx, claims.ID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		if revoked, err = s.isSessionRevoked(ctx, claims); err != nil {
+			return err
+		}
+	}
+	if revoked {
+		return errors.New("token revoked")
+	}
+	account, err := s.accounts.GetByID(ctx, claims.UserID)
+	if err != nil {
+		return ErrAccountNotFound
+	}
+	if account.Disabled {
+		return ErrAccountDisabled
+	}
+	if account.TokenVersion != claims.Version || account.Role != claims.Role {
+		return errors.New("token revoked")
+	}
+	if auth.MFARequired(account.Role) && !account.MFAEnabled {
+		return errors.New("mfa enrollment required")
+	}
+	return nil
+}
+
+func (s *TokenService) IsRevoked(ctx context.Context, jti string) (bool, error) {
+	_, ok, err := s.cache.get(ctx, jti)
+	return ok, err
+}
+
+// Revoke 把令牌加入吊销名单，直到它自然过期
+func (s *TokenService) Revoke(ctx context.Context, claims *auth.Claims) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revoke(ctx, claims, revokeReasonLogout)
+}
+
+// Refresh 用刷新令牌换一对新令牌，旧的刷新令牌随即作废。
+// 已作废的刷新令牌再次出现说明可能被盗用，此时让该账号的所有令牌失效
+func (s *TokenService) Refresh(ctx context.Context, refreshToken string) (*models.Account, *auth.TokenPair, error) {
+	claims, err := auth.ParseToken(refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.Type != auth.TokenTypeRefresh {
+		return nil, nil, errors.New("invalid token")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	revoked, ok, err := s.cache.get(ctx, claims.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok {
+		if revoked.Reason != revokeReasonRotated {
+			return nil, nil, errors.New("token revoked")
+		}
+		if _, err := s.accounts.RevokeAllTokens(ctx, claims.UserID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("refresh token reused")
+	}
+	if sessionRevoked, err := s.isSessionRevoked(ctx, claims); err != nil {
+		return nil, nil, err
+	} else if sessionRevoked {
+		return nil, nil, errors.New("token revoked")
+	}
+
+	account, err := s.accounts.GetByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, nil, ErrAccountNotFound
+	}
+	if account.Disabled {
+		return nil, nil, ErrAccountDisabled
+	}
+	if account.TokenVersion != claims.Version || account.Role != claims.Role {
+		return nil, nil, errors.New("token revoked")
+	}
+	if auth.MFARequired(account.Role) && !account.MFAEnabled {
+		return nil, nil, errors.New("mfa enrollment required")
+	}
+	if err := s.revoke(ctx, claims, revokeReasonRotated); err != nil {
+		return nil, nil, err
+	}
+	pair, err := auth.IssueTokenPair(account.ID, account.Role, account.TokenVersion, account.MustChangePassword, claims.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, pair, nil
+}
+
+// IssueMFAToken 密码校验通过后签发的临时令牌，只能用来完成第二步验证或首次绑定
+func (s *TokenService) IssueMFAToken(ctx context.Context, account *models.Account) (string, error) {
+	return auth.IssueToken(account.ID, account.Role, account.TokenVersion, account.MustChangePassword, auth.TokenTypeMFA, auth.MFATokenTTL)
+}
+
+// ParseMFAToken 校验临时令牌并取出对应账号，令牌用过后由调用方 Revoke
+func (s *TokenService) ParseMFAToken(ctx context.Context, token string) (*models.Account, *auth.Claims, error) {
+	claims, err := auth.ParseToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if claims.Type != auth.TokenTypeMFA {
+		return nil, nil, errors.New("invalid token")
+	}
+	revoked, err := s.IsRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if revoked {
+		return nil, nil, errors.New("token revoked")
+	}
+	account, err := s.accounts.GetByID(ctx, claims.UserID)
+	if err != nil {
+		return nil, nil, ErrAccountNotFound
+	}
+	if account.Disabled {
+		return nil, nil, ErrAccountDisabled
+	}
+	if account.TokenVersion != claims.Version || account.Role != claims.Role {
+		return nil, nil, errors.New("token revoked")
+	}
+	return account, claims, nil
+}
+
+// Logout 吊销当前访问令牌所属的整个会话，包括同一次登录签发、轮换出来的刷新令牌，客户端不必回传刷新令牌；
+// all 为 true 时让该账号所有设备上的令牌失效。请求体带了刷新令牌时也一并吊销，兼容没有会话ID的旧令牌
+func (s *TokenService) Logout(ctx context.Context, access *auth.Claims, refreshToken string, all bool) error {
+	if all {
+		_, err := s.accounts.RevokeAllTokens(ctx, access.UserID)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.revoke(ctx, access, revokeReasonLogout); err != nil {
+		return err
+	}
+	if access.SessionID != "" {
+		// 会话里的刷新令牌最晚在 RefreshTokenTTL 之后过期，吊销记录保留到那时
+		session := &auth.Claims{
+			ID:     sessionRevocationID(access.SessionID),
+			UserID: access.UserID,
+			Exp:    time.Now().Add(auth.RefreshTokenTTL).Unix(),
+		}
+		if err := s.revoke(ctx, session, revokeReasonLogout); err != nil {
+			return err
+		}
+	}
+	if refreshToken == "" {
+		return nil
+	}
+	refresh, err := auth.ParseToken(refreshToken)
+	if err != nil {
+		// 刷新令牌本身已过期或无效，不需要再吊销
+		return nil
+	}
+	if refresh.Type != auth.TokenTypeRefresh || refresh.UserID != access.UserID {
+		return errors.New("invalid refresh token")
+	}
+	return s.revoke(ctx, refresh, revokeReasonLogout)
+}
+
+func (s *TokenService) revoke(ctx context.Context, claims *auth.Claims, reason string) error {
+	now := time.Now()
+	if now.Sub(s.lastPurge) >= revokedTokenPurgeInterval {
+		if err := s.purgeExpired(ctx, now); err != nil {
+			return err
+		}
+		s.lastPurge = now
+	}
+	token := models.RevokedToken{
+		ID:        claims.ID,
+		AccountID: claims.UserID,
+		Reason:    reason,
+		ExpiresAt: time.Unix(claims.Exp, 0),
+		RevokedAt: now,
+	}
+	if err := storage.Save(ctx, s.store, storage.CollectionRevokedTokens, token.ID, &token); err != nil {
+		return err
+	}
+	s.cache.invalidate()
+	return nil
+}
+
+// purgeExpired 清理已经过期的吊销记录，过期令牌本身就会被拒绝，没必要再留着。要扫描全部记录，由 revoke 按 revokedTokenPurgeInterval 调用
+func (s *TokenService) purgeExpired(ctx context.Context, now time.Time) error {
+	tokens, err := s.cache.all(ctx)
+	if err != nil {
+		return err
+	}
+	purged := false
+	for _, t := range tokens {
+		if t.ExpiresAt.After(now) {
+			continue
+		}
+		if err := s.store.Delete(ctx, storage.CollectionRevokedTokens, t.ID); err != nil {
+			return err
+		}
+		purged = true
+	}
+	if purged {
+		s.cache.invalidate()
+	}
+	return nil
+}
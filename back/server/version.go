@@ -0,0 +1,26 @@
+package services
+
+import "fmt"
+
+// 每条记录带一个版本号，每次写入（save）加一，新建的记录从 1 开始。
+// 修改时传入客户端看到的版本，和当前版本不一致说明中间有人改过，拒绝覆盖
+
+// AnyVersion 不检查版本，只给内部的联动修改用，例如删除病种时从医生身上摘掉它
+const AnyVersion int64 = -1
+
+// VersionConflictError 记录已经被别人修改，客户端需要重新读取后再改
+type VersionConflictError struct {
+	Expected int64
+	Current  int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict: expected %d, current %d", e.Expected, e.Current)
+}
+
+func checkVersion(expected int64, current int64) error {
+	if expected == AnyVersion || expected == current {
+		return nil
+	}
+	return &VersionConflictError{Expected: expected, Current: current}
+}
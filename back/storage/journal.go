@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	journalOpPut    = "put"
+	journalOpDelete = "delete"
+
+	// 日志超过这么多条就做一次检查点（存快照后清空），此前的操作都已落盘
+	journalCheckpointEntries = 1000
+)
+
+// journalEntry 预写日志的一行。先追加日志并 fsync，再改数据文件；
+// 进程在两步之间崩溃时，启动时重放日志即可恢复
+type journalEntry struct {
+	Op         string          `json:"op"`
+	Collection string          `json:"collection"`
+	ID         string          `json:"id"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Time       time.Time       `json:"time"`
+}
+
+type journal struct {
+	path    string
+	entries int
+}
+
+// append 追加一条日志，返回追加前的文件长度，应用失败时用来回滚
+func (j *journal) append(entry journalEntry) (int64, error) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	j.entries++
+	return info.Size(), nil
+}
+
+func (j *journal) rollback(offset int64) error {
+	j.entries--
+	return os.Truncate(j.path, offset)
+}
+
+// readAll 读取全部日志。最后一行可能因崩溃只写了一半，直接丢弃
+func (j *journal) readAll() ([]journalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		complete := err == nil
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 && complete {
+			var entry journalEntry
+			if jsonErr := json.Unmarshal(line, &entry); jsonErr != nil {
+				return nil, jsonErr
+			}
+			entries = append(entries, entry)
+		}
+		if !complete {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (j *journal) checkpoint() error {
+	j.entries = 0
+	return WriteFileAtomic(j.path, nil, 0644)
+}
+
+// WriteFileAtomic 先写同目录临时文件并 fsync，再 rename 覆盖，
+// 保证目标文件要么是旧内容要么是新内容，不会被写一半
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmpName)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		cleanup()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		cleanup()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// 部分平台不支持对目录 fsync，忽略该错误
+	_ = d.Sync()
+	return nil
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalReadAll(t *testing.T) {
+	put := `{"op":"put","collection":"patients","id":"p1","record":{"id":"p1"},"time":"2026-03-02T10:00:00Z"}`
+	del := `{"op":"delete","collection":"patients","id":"p1","time":"2026-03-02T10:00:01Z"}`
+
+	tests := []struct {
+		name    string
+		content *string // nil 表示日志文件不存在
+		wantOps []string
+		wantErr bool
+	}{
+		{name: "missing file", content: nil, wantOps: nil},
+		{name: "empty file", content: strPtr(""), wantOps: nil},
+		{name: "complete entries", content: strPtr(put + "\n" + del + "\n"), wantOps: []string{journalOpPut, journalOpDelete}},
+		{name: "blank lines skipped", content: strPtr(put + "\n\n" + del + "\n"), wantOps: []string{journalOpPut, journalOpDelete}},
+		{name: "torn last line dropped", content: strPtr(put + "\n" + del[:20]), wantOps: []string{journalOpPut}},
+		{name: "last line without newline dropped", content: strPtr(put + "\n" + del), wantOps: []string{journalOpPut}},
+		{name: "corrupt complete line", content: strPtr(put + "\n" + "{not json\n" + del + "\n"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &journal{path: filepath.Join(t.TempDir(), "journal.log")}
+			if tt.content != nil {
+				if err := os.WriteFile(j.path, []byte(*tt.content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries, err := j.readAll()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error for corrupt journal")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var ops []string
+			for _, e := range entries {
+				ops = append(ops, e.Op)
+			}
+			if !reflect.DeepEqual(ops, tt.wantOps) {
+				t.Fatalf("ops = %v, want %v", ops, tt.wantOps)
+			}
+		})
+	}
+}
+
+func TestJournalAppendRollbackCheckpoint(t *testing.T) {
+	j := &journal{path: filepath.Join(t.TempDir(), "journal.log")}
+	first := journalEntry{Op: journalOpPut, Collection: CollectionPatients, ID: "p1", Record: json.RawMessage(`{"id":"p1"}`)}
+	second := journalEntry{Op: journalOpDelete, Collection: CollectionPatients, ID: "p1"}
+
+	if offset, err := j.append(first); err != nil || offset != 0 {
+		t.Fatalf("first append: offset %d, err %v", offset, err)
+	}
+	offset, err := j.append(second)
+	if err != nil || offset == 0 {
+		t.Fatalf("second append: offset %d, err %v", offset, err)
+	}
+	if j.entries != 2 {
+		t.Fatalf("entries = %d, want 2", j.entries)
+	}
+
+	// 回滚只撤掉最后一条
+	if err := j.rollback(offset); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := j.readAll()
+	if err != nil || len(entries) != 1 || entries[0].ID != "p1" || entries[0].Op != journalOpPut {
+		t.Fatalf("after rollback got %+v, %v", entries, err)
+	}
+	if j.entries != 1 {
+		t.Fatalf("entries = %d, want 1", j.entries)
+	}
+
+	if err := j.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = j.readAll()
+	if err != nil || len(entries) != 0 || j.entries != 0 {
+		t.Fatalf("after checkpoint got %d entries (counter %d), %v", len(entries), j.entries, err)
+	}
+}
+
+func TestJSONStoreRecover(t *testing.T) {
+	const collection = CollectionPatients
+	journalLine := func(e journalEntry) string {
+		b, _ := json.Marshal(e)
+		return string(b) + "\n"
+	}
+
+	tests := []struct {
+		name     string
+		data     *string // 数据文件内容，nil 表示不存在
+		snapshot *string
+		journal  string
+		wantIDs  []string
+		wantErr  bool
+	}{
+		{
+			name:    "journal replayed after crash before data write",
+			data:    strPtr(`[{"id":"p1"}]`),
+			journal: journalLine(journalEntry{Op: journalOpPut, Collection: collection, ID: "p2", Record: json.RawMessage(`{"id":"p2"}`)}),
+			wantIDs: []string{"p1", "p2"},
+		},
+		{
+			name: "replay is idempotent when data was already written",
+			data: strPtr(`[{"id":"p1"},{"id":"p2"}]`),
+			journal: journalLine(journalEntry{Op: journalOpPut, Collection: collection, ID: "p2", Record: json.RawMessage(`{"id":"p2"}`)}) +
+				journalLine(journalEntry{Op: journalOpDelete, Collection: collection, ID: "p1"}),
+			wantIDs: []string{"p2"},
+		},
+		{
+			name:    "delete of missing record is a no-op",
+			data:    strPtr(`[{"id":"p1"}]`),
+			journal: journalLine(journalEntry{Op: journalOpDelete, Collection: collection, ID: "p9"}),
+			wantIDs: []string{"p1"},
+		},
+		{
+			name:    "torn journal tail ignored",
+			data:    strPtr(`[{"id":"p1"}]`),
+			journal: `{"op":"put","collection":"patients","id":"p2"`,
+			wantIDs: []string{"p1"},
+		},
+		{
+			name:     "corrupt data file restored from snapshot then replayed",
+			data:     strPtr(`[{"id":"p1"},{"id"`),
+			snapshot: strPtr(`[{"id":"p1"}]`),
+			journal:  journalLine(journalEntry{Op: journalOpPut, Collection: collection, ID: "p3", Record: json.RawMessage(`{"id":"p3"}`)}),
+			wantIDs:  []string{"p1", "p3"},
+		},
+		{
+			name:    "corrupt data file without snapshot refuses to start",
+			data:    strPtr(`[{"id":"p1"},{"id"`),
+			wantErr: true,
+		},
+		{
+			name:    "corrupt journal quarantined",
+			data:    strPtr(`[{"id":"p1"}]`),
+			journal: "{broken\n",
+			wantIDs: []string{"p1"},
+		},
+		{
+			name:    "unknown op rejected",
+			data:    strPtr(`[]`),
+			journal: journalLine(journalEntry{Op: "truncate", Collection: collection, ID: "p1"}),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := NewJSONStore(dir)
+			if tt.data != nil {
+				writeTestFile(t, s.path(collection), *tt.data)
+			}
+			if tt.snapshot != nil {
+				writeTestFile(t, s.snapshotPath(collection), *tt.snapshot)
+			}
+			if tt.journal != "" {
+				writeTestFile(t, s.journal.path, tt.journal)
+			}
+			// 崩溃遗留的临时文件应被清理
+			writeTestFile(t, filepath.Join(dir, ".patients.json.tmp-123"), "partial")
+
+			err := s.Recover(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want recover error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			records, err := s.List(context.Background(), collection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, 0, len(records))
+			for _, raw := range records {
+				id, _ := recordID(raw)
+				ids = append(ids, id)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if entries, _ := s.journal.readAll(); len(entries) != 0 {
+				t.Fatalf("journal not checkpointed, %d entries left", len(entries))
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".patients.json.tmp-123")); !os.IsNotExist(err) {
+				t.Fatal("leftover temp file not removed")
+			}
+			if _, err := os.Stat(s.snapshotPath(collection)); err != nil {
+				t.Fatalf("snapshot not written: %v", err)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JSONStore 每个集合一个 JSON 数组文件，即原来 static/*.json 的格式。
+// 写入走预写日志 + 临时文件 rename，崩溃后由 Recover 恢复。
+// 每次检查点把数据文件存一份快照到 snapshots 目录，快照加上之后的日志就是完整数据
+type JSONStore struct {
+	dir     string
+	mu      sync.Mutex
+	journal *journal
+}
+
+func NewJSONStore(dir string) *JSONStore {
+	return &JSONStore{
+		dir:     dir,
+		journal: &journal{path: filepath.Join(dir, "journal.log")},
+	}
+}
+
+func (s *JSONStore) path(collection string) string {
+	return filepath.Join(s.dir, collection+".json")
+}
+
+func (s *JSONStore) List(ctx context.Context, collection string) ([]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readAll(collection)
+}
+
+func (s *JSONStore) Put(ctx context.Context, collection string, id string, record json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply(journalEntry{
+		Op:         journalOpPut,
+		Collection: collection,
+		ID:         id,
+		Record:     record,
+		Time:       time.Now(),
+	})
+}
+
+func (s *JSONStore) Delete(ctx context.Context, collection string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.apply(journalEntry{
+		Op:         journalOpDelete,
+		Collection: collection,
+		ID:         id,
+		Time:       time.Now(),
+	})
+}
+
+// Version 以文件的修改时间和大小作为版本，外部直接改了文件也能感知到
+func (s *JSONStore) Version(ctx context.Context, collection string) (string, error) {
+	info, err := os.Stat(s.path(collection))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "missing", nil
+		}
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+func (s *JSONStore) Close() error {
+	return nil
+}
+
+// apply 先记日志再改文件；改文件失败时把日志回滚掉，避免重启后重放一个已向调用方报错的操作
+func (s *JSONStore) apply(entry journalEntry) error {
+	offset, err := s.journal.append(entry)
+	if err != nil {
+		return err
+	}
+	if err := s.replay(entry); err != nil {
+		if rbErr := s.journal.rollback(offset); rbErr != nil {
+			return fmt.Errorf("%v (journal rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	if s.journal.entries >= journalCheckpointEntries {
+		// 写入已经生效，检查点失败只是日志没清空，下次写入会再试，不能向调用方报告写入失败
+		if err := s.checkpoint(); err != nil {
+			log.Println("检查点失败:", err)
+		}
+	}
+	return nil
+}
+
+func (s *JSONStore) snapshotPath(collection string) string {
+	return filepath.Join(s.dir, "snapshots", collection+".json")
+}
+
+// checkpoint 先把各集合的数据文件存为快照，再清空日志。数据文件读不出来时不覆盖上一份快照，也不清空日志
+func (s *JSONStore) checkpoint() error {
+	collections := append([]string{}, Collections...)
+	if entries, err := s.journal.readAll(); err == nil {
+		for _, entry := range entries {
+			collections = append(collections, entry.Collection)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, "snapshots"), 0755); err != nil {
+		return err
+	}
+	done := make(map[string]struct{}, len(collections))
+	for _, collection := range collections {
+		if _, ok := done[collection]; ok {
+			continue
+		}
+		done[collection] = struct{}{}
+		data, err := os.ReadFile(s.path(collection))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if _, err := s.readAll(collection); err != nil {
+			return fmt.Errorf("cannot snapshot %s: %v", collection, err)
+		}
+		if err := WriteFileAtomic(s.snapshotPath(collection), data, 0644); err != nil {
+			return err
+		}
+	}
+	return s.journal.checkpoint()
+}
+
+// replay 把一条日志应用到数据文件，put/delete 都是幂等的，可以重复执行
+func (s *JSONStore) replay(entry journalEntry) error {
+	records, err := s.readAll(entry.Collection)
+	if err != nil {
+		return err
+	}
+
+	switch entry.Op {
+	case journalOpPut:
+		replaced := false
+		for i, raw := range records {
+			if existingID, _ := recordID(raw); existingID == entry.ID {
+				records[i] = entry.Record
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			records = append(records, entry.Record)
+		}
+	case journalOpDelete:
+		kept := make([]json.RawMessage, 0, len(records))
+		for _, raw := range records {
+			if existingID, _ := recordID(raw); existingID != entry.ID {
+				kept = append(kept, raw)
+			}
+		}
+		records = kept
+	default:
+		return fmt.Errorf("unknown journal op: %s", entry.Op)
+	}
+	return s.writeAll(entry.Collection, records)
+}
+
+// Recover 启动时调用：清理残留临时文件，损坏的数据文件隔离后从上次检查点的快照恢复，重放日志后再做检查点。
+// 没有可用的快照时拒绝启动，不能拿空集合继续跑
+func (s *JSONStore) Recover(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	if tmps, err := filepath.Glob(filepath.Join(s.dir, ".*.tmp-*")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	entries, err := s.journal.readAll()
+	if err != nil {
+		// 日志本身损坏时无法重放，隔离后从数据文件现状继续
+		if qErr := s.quarantine(s.journal.path); qErr != nil {
+			return qErr
+		}
+		entries = nil
+	}
+
+	collections := append([]string{}, Collections...)
+	for _, entry := range entries {
+		collections = append(collections, entry.Collection)
+	}
+	checked := make(map[string]struct{}, len(collections))
+	for _, collection := range collections {
+		if _, ok := checked[collection]; ok {
+			continue
+		}
+		checked[collection] = struct{}{}
+		if _, err := s.readAll(collection); err != nil {
+			if !isCorruptJSON(err) {
+				return err
+			}
+			if rErr := s.restoreSnapshot(collection, err); rErr != nil {
+				return rErr
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if err := s.replay(entry); err != nil {
+			return err
+		}
+	}
+	if len(entries) > 0 {
+		log.Printf("已从日志恢复 %d 条写操作", len(entries))
+	}
+	return s.checkpoint()
+}
+
+// restoreSnapshot 用快照替换损坏的数据文件，损坏的文件留在 quarantine 目录
+func (s *JSONStore) restoreSnapshot(collection string, cause error) error {
+	data, err := os.ReadFile(s.snapshotPath(collection))
+	if err == nil {
+		var records []json.RawMessage
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		return fmt.Errorf("data file %s is corrupt (%v) and no usable snapshot exists; restore it manually before starting", s.path(collection), cause)
+	}
+	if err := s.quarantine(s.path(collection)); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(s.path(collection), data, 0644); err != nil {
+		return err
+	}
+	log.Printf("数据文件 %s 已从快照恢复，之后的写操作由日志重放", s.path(collection))
+	return nil
+}
+
+// quarantine 把损坏的文件移到 quarantine 目录留档
+func (s *JSONStore) quarantine(path string) error {
+	dir := filepath.Join(s.dir, "quarantine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s.%s.corrupt", filepath.Base(path), time.Now().Format("20060102-150405"))
+	target := filepath.Join(dir, name)
+	if err := os.Rename(path, target); err != nil {
+		return err
+	}
+	log.Printf("检测到损坏的数据文件 %s，已隔离到 %s", path, target)
+	return nil
+}
+
+func isCorruptJSON(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *JSONStore) readAll(collection string) ([]json.RawMessage, error) {
+	data, err := os.ReadFile(s.path(collection))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []json.RawMessage{}, nil
+		}
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return []json.RawMessage{}, nil
+	}
+
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (s *JSONStore) writeAll(collection string, records []json.RawMessage) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(s.path(collection), data, 0644)
+}
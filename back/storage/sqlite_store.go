@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"sync"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore 内嵌 SQLite（纯 Go 驱动），单条记录读写，不再整文件重写
+type SQLiteStore struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func NewSQLiteStore(dsn string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 同一时刻只允许一个写者，单连接避免 database is locked
+	db.SetMaxOpenConns(1)
+
+	stmts := []string{
+		`PRAGMA journal_mode=WAL`,
+		`PRAGMA busy_timeout=5000`,
+		`CREATE TABLE IF NOT EXISTS records (
+			seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+			collection TEXT NOT NULL,
+			id         TEXT NOT NULL,
+			data       TEXT NOT NULL,
+			UNIQUE (collection, id)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLiteStore{db: db, versions: map[string]int64{}}, nil
+}
+
+func (s *SQLiteStore) List(ctx context.Context, collection string) ([]json.RawMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT data FROM records WHERE collection = ? ORDER BY seq`, collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []json.RawMessage{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		records = append(records, json.RawMessage(data))
+	}
+	return records, rows.Err()
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, collection string, id string, record json.RawMessage) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO records (collection, id, data) VALUES (?, ?, ?)
+		ON CONFLICT (collection, id) DO UPDATE SET data = excluded.data`,
+		collection, id, string(record))
+	if err != nil {
+		return err
+	}
+	s.bump(collection)
+	return nil
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, collection string, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM records WHERE collection = ? AND id = ?`, collection, id)
+	if err != nil {
+		return err
+	}
+	s.bump(collection)
+	return nil
+}
+
+// Version 进程内的写计数。数据库只由本进程写入，计数不变即数据未变
+func (s *SQLiteStore) Version(ctx context.Context, collection string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strconv.FormatInt(s.versions[collection], 10), nil
+}
+
+func (s *SQLiteStore) bump(collection string) {
+	s.mu.Lock()
+	s.versions[collection]++
+	s.mu.Unlock()
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
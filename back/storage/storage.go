@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 各业务集合的名称，JSON 后端下对应 static/<collection>.json
+const (
+	CollectionPatients      = "patients"
+	CollectionDiseases      = "diseases"
+	CollectionDoctors       = "doctors"
+	CollectionRegistrations = "registrations"
+	CollectionAccounts      = "accounts"
+	CollectionDepartments   = "departments"
+	CollectionRevokedTokens = "revoked_tokens"
+	CollectionIdempotency   = "idempotency_keys"
+)
+
+var Collections = []string{
+	CollectionPatients,
+	CollectionDiseases,
+	CollectionDoctors,
+	CollectionRegistrations,
+	CollectionAccounts,
+	CollectionDepartments,
+	CollectionRevokedTokens,
+	CollectionIdempotency,
+}
+
+// Store 持久化后端。记录以 JSON 形式保存，按集合 + ID 存取，List 按写入顺序返回
+type Store interface {
+	List(ctx context.Context, collection string) ([]json.RawMessage, error)
+	Put(ctx context.Context, collection string, id string, record json.RawMessage) error
+	Delete(ctx context.Context, collection string, id string) error
+	Close() error
+}
+
+// Recoverer 需要在启动时做崩溃恢复的后端实现该接口
+type Recoverer interface {
+	Recover(ctx context.Context) error
+}
+
+// Versioner 返回集合当前的版本标识，标识不变说明数据没有被改动，上层可以放心用缓存
+type Versioner interface {
+	Version(ctx context.Context, collection string) (string, error)
+}
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+type Config struct {
+	Driver string // json 或 sqlite
+	Dir    string // 数据目录，JSON 文件和默认的 sqlite 文件都放在这里
+	DSN    string // sqlite 数据库文件，为空时使用 <Dir>/hospital.db
+}
+
+// ConfigFromEnv 从环境变量 STORAGE_DRIVER / HOSPITAL_DATA_DIR / STORAGE_DSN 读取配置，
+// 默认沿用 static 目录下的 JSON 文件
+func ConfigFromEnv() Config {
+	cfg := Config{
+		Driver: strings.ToLower(strings.TrimSpace(os.Getenv("STORAGE_DRIVER"))),
+		Dir:    strings.TrimSpace(os.Getenv("HOSPITAL_DATA_DIR")),
+		DSN:    strings.TrimSpace(os.Getenv("STORAGE_DSN")),
+	}
+	if cfg.Driver == "" {
+		cfg.Driver = DriverJSON
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "static"
+	}
+	return cfg
+}
+
+func (c Config) dsn() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+	return filepath.Join(c.Dir, "hospital.db")
+}
+
+func Open(cfg Config) (Store, error) {
+	switch cfg.Driver {
+	case DriverJSON, "":
+		return NewJSONStore(cfg.Dir), nil
+	case DriverSQLite:
+		if err := os.MkdirAll(filepath.Dir(cfg.dsn()), 0755); err != nil {
+			return nil, err
+		}
+		return NewSQLiteStore(cfg.dsn())
+	default:
+		return nil, errors.New("unknown storage driver: " + cfg.Driver)
+	}
+}
+
+// LoadAll 读取整个集合并解码为具体类型
+func LoadAll[T any](ctx context.Context, s Store, collection string) ([]T, error) {
+	raws, err := s.List(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]T, 0, len(raws))
+	for _, raw := range raws {
+		var item T
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Save 写入（新增或覆盖）单条记录
+func Save(ctx context.Context, s Store, collection string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, collection, id, data)
+}
+
+// Copy 把 src 中的集合整体复制到 dst，用于从 JSON 文件迁移到数据库
+func Copy(ctx context.Context, src Store, dst Store, collection string) (int, error) {
+	raws, err := src.List(ctx, collection)
+	if err != nil {
+		return 0, err
+	}
+	for _, raw := range raws {
+		id, err := recordID(raw)
+		if err != nil {
+			return 0, err
+		}
+		if err := dst.Put(ctx, collection, id, raw); err != nil {
+			return 0, err
+		}
+	}
+	return len(raws), nil
+}
+
+func recordID(raw json.RawMessage) (string, error) {
+	var v struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	if v.ID == "" {
+		return "", errors.New("record id cannot be empty")
+	}
+	return v.ID, nil
+}
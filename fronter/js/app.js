@@ -13,6 +13,7 @@ document.addEventListener('DOMContentLoaded', async function() {
 const API_BASE_URL = '/api';
 const ID_CARD_REGEX = /^[1-9]\d{5}(18|19|([23]\d))\d{2}((0[1-9])|(10|11|12))(([0-2][1-9])|10|20|30|31)\d{3}[0-9xX]$/;
 const AUTH_TOKEN_STORAGE_KEY = 'hospital-auth-token';
+const REFRESH_TOKEN_STORAGE_KEY = 'hospital-refresh-token';
 
 let currentPatients = [];
 let currentDiseases = [];
@@ -29,6 +30,8 @@ let editingPatientId = null;
 let editingDiseaseId = null;
 let editingDoctorId = null;
 let editingRegistrationId = null;
+// 新建挂号的幂等键：网络出错重试时沿用同一个，服务器会返回第一次的结果而不是再挂一个号
+let pendingRegistrationKey = null;
 let editingDepartmentId = null;
 
 let registrationsChartInstance = null;
@@ -58,10 +61,23 @@ function initAuthBindings() {
     const loginForm = document.getElementById('login-form');
     loginForm?.addEventListener('submit', async function(event) {
         event.preventDefault();
-        await handleLoginSubmit();
+        await handleLoginSubmit('login');
     });
 
-    document.getElementById('logout-btn')?.addEventListener('click', function() {
+    document.getElementById('register-submit')?.addEventListener('click', async function() {
+        await handleLoginSubmit('register');
+    });
+
+    document.getElementById('setup-submit')?.addEventListener('click', async function() {
+        await handleLoginSubmit('setup');
+    });
+
+    document.getElementById('mfa-btn')?.addEventListener('click', async function() {
+        await toggleMfa();
+    });
+
+    document.getElementById('logout-btn')?.addEventListener('click', async function() {
+        await revokeSession();
         logout();
     });
 }
@@ -81,13 +97,18 @@ async function initSession() {
     }
 
     currentSession.me = me;
+    if (me.mustChangePassword && !(await forcePasswordChange(''))) {
+        logout();
+        return;
+    }
     setAuthenticatedUI();
 }
 
-async function handleLoginSubmit() {
+// mode 为 login、register 或 setup（用初始化令牌创建第一个管理员），三者返回的令牌格式相同
+async function handleLoginSubmit(mode = 'login') {
     const usernameInput = document.getElementById('login-username');
     const passwordInput = document.getElementById('login-password');
-    const submitBtn = document.getElementById('login-submit');
+    const submitBtn = document.getElementById(mode === 'login' ? 'login-submit' : `${mode}-submit`);
     const errorBox = document.getElementById('login-error');
 
     const username = (usernameInput?.value ?? '').trim();
@@ -99,23 +120,41 @@ async function handleLoginSubmit() {
         return;
     }
 
+    let setupToken = '';
+    if (mode === 'setup') {
+        setupToken = (window.prompt('请输入服务器启动日志中的初始化令牌') || '').trim();
+        if (!setupToken) return;
+    }
+
     if (submitBtn) submitBtn.disabled = true;
     try {
-        const response = await fetch(`${API_BASE_URL}/auth/login`, {
+        const response = await fetch(`${API_BASE_URL}/auth/${mode}`, {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json'
             },
-            body: JSON.stringify({ username, password })
+            body: JSON.stringify(mode === 'setup' ? { setupToken, username, password } : { username, password })
         });
 
-        const data = await safeParseJson(response);
+        let data = await safeParseJson(response);
         if (!response.ok) {
-            const message = data?.error || '登录失败';
+            const message = data?.error || (mode === 'register' ? '注册失败' : '登录失败');
             if (errorBox) errorBox.textContent = message;
             return;
         }
 
+        // 管理员必须开启两步验证时，初始化只返回绑定码，再用它登录完成绑定
+        if (mode === 'setup' && data?.mfaEnrollmentRequired) {
+            alert(`管理员已创建，该账号必须开启两步验证。\n请保存绑定码（24 小时内有效），然后点击登录完成绑定：\n\n${data.enrollmentCode}`);
+            return;
+        }
+
+        // 启用了两步验证的账号，密码通过后还要输入验证码
+        if (data?.mfaRequired) {
+            data = await completeMfaLogin(data, errorBox);
+            if (!data) return;
+        }
+
         const token = data?.token;
         if (!token) {
             if (errorBox) errorBox.textContent = '登录失败';
@@ -123,6 +162,7 @@ async function handleLoginSubmit() {
         }
 
         setAuthToken(token);
+        setRefreshToken(data?.refreshToken || '');
         currentSession.token = token;
         const me = await fetchMe();
         if (!me) {
@@ -132,6 +172,11 @@ async function handleLoginSubmit() {
         }
 
         currentSession.me = me;
+        if (me.mustChangePassword && !(await forcePasswordChange(password))) {
+            if (errorBox) errorBox.textContent = '请先修改初始密码';
+            logout();
+            return;
+        }
         setAuthenticatedUI();
         const defaultPage = getDefaultPageForRole(getCurrentRole());
         window.location.hash = `#${defaultPage}`;
@@ -144,13 +189,179 @@ async function handleLoginSubmit() {
     }
 }
 
-async function fetchMe() {
-    try {
-        const response = await fetch(`${API_BASE_URL}/auth/me`, {
-            method: 'GET',
+// 初始密码或被管理员重置的密码，改掉之前不能使用系统。oldPassword 为空时让用户输入
+async function forcePasswordChange(oldPassword) {
+    if (!oldPassword) {
+        oldPassword = (window.prompt('当前密码需要修改，请输入当前密码') || '').trim();
+        if (!oldPassword) return false;
+    }
+    for (;;) {
+        const newPassword = (window.prompt('首次登录或密码已被重置，请设置新密码（8 位以上，同时包含字母和数字）') || '').trim();
+        if (!newPassword) return false;
+        if ((window.prompt('请再次输入新密码') || '').trim() !== newPassword) {
+            alert('两次输入的密码不一致');
+            continue;
+        }
+
+        const response = await apiFetch(`${API_BASE_URL}/auth/changePassword`, {
+            method: 'POST',
             headers: {
-                'Authorization': `Bearer ${currentSession.token}`
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ oldPassword, newPassword })
+        });
+        const data = await safeParseJson(response);
+        if (!response.ok) {
+            alert(data?.error || '修改密码失败');
+            if (response.status === 401) return false;
+            continue;
+        }
+
+        setAuthToken(data.token);
+        setRefreshToken(data.refreshToken || '');
+        currentSession.token = data.token;
+        const me = await fetchMe();
+        if (!me) return false;
+        currentSession.me = me;
+        alert('密码已修改');
+        return true;
+    }
+}
+
+// 还没有管理员时显示"初始化管理员"按钮
+async function refreshSetupStatus() {
+    const setupBtn = document.getElementById('setup-submit');
+    if (!setupBtn) return;
+    try {
+        const response = await fetch(`${API_BASE_URL}/auth/setup`);
+        const data = await safeParseJson(response);
+        setupBtn.style.display = response.ok && data?.setupRequired ? '' : 'none';
+    } catch {
+        setupBtn.style.display = 'none';
+    }
+}
+
+// 登录第二步：未绑定的账号先绑定验证器 App，已绑定的输入验证码或恢复码
+async function completeMfaLogin(challenge, errorBox) {
+    const mfaToken = challenge.mfaToken;
+    let url = `${API_BASE_URL}/auth/login/mfa`;
+    let promptText = '请输入验证器 App 上的 6 位验证码（也可以输入恢复码）';
+
+    let enrollmentCode = '';
+    if (challenge.mfaEnrollmentRequired) {
+        enrollmentCode = (window.prompt('该账号必须开启两步验证，请输入管理员提供的绑定码') || '').trim();
+        if (!enrollmentCode) {
+            if (errorBox) errorBox.textContent = '请输入绑定码';
+            return null;
+        }
+        const enrollResponse = await fetch(`${API_BASE_URL}/auth/login/mfa/enroll`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ mfaToken, enrollmentCode })
+        });
+        const enrollment = await safeParseJson(enrollResponse);
+        if (!enrollResponse.ok || !enrollment?.secret) {
+            if (errorBox) errorBox.textContent = enrollment?.error || '两步验证绑定失败';
+            return null;
+        }
+        url = `${API_BASE_URL}/auth/login/mfa/activate`;
+        promptText = `该账号必须开启两步验证。\n请在验证器 App 中添加账号（或扫描 ${enrollment.provisioningUri} 生成的二维码）：\n密钥：${enrollment.secret}\n\n然后输入 App 上显示的 6 位验证码`;
+    }
+
+    const code = (window.prompt(promptText) || '').trim();
+    if (!code) {
+        if (errorBox) errorBox.textContent = '请输入验证码';
+        return null;
+    }
+
+    const response = await fetch(url, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ mfaToken, code, enrollmentCode })
+    });
+    const data = await safeParseJson(response);
+    if (!response.ok) {
+        if (errorBox) errorBox.textContent = data?.error === 'invalid mfa code' ? '验证码错误' : (data?.error || '验证失败');
+        return null;
+    }
+    showRecoveryCodes(data?.recoveryCodes);
+    return data;
+}
+
+function showRecoveryCodes(codes) {
+    if (!Array.isArray(codes) || !codes.length) return;
+    alert(`请妥善保存以下恢复码，每个只能使用一次，手机丢失时可用来登录：\n\n${codes.join('\n')}`);
+}
+
+// 已登录用户开启或关闭两步验证
+async function toggleMfa() {
+    const me = currentSession.me;
+    if (!me) return;
+
+    try {
+        if (me.mfaEnabled) {
+            if (me.mfaRequired) {
+                alert('当前角色必须开启两步验证，不能关闭');
+                return;
+            }
+            const code = (window.prompt('输入验证器 App 上的 6 位验证码以关闭两步验证') || '').trim();
+            if (!code) return;
+            const response = await apiFetch(`${API_BASE_URL}/auth/mfa/disable`, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ code })
+            });
+            const data = await safeParseJson(response);
+            if (!response.ok) {
+                alert(data?.error === 'invalid mfa code' ? '验证码错误' : (data?.error || '关闭失败'));
+                return;
+            }
+            alert('已关闭两步验证');
+        } else {
+            const enrollResponse = await apiFetch(`${API_BASE_URL}/auth/mfa/enroll`, { method: 'POST' });
+            const enrollment = await safeParseJson(enrollResponse);
+            if (!enrollResponse.ok || !enrollment?.secret) {
+                alert(enrollment?.error || '开启失败');
+                return;
+            }
+            const code = (window.prompt(`请在验证器 App 中添加账号（或扫描 ${enrollment.provisioningUri} 生成的二维码）：\n密钥：${enrollment.secret}\n\n然后输入 App 上显示的 6 位验证码`) || '').trim();
+            if (!code) return;
+            const response = await apiFetch(`${API_BASE_URL}/auth/mfa/activate`, {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ code })
+            });
+            const data = await safeParseJson(response);
+            if (!response.ok) {
+                alert(data?.error === 'invalid mfa code' ? '验证码错误' : (data?.error || '开启失败'));
+                return;
             }
+            // 开启后旧令牌失效，换成响应里的新令牌
+            setAuthToken(data.token);
+            setRefreshToken(data.refreshToken || '');
+            currentSession.token = data.token;
+            showRecoveryCodes(data.recoveryCodes);
+        }
+
+        const refreshed = await fetchMe();
+        if (refreshed) {
+            currentSession.me = refreshed;
+            setAuthenticatedUI();
+        }
+    } catch (error) {
+        console.error('两步验证设置失败:', error);
+        alert('操作失败，请重试！');
+    }
+}
+
+async function fetchMe() {
+    try {
+        const response = await apiFetch(`${API_BASE_URL}/auth/me`, {
+            method: 'GET'
         });
         const data = await safeParseJson(response);
         if (!response.ok) return null;
@@ -175,6 +386,11 @@ function setAuthenticatedUI() {
     applyRoleUI();
     const logoutBtn = document.getElementById('logout-btn');
     if (logoutBtn) logoutBtn.style.display = 'inline-flex';
+    const mfaBtn = document.getElementById('mfa-btn');
+    if (mfaBtn) {
+        mfaBtn.style.display = 'inline-flex';
+        mfaBtn.title = currentSession.me?.mfaEnabled ? '关闭两步验证' : '开启两步验证';
+    }
 }
 
 function setUnauthenticatedUI() {
@@ -185,6 +401,9 @@ function setUnauthenticatedUI() {
     if (roleEl) roleEl.textContent = '请先登录';
     const logoutBtn = document.getElementById('logout-btn');
     if (logoutBtn) logoutBtn.style.display = 'none';
+    const mfaBtn = document.getElementById('mfa-btn');
+    if (mfaBtn) mfaBtn.style.display = 'none';
+    refreshSetupStatus();
 }
 
 function updateUserProfileUI() {
@@ -203,11 +422,11 @@ function applyRoleUI() {
         item.style.display = allowedPages.includes(page) ? '' : 'none';
     });
 
-    setElementVisible('add-patient-btn', role === 'admin');
-    setElementVisible('add-disease-btn', role === 'admin' || role === 'doctor');
-    setElementVisible('add-department-btn', role === 'admin');
-    setElementVisible('add-doctor-btn', role === 'admin');
-    setElementVisible('add-registration-btn', role === 'admin' || role === 'patient');
+    setElementVisible('add-patient-btn', hasPermission('patient:create'));
+    setElementVisible('add-disease-btn', hasPermission('disease:create'));
+    setElementVisible('add-department-btn', hasPermission('department:create'));
+    setElementVisible('add-doctor-btn', hasPermission('doctor:create'));
+    setElementVisible('add-registration-btn', hasPermission('registration:create'));
 }
 
 function setElementVisible(id, isVisible) {
@@ -217,6 +436,9 @@ function setElementVisible(id, isVisible) {
 }
 
 function roleLabel(role) {
+    if (currentSession.me?.role === role && currentSession.me?.roleLabel) {
+        return currentSession.me.roleLabel;
+    }
     switch (role) {
         case 'admin':
             return '管理员';
@@ -233,12 +455,27 @@ function getCurrentRole() {
     return currentSession.me?.role || null;
 }
 
+// 当前账号是否拥有某个权限（含只对自己数据生效的 :own 权限），权限列表来自 /auth/me
+function hasPermission(perm) {
+    const grants = currentSession.me?.permissions || [];
+    const resource = perm.split(':')[0];
+    return grants.some(grant => {
+        const name = grant.endsWith(':own') ? grant.slice(0, -4) : grant;
+        return name === '*' || name === perm || name === `${resource}:*`;
+    });
+}
+
 function getAllowedPagesForRole(role) {
+    if (currentSession.me?.role === role && Array.isArray(currentSession.me?.pages)) {
+        return currentSession.me.pages;
+    }
     switch (role) {
         case 'admin':
             return ['dashboard', 'patients', 'diseases', 'departments', 'doctors', 'registrations', 'reports'];
         case 'doctor':
             return ['diseases', 'registrations'];
+        case 'receptionist':
+            return ['patients', 'registrations'];
         case 'patient':
             return ['registrations'];
         default:
@@ -252,32 +489,61 @@ function getDefaultPageForRole(role) {
 }
 
 function canManagePatients() {
-    return getCurrentRole() === 'admin';
+    return hasPermission('patient:update');
+}
+
+function canDeletePatient() {
+    return hasPermission('patient:delete');
 }
 
 function canManageDiseases() {
-    const role = getCurrentRole();
-    return role === 'admin' || role === 'doctor';
+    return hasPermission('disease:update');
 }
 
 function canManageDoctors() {
-    return getCurrentRole() === 'admin';
+    return hasPermission('doctor:update');
 }
 
 function canCreateRegistration() {
-    const role = getCurrentRole();
-    return role === 'admin' || role === 'patient';
+    return hasPermission('registration:create');
 }
 
 function canEditRegistration() {
-    const role = getCurrentRole();
-    return role === 'admin' || role === 'doctor';
+    return hasPermission('registration:update') || hasPermission('registration:update-status');
 }
 
 function canDeleteRegistration() {
-    return getCurrentRole() === 'admin';
+    return hasPermission('registration:delete');
+}
+
+function canCheckInRegistration() {
+    return hasPermission('registration:check-in');
+}
+
+function canMarkRegistrationNoShow() {
+    return hasPermission('registration:no-show');
+}
+
+function canCancelRegistration() {
+    return hasPermission('registration:cancel') || canEditRegistration();
 }
 
+function canConsultRegistration() {
+    return canEditRegistration();
+}
+
+// 挂号状态，顺序同后端状态机
+const REGISTRATION_STATUS_TEXT = {
+    'pending': '待处理',
+    'confirmed': '已确认',
+    'rescheduled': '已改期',
+    'checked_in': '已签到',
+    'in_consultation': '就诊中',
+    'completed': '已完成',
+    'cancelled': '已取消',
+    'no_show': '爽约'
+};
+
 function safeParseJson(response) {
     return response
         .json()
@@ -294,14 +560,79 @@ function setAuthToken(token) {
 
 function clearAuthToken() {
     localStorage.removeItem(AUTH_TOKEN_STORAGE_KEY);
+    localStorage.removeItem(REFRESH_TOKEN_STORAGE_KEY);
+}
+
+function getRefreshToken() {
+    return localStorage.getItem(REFRESH_TOKEN_STORAGE_KEY) || '';
+}
+
+function setRefreshToken(token) {
+    if (token) {
+        localStorage.setItem(REFRESH_TOKEN_STORAGE_KEY, token);
+    } else {
+        localStorage.removeItem(REFRESH_TOKEN_STORAGE_KEY);
+    }
+}
+
+let refreshInFlight = null;
+
+// 访问令牌过期后用刷新令牌换新令牌，并发请求共用同一次刷新
+function refreshSession() {
+    if (refreshInFlight) return refreshInFlight;
+    const refreshToken = getRefreshToken();
+    if (!refreshToken) return Promise.resolve(false);
+
+    refreshInFlight = fetch(`${API_BASE_URL}/auth/refresh`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ refreshToken })
+    })
+        .then(async response => {
+            const data = await safeParseJson(response);
+            if (!response.ok || !data?.token) return false;
+            setAuthToken(data.token);
+            setRefreshToken(data.refreshToken || '');
+            currentSession.token = data.token;
+            return true;
+        })
+        .catch(() => false)
+        .finally(() => {
+            refreshInFlight = null;
+        });
+    return refreshInFlight;
+}
+
+async function revokeSession() {
+    if (!currentSession.token) return;
+    try {
+        await apiFetch(`${API_BASE_URL}/auth/logout`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ refreshToken: getRefreshToken() })
+        });
+    } catch {
+        // 服务端吊销失败也照常清掉本地令牌
+    }
 }
 
-function apiFetch(url, options = {}) {
-    const headers = new Headers(options.headers || {});
-    if (currentSession.token) {
-        headers.set('Authorization', `Bearer ${currentSession.token}`);
+async function apiFetch(url, options = {}) {
+    const send = () => {
+        const headers = new Headers(options.headers || {});
+        if (currentSession.token) {
+            headers.set('Authorization', `Bearer ${currentSession.token}`);
+        }
+        return fetch(url, { ...options, headers });
+    };
+
+    const response = await send();
+    if (response.status !== 401 || !getRefreshToken()) {
+        return response;
+    }
+    if (!(await refreshSession())) {
+        return response;
     }
-    return fetch(url, { ...options, headers });
+    return send();
 }
 
 // 设置当前日期
@@ -421,18 +752,14 @@ async function loadDashboardStats() {
             fetchDiseaseCount()
         ]);
 
-        const patients = indexInfo.patients;
-        const doctors = indexInfo.doctors;
-        const registrations = indexInfo.registrations;
+        const { patients, doctors, registrations } = indexInfo;
 
         const now = new Date();
 
-        document.getElementById('patient-count').textContent = patients.length.toLocaleString('zh-CN');
-        document.getElementById('doctor-count').textContent = doctors.length.toLocaleString('zh-CN');
+        document.getElementById('patient-count').textContent = indexInfo.patientCount.toLocaleString('zh-CN');
+        document.getElementById('doctor-count').textContent = indexInfo.doctorCount.toLocaleString('zh-CN');
         document.getElementById('disease-count').textContent = diseaseCount.toLocaleString('zh-CN');
-
-        const todaysRegistrations = registrations.filter((r) => isSameLocalDay(getRegistrationCreatedAt(r), now));
-        document.getElementById('registration-count').textContent = todaysRegistrations.length.toLocaleString('zh-CN');
+        document.getElementById('registration-count').textContent = indexInfo.todayRegistrations.toLocaleString('zh-CN');
 
         const statusCounts = {
             pending: 0,
@@ -440,11 +767,8 @@ async function loadDashboardStats() {
             completed: 0,
             cancelled: 0
         };
-        todaysRegistrations.forEach((r) => {
-            const k = r?.status;
-            if (k && Object.prototype.hasOwnProperty.call(statusCounts, k)) {
-                statusCounts[k] += 1;
-            }
+        Object.keys(statusCounts).forEach((k) => {
+            statusCounts[k] = Number(indexInfo.todayStatusCounts[k]) || 0;
         });
         updateDashboardSummary(statusCounts);
 
@@ -470,6 +794,10 @@ async function fetchIndexInfo() {
     const data = await response.json();
     const info = Array.isArray(data) ? (data[0] || {}) : (data || {});
     return {
+        patientCount: Number(info.patientCount) || 0,
+        doctorCount: Number(info.doctorCount) || 0,
+        todayRegistrations: Number(info.todayRegistrations) || 0,
+        todayStatusCounts: info.todayStatusCounts || {},
         patients: Array.isArray(info.patients) ? info.patients : [],
         doctors: Array.isArray(info.doctors) ? info.doctors : [],
         registrations: Array.isArray(info.registrations) ? info.registrations : []
@@ -478,10 +806,10 @@ async function fetchIndexInfo() {
 
 async function fetchDiseaseCount() {
     try {
-        const response = await apiFetch(`${API_BASE_URL}/diseases/getDiseases`, { method: 'GET' });
+        const response = await apiFetch(`${API_BASE_URL}/diseases/getDiseases?pageSize=1`, { method: 'GET' });
         if (!response.ok) return 0;
-        const diseases = await response.json();
-        return Array.isArray(diseases) ? diseases.length : 0;
+        const page = await response.json();
+        return Number(page?.total) || 0;
     } catch {
         return 0;
     }
@@ -876,12 +1204,17 @@ async function updatePatient(id) {
     try {
         const response = await apiFetch(`${API_BASE_URL}/patients/updatePatient?id=${encodeURIComponent(id)}`, {
             method: 'PUT',
-            headers: {
+            headers: withIfMatch({
                 'Content-Type': 'application/json'
-            },
+            }, currentPatients.find(p => p.id === id)),
             body: JSON.stringify(patient)
         });
 
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadPatients();
+            return;
+        }
         if (!response.ok) {
             throw new Error(await getResponseErrorMessage(response, '保存失败'));
         }
@@ -967,14 +1300,21 @@ async function saveDisease() {
             ? `${API_BASE_URL}/diseases/updateDisease?id=${encodeURIComponent(editingDiseaseId)}`
             : `${API_BASE_URL}/diseases/createDisease`;
 
+        const headers = { 'Content-Type': 'application/json' };
+        if (isEdit) {
+            withIfMatch(headers, currentDiseases.find(d => d.id === editingDiseaseId));
+        }
         const response = await apiFetch(url, {
             method: isEdit ? 'PUT' : 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
+            headers,
             body: JSON.stringify(disease)
         });
 
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadDiseases();
+            return;
+        }
         if (!response.ok) {
             const errorText = await response.text();
             throw new Error(errorText || '保存失败');
@@ -1043,9 +1383,11 @@ function renderPatientsTable(patients) {
                     <button class="btn-action btn-edit" onclick="editPatient('${patient.id}')">
                         <i class="fas fa-edit"></i> 编辑
                     </button>
+                    ${canDeletePatient() ? `
                     <button class="btn-action btn-delete" onclick="deletePatient('${patient.id}')">
                         <i class="fas fa-trash"></i> 删除
                     </button>
+                    ` : ''}
             `
             : '<span style="color: #94a3b8;">无权限</span>';
 
@@ -1161,7 +1503,7 @@ function editPatient(id) {
 
 // 删除病人
 async function deletePatient(id) {
-    if (!canManagePatients()) {
+    if (!canDeletePatient()) {
         alert('无权限');
         return;
     }
@@ -1416,11 +1758,20 @@ async function saveDepartment() {
         const url = isEdit
             ? `${API_BASE_URL}/departments/updateDepartment?id=${encodeURIComponent(editingDepartmentId)}`
             : `${API_BASE_URL}/departments/createDepartment`;
+        const headers = { 'Content-Type': 'application/json' };
+        if (isEdit) {
+            withIfMatch(headers, currentDepartments.find(d => d.id === editingDepartmentId));
+        }
         const response = await apiFetch(url, {
             method: isEdit ? 'PUT' : 'POST',
-            headers: { 'Content-Type': 'application/json' },
+            headers,
             body: JSON.stringify(payload)
         });
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadDepartments();
+            return;
+        }
         if (!response.ok) {
             const errorText = await response.text();
             throw new Error(errorText || '保存失败');
@@ -1968,14 +2319,21 @@ async function saveDoctor() {
             ? `${API_BASE_URL}/doctors/updateDoctor?id=${encodeURIComponent(editingDoctorId)}`
             : `${API_BASE_URL}/doctors/createDoctor`;
 
+        const headers = { 'Content-Type': 'application/json' };
+        if (isEdit) {
+            withIfMatch(headers, currentDoctors.find(d => d.id === editingDoctorId));
+        }
         const response = await apiFetch(url, {
             method: isEdit ? 'PUT' : 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
+            headers,
             body: JSON.stringify(doctor)
         });
 
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadDoctors();
+            return;
+        }
         if (!response.ok) {
             const errorText = await response.text();
             throw new Error(errorText || '保存失败');
@@ -1993,8 +2351,7 @@ async function saveDoctor() {
 // 加载挂号数据
 async function loadRegistrations() {
     try {
-        const role = getCurrentRole();
-        if (role === 'admin' || role === 'doctor') {
+        if (hasPermission('patient:read')) {
             if (!currentPatients.length) {
                 await loadPatients();
             }
@@ -2065,7 +2422,7 @@ function renderRegistrationsTable(registrations) {
     }
 
     const patientNames = Object.fromEntries(currentPatients.map(p => [p.id, p.name]));
-    if (getCurrentRole() === 'patient') {
+    if (currentSession.me?.linkedEntity === 'patient') {
         const linkedId = currentSession.me?.linkedId;
         if (linkedId) {
             patientNames[linkedId] = '本人';
@@ -2076,12 +2433,7 @@ function renderRegistrationsTable(registrations) {
     let html = '';
 
     registrations.forEach(registration => {
-        const statusText = {
-            'pending': '待处理',
-            'confirmed': '已确认',
-            'completed': '已完成',
-            'cancelled': '已取消'
-        }[registration.status] || registration.status;
+        const statusText = REGISTRATION_STATUS_TEXT[registration.status] || registration.status;
 
         const statusClass = `status-${registration.status}`;
 
@@ -2095,8 +2447,33 @@ function renderRegistrationsTable(registrations) {
 
         const canEdit = canEditRegistration();
         const canDelete = canDeleteRegistration();
-        const actionsHtml = (canEdit || canDelete)
+        const awaitingArrival = ['pending', 'confirmed', 'rescheduled'].includes(registration.status);
+        const canCheckIn = canCheckInRegistration() && awaitingArrival;
+        const canNoShow = canMarkRegistrationNoShow() && awaitingArrival;
+        const canConsult = canConsultRegistration() && registration.status === 'checked_in';
+        const canCancel = canCancelRegistration() && awaitingArrival;
+        const actionsHtml = (canEdit || canDelete || canCheckIn || canNoShow || canConsult || canCancel)
             ? `
+                    ${canConsult ? `
+                    <button class="btn-action btn-edit" onclick="startRegistrationConsultation('${registration.id}')">
+                        <i class="fas fa-stethoscope"></i> 接诊
+                    </button>
+                    ` : ''}
+                    ${canCancel ? `
+                    <button class="btn-action btn-delete" onclick="cancelRegistration('${registration.id}')">
+                        <i class="fas fa-ban"></i> 取消
+                    </button>
+                    ` : ''}
+                    ${canCheckIn ? `
+                    <button class="btn-action btn-edit" onclick="checkInRegistration('${registration.id}')">
+                        <i class="fas fa-user-check"></i> 签到
+                    </button>
+                    ` : ''}
+                    ${canNoShow ? `
+                    <button class="btn-action btn-delete" onclick="markRegistrationNoShow('${registration.id}')">
+                        <i class="fas fa-user-times"></i> 爽约
+                    </button>
+                    ` : ''}
                     ${canEdit ? `
                     <button class="btn-action btn-edit" onclick="editRegistration('${registration.id}')">
                         <i class="fas fa-edit"></i> 编辑
@@ -2144,6 +2521,87 @@ function editRegistration(id) {
     openRegistrationModal(registration);
 }
 
+// 前台签到，只能在就诊当天操作
+async function checkInRegistration(id) {
+    if (!canCheckInRegistration()) {
+        alert('无权限');
+        return;
+    }
+    await changeRegistrationStatus(id, 'checked_in', '签到');
+}
+
+// 前台标记爽约
+async function markRegistrationNoShow(id) {
+    if (!canMarkRegistrationNoShow()) {
+        alert('无权限');
+        return;
+    }
+    if (!confirm('确定将该挂号标记为爽约吗？')) {
+        return;
+    }
+    await changeRegistrationStatus(id, 'no_show', '标记爽约');
+}
+
+// 医生开始接诊已签到的病人
+async function startRegistrationConsultation(id) {
+    if (!canConsultRegistration()) {
+        alert('无权限');
+        return;
+    }
+    await changeRegistrationStatus(id, 'in_consultation', '接诊');
+}
+
+// 取消挂号必须填写原因
+async function cancelRegistration(id) {
+    if (!canCancelRegistration()) {
+        alert('无权限');
+        return;
+    }
+    const reason = promptCancelReason();
+    if (reason === null) {
+        return;
+    }
+    await changeRegistrationStatus(id, 'cancelled', '取消挂号', reason);
+}
+
+function promptCancelReason() {
+    const reason = prompt('请填写取消原因：');
+    if (reason === null) {
+        return null;
+    }
+    if (!reason.trim()) {
+        alert('取消挂号必须填写原因');
+        return null;
+    }
+    return reason.trim();
+}
+
+async function changeRegistrationStatus(id, status, actionText, reason = '') {
+    try {
+        const response = await apiFetch(`${API_BASE_URL}/registrations/changeStatus?id=${encodeURIComponent(id)}`, {
+            method: 'POST',
+            headers: withIfMatch({ 'Content-Type': 'application/json' }, currentRegistrations.find(r => r.id === id)),
+            body: JSON.stringify({ status, reason })
+        });
+
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadRegistrations();
+            return;
+        }
+        if (!response.ok) {
+            const data = await safeParseJson(response);
+            alert(describeRegistrationConflict(data) || `${actionText}失败`);
+            return;
+        }
+
+        await loadRegistrations();
+    } catch (error) {
+        console.error(`${actionText}失败:`, error);
+        alert(`${actionText}失败，请重试！`);
+    }
+}
+
 // 删除挂号
 async function deleteRegistration(id) {
     if (!canDeleteRegistration()) {
@@ -2308,6 +2766,8 @@ function openMyPatientProfileModal() {
 }
 
 async function openRegistrationModal(registration) {
+    // 重新打开表单就是一次新的挂号，不能沿用上一次没成功的幂等键
+    pendingRegistrationKey = null;
     const role = getCurrentRole();
     if (role === 'admin' || role === 'doctor') {
         if (!currentPatients.length) {
@@ -2356,10 +2816,9 @@ async function openRegistrationModal(registration) {
                             <div class="form-group">
                                 <label for="registration-status">状态</label>
                                 <select id="registration-status">
-                                    <option value="pending" ${registration?.status === 'pending' ? 'selected' : ''}>待处理</option>
-                                    <option value="confirmed" ${registration?.status === 'confirmed' ? 'selected' : ''}>已确认</option>
-                                    <option value="completed" ${registration?.status === 'completed' ? 'selected' : ''}>已完成</option>
-                                    <option value="cancelled" ${registration?.status === 'cancelled' ? 'selected' : ''}>已取消</option>
+                                    ${Object.entries(REGISTRATION_STATUS_TEXT)
+                                        .map(([value, text]) => `<option value="${value}" ${registration?.status === value ? 'selected' : ''}>${text}</option>`)
+                                        .join('')}
                                 </select>
                             </div>
                         </div>
@@ -2550,6 +3009,14 @@ async function saveRegistration() {
         symptoms,
         notes
     };
+    const original = isEditOperation ? currentRegistrations.find(r => r.id === editingRegistrationId) : null;
+    if (original && payload.status === 'cancelled' && original.status !== 'cancelled') {
+        const reason = promptCancelReason();
+        if (reason === null) {
+            return;
+        }
+        payload.cancelReason = reason;
+    }
 
     try {
         const isEdit = !!editingRegistrationId;
@@ -2557,14 +3024,32 @@ async function saveRegistration() {
             ? `${API_BASE_URL}/registrations/updateRegistration?id=${encodeURIComponent(editingRegistrationId)}`
             : `${API_BASE_URL}/registrations/createRegistration`;
 
+        const headers = { 'Content-Type': 'application/json' };
+        if (!isEdit) {
+            pendingRegistrationKey = pendingRegistrationKey || newIdempotencyKey();
+            headers['Idempotency-Key'] = pendingRegistrationKey;
+        } else {
+            withIfMatch(headers, currentRegistrations.find(r => r.id === editingRegistrationId));
+        }
+
         const response = await apiFetch(url, {
             method: isEdit ? 'PUT' : 'POST',
-            headers: {
-                'Content-Type': 'application/json'
-            },
+            headers,
             body: JSON.stringify(payload)
         });
+        // 拿到了服务器的答复就不再需要重试，下次提交用新的键
+        pendingRegistrationKey = null;
 
+        if (response.status === 409 || response.status === 403 || response.status === 400) {
+            const conflict = await response.json().catch(() => ({}));
+            alert(describeRegistrationConflict(conflict));
+            return;
+        }
+        if (response.status === 412) {
+            alert(STALE_RECORD_MESSAGE);
+            await loadRegistrations();
+            return;
+        }
         if (!response.ok) {
             const errorText = await response.text();
             throw new Error(errorText || '保存失败');
@@ -2579,6 +3064,58 @@ async function saveRegistration() {
     }
 }
 
+const STALE_RECORD_MESSAGE = '该记录已被其他人修改，已重新加载，请确认后再保存';
+
+// 修改时带上加载时的版本号，记录在这之后被别人改过服务器会返回 412
+function withIfMatch(headers, item) {
+    if (item && item.version !== undefined && item.version !== null) {
+        headers['If-Match'] = `"${item.version}"`;
+    }
+    return headers;
+}
+
+function newIdempotencyKey() {
+    if (window.crypto && typeof window.crypto.randomUUID === 'function') {
+        return window.crypto.randomUUID();
+    }
+    return `${Date.now().toString(36)}-${Math.random().toString(36).slice(2)}${Math.random().toString(36).slice(2)}`;
+}
+
+// 说明挂号保存失败的原因：和哪条挂号冲突、医生号源已满，或者状态不能这样改
+function describeRegistrationConflict(conflict) {
+    const c = conflict?.conflictingRegistration;
+    const day = toSafeDate(c?.visitDate);
+    const when = `${day ? day.toLocaleDateString('zh-CN') : ''} ${c?.timeSlot || ''}`.trim();
+    switch (conflict?.rule) {
+        case 'same_doctor_same_day':
+            return `该病人当天已挂过这位医生的号（${when}），不能重复挂号。`;
+        case 'overlapping_time_slot':
+            return `该病人在 ${when} 已有其他挂号，时间段重叠。`;
+        case 'max_active_per_day':
+            return `该病人当天的有效挂号已达上限（${conflict.limit} 个）。`;
+        case 'max_active_per_week':
+            return `该病人本周的有效挂号已达上限（${conflict.limit} 个）。`;
+    }
+    if (conflict?.error === 'doctor is fully booked') {
+        return '该医生当天号源已满，请选择其他日期或医生。';
+    }
+    if (conflict?.error === 'invalid status transition') {
+        const text = (s) => REGISTRATION_STATUS_TEXT[s] || s;
+        const allowed = (conflict.allowedStatuses || []).map(text);
+        return `不能把挂号从「${text(conflict.from)}」改为「${text(conflict.to)}」。`
+            + (allowed.length ? `当前可改为：${allowed.join('、')}` : '当前没有可执行的状态变更。');
+    }
+    switch (conflict?.error) {
+        case 'check-in is only allowed on the visit date':
+            return '只能在就诊当天签到';
+        case 'cannot mark no-show before the visit date':
+            return '就诊日期之前不能标记爽约';
+        case 'a reason is required to cancel a registration':
+            return '取消挂号必须填写原因';
+    }
+    return conflict?.message || conflict?.error || '保存失败，请重试！';
+}
+
 async function loadReports() {
     try {
         if (typeof Chart === 'undefined') {
@@ -46,6 +46,24 @@ class RegistrationManager {
         return this.filteredRegistrations;
     }
 
+    // 查询医生在日期范围内的可预约时间段，用于生成挂号日历
+    async loadDoctorSlots(doctorId, startDate, endDate) {
+        try {
+            const params = new URLSearchParams({ id: doctorId });
+            if (startDate) params.set('startDate', startDate);
+            if (endDate) params.set('endDate', endDate);
+            const response = await apiFetch(`${API_BASE_URL}/doctors/getDoctorSlots?${params.toString()}`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+            const data = await response.json();
+            return data.days || [];
+        } catch (error) {
+            console.error('加载医生号源失败:', error);
+            return [];
+        }
+    }
+
     // 获取病人挂号记录
     async getPatientRegistrations(patientId) {
         try {